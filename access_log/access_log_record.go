@@ -2,6 +2,7 @@ package access_log
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -21,6 +22,52 @@ type AccessLogRecord struct {
 	BodyBytesSent        int
 	RequestBytesReceived int
 	ExtraHeadersToLog    []string
+
+	// Set when the request was forwarded to a route service.
+	RouteServiceHost    string
+	RouteServiceLatency time.Duration
+
+	// Set from the certificate the route service presented over TLS.
+	// Verified is false when validating it was skipped.
+	RouteServiceCertSubject  string
+	RouteServiceCertSANs     []string
+	RouteServiceCertVerified bool
+
+	// Set when the request came back from a route service, with a valid
+	// signature or with the reason it was rejected.
+	RouteServiceTraversed       bool
+	RouteServiceValidationError string
+}
+
+type jsonRecord struct {
+	Host                 string            `json:"host"`
+	StartedAt            string            `json:"start_time"`
+	Method               string            `json:"method"`
+	RequestURI           string            `json:"request_uri"`
+	Protocol             string            `json:"protocol"`
+	StatusCode           int               `json:"status_code"`
+	RequestBytesReceived int               `json:"request_bytes_received"`
+	BodyBytesSent        int               `json:"body_bytes_sent"`
+	Referer              string            `json:"referer"`
+	UserAgent            string            `json:"user_agent"`
+	RemoteAddr           string            `json:"remote_addr"`
+	XForwardedFor        string            `json:"x_forwarded_for"`
+	XForwardedProto      string            `json:"x_forwarded_proto"`
+	VcapRequestId        string            `json:"vcap_request_id"`
+	ResponseTime         *float64          `json:"response_time"`
+	AppId                string            `json:"app_id"`
+	ExtraHeaders         map[string]string `json:"extra_headers,omitempty"`
+	RouteService         jsonRouteService  `json:"route_service"`
+}
+
+type jsonRouteService struct {
+	Traversed       bool     `json:"traversed"`
+	Host            string   `json:"host,omitempty"`
+	Latency         *float64 `json:"latency,omitempty"`
+	ValidationError string   `json:"validation_error,omitempty"`
+	CertSubject     string   `json:"cert_subject,omitempty"`
+	CertSANs        []string `json:"cert_sans,omitempty"`
+	CertVerified    *bool    `json:"cert_verified,omitempty"`
 }
 
 func (r *AccessLogRecord) FormatStartedAt() string {
@@ -72,6 +119,16 @@ func (r *AccessLogRecord) makeRecord() *bytes.Buffer {
 		fmt.Fprintf(b, `app_id:%s`, r.RouteEndpoint.ApplicationId)
 	}
 
+	if r.RouteServiceHost != "" {
+		fmt.Fprintf(b, ` route_service_host:%s`, r.RouteServiceHost)
+	}
+
+	if r.hasRouteServiceCert() {
+		fmt.Fprintf(b, ` route_service_cert_subject:"%s"`, strings.Replace(r.RouteServiceCertSubject, "\"", "\\\"", -1))
+		fmt.Fprintf(b, ` route_service_cert_sans:"%s"`, strings.Join(r.RouteServiceCertSANs, ","))
+		fmt.Fprintf(b, ` route_service_cert_verified:%t`, r.RouteServiceCertVerified)
+	}
+
 	if r.ExtraHeadersToLog != nil && len(r.ExtraHeadersToLog) > 0 {
 		fmt.Fprintf(b, ` %s`, r.ExtraHeaders())
 	}
@@ -85,6 +142,64 @@ func (r *AccessLogRecord) WriteTo(w io.Writer) (int64, error) {
 	return recordBuffer.WriteTo(w)
 }
 
+// WriteJSONTo writes the record as a line of JSON. Times are in seconds and
+// missing values are null or empty rather than placeholders.
+func (r *AccessLogRecord) WriteJSONTo(w io.Writer) (int64, error) {
+	record := jsonRecord{
+		Host:                 r.Request.Host,
+		StartedAt:            r.StartedAt.Format(time.RFC3339Nano),
+		Method:               r.Request.Method,
+		RequestURI:           r.Request.URL.RequestURI(),
+		Protocol:             r.Request.Proto,
+		StatusCode:           r.StatusCode,
+		RequestBytesReceived: r.RequestBytesReceived,
+		BodyBytesSent:        r.BodyBytesSent,
+		Referer:              r.Request.Header.Get("Referer"),
+		UserAgent:            r.Request.Header.Get("User-Agent"),
+		RemoteAddr:           r.Request.RemoteAddr,
+		XForwardedFor:        r.Request.Header.Get("X-Forwarded-For"),
+		XForwardedProto:      r.Request.Header.Get("X-Forwarded-Proto"),
+		VcapRequestId:        r.Request.Header.Get("X-Vcap-Request-Id"),
+		AppId:                r.ApplicationId(),
+		RouteService: jsonRouteService{
+			Traversed:       r.RouteServiceTraversed,
+			Host:            r.RouteServiceHost,
+			ValidationError: r.RouteServiceValidationError,
+			CertSubject:     r.RouteServiceCertSubject,
+			CertSANs:        r.RouteServiceCertSANs,
+		},
+	}
+
+	if responseTime := r.ResponseTime(); responseTime >= 0 {
+		record.ResponseTime = &responseTime
+	}
+	if r.RouteServiceHost != "" {
+		latency := r.RouteServiceLatency.Seconds()
+		record.RouteService.Latency = &latency
+	}
+	if r.hasRouteServiceCert() {
+		verified := r.RouteServiceCertVerified
+		record.RouteService.CertVerified = &verified
+	}
+	if len(r.ExtraHeadersToLog) > 0 {
+		record.ExtraHeaders = make(map[string]string, len(r.ExtraHeadersToLog))
+		for _, header := range r.ExtraHeadersToLog {
+			record.ExtraHeaders[strings.Replace(strings.ToLower(header), "-", "_", -1)] = r.Request.Header.Get(header)
+		}
+	}
+
+	b, err := json.Marshal(record)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+func (r *AccessLogRecord) hasRouteServiceCert() bool {
+	return r.RouteServiceCertSubject != "" || len(r.RouteServiceCertSANs) > 0
+}
+
 func (r *AccessLogRecord) ApplicationId() string {
 	if r.RouteEndpoint == nil || r.RouteEndpoint.ApplicationId == "" {
 		return ""
@@ -8,6 +8,8 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"bytes"
+	"encoding/json"
 	"net/http"
 	"net/url"
 	"time"
@@ -104,6 +106,49 @@ var _ = Describe("AccessLogRecord", func() {
 		Expect(record.LogMessage()).To(Equal(""))
 	})
 
+	It("Appends the route service host if the request went through a route service", func() {
+		record := AccessLogRecord{
+			Request: &http.Request{
+				Host:   "FakeRequestHost",
+				Method: "FakeRequestMethod",
+				Proto:  "FakeRequestProto",
+				URL: &url.URL{
+					Opaque: "http://example.com/request",
+				},
+				Header: http.Header{
+					"Cache-Control": []string{"no-cache"},
+				},
+				RemoteAddr: "FakeRemoteAddr",
+			},
+			RouteEndpoint: &route.Endpoint{
+				ApplicationId: "FakeApplicationId",
+			},
+			StartedAt:         time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+			ExtraHeadersToLog: []string{"Cache-Control"},
+			RouteServiceHost:  "route-service.example.com",
+		}
+
+		recordString := "FakeRequestHost - " +
+			"[01/01/2000:00:00:00 +0000] " +
+			"\"FakeRequestMethod http://example.com/request FakeRequestProto\" " +
+			"MissingResponseStatusCode " +
+			"0 " +
+			"0 " +
+			"\"-\" " +
+			"\"-\" " +
+			"FakeRemoteAddr " +
+			"x_forwarded_for:\"-\" " +
+			"x_forwarded_proto:\"-\" " +
+			"vcap_request_id:- " +
+			"response_time:MissingFinishedAt " +
+			"app_id:FakeApplicationId " +
+			"route_service_host:route-service.example.com " +
+			"cache_control:\"no-cache\"" +
+			"\n"
+
+		Expect(record.LogMessage()).To(Equal(recordString))
+	})
+
 	It("Appends extra headers if specified", func() {
 		record := AccessLogRecord{
 			Request: &http.Request{
@@ -149,4 +194,154 @@ var _ = Describe("AccessLogRecord", func() {
 
 		Expect(record.LogMessage()).To(Equal(recordString))
 	})
+
+	Describe("WriteJSONTo", func() {
+		It("writes the record with its route service fields as JSON", func() {
+			record := AccessLogRecord{
+				Request: &http.Request{
+					Host:   "FakeRequestHost",
+					Method: "FakeRequestMethod",
+					Proto:  "FakeRequestProto",
+					URL: &url.URL{
+						Opaque: "http://example.com/request",
+					},
+					Header: http.Header{
+						"User-Agent":                    []string{"FakeUserAgent"},
+						"Cache-Control":                 []string{"no-cache"},
+						router_http.VcapRequestIdHeader: []string{"abc-123-xyz-pdq"},
+					},
+					RemoteAddr: "FakeRemoteAddr",
+				},
+				BodyBytesSent: 23,
+				StatusCode:    200,
+				RouteEndpoint: &route.Endpoint{
+					ApplicationId: "FakeApplicationId",
+				},
+				StartedAt:            time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+				FinishedAt:           time.Date(2000, time.January, 1, 0, 1, 0, 0, time.UTC),
+				RequestBytesReceived: 30,
+				ExtraHeadersToLog:    []string{"Cache-Control"},
+				RouteServiceHost:     "route-service.example.com",
+				RouteServiceLatency:  1500 * time.Millisecond,
+			}
+
+			var b bytes.Buffer
+			_, err := record.WriteJSONTo(&b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(b.String()).To(HaveSuffix("}\n"))
+			Expect(b.String()).To(MatchJSON(`{
+				"host": "FakeRequestHost",
+				"start_time": "2000-01-01T00:00:00Z",
+				"method": "FakeRequestMethod",
+				"request_uri": "http://example.com/request",
+				"protocol": "FakeRequestProto",
+				"status_code": 200,
+				"request_bytes_received": 30,
+				"body_bytes_sent": 23,
+				"referer": "",
+				"user_agent": "FakeUserAgent",
+				"remote_addr": "FakeRemoteAddr",
+				"x_forwarded_for": "",
+				"x_forwarded_proto": "",
+				"vcap_request_id": "abc-123-xyz-pdq",
+				"response_time": 60,
+				"app_id": "FakeApplicationId",
+				"extra_headers": {"cache_control": "no-cache"},
+				"route_service": {
+					"traversed": false,
+					"host": "route-service.example.com",
+					"latency": 1.5
+				}
+			}`))
+		})
+
+		It("records whether a returning request traversed the route service", func() {
+			record := AccessLogRecord{
+				Request: &http.Request{
+					Host:   "FakeRequestHost",
+					Method: "FakeRequestMethod",
+					URL:    &url.URL{Path: "/"},
+					Header: http.Header{},
+				},
+				StartedAt:                   time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+				RouteServiceValidationError: "Forwarded url does not match",
+			}
+
+			var b bytes.Buffer
+			_, err := record.WriteJSONTo(&b)
+			Expect(err).NotTo(HaveOccurred())
+
+			var decoded map[string]interface{}
+			Expect(json.Unmarshal(b.Bytes(), &decoded)).To(Succeed())
+			Expect(decoded["response_time"]).To(BeNil())
+			Expect(decoded["app_id"]).To(Equal(""))
+			Expect(decoded["route_service"]).To(Equal(map[string]interface{}{
+				"traversed":        false,
+				"validation_error": "Forwarded url does not match",
+			}))
+
+			record.RouteServiceValidationError = ""
+			record.RouteServiceTraversed = true
+			b.Reset()
+			_, err = record.WriteJSONTo(&b)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(json.Unmarshal(b.Bytes(), &decoded)).To(Succeed())
+			Expect(decoded["route_service"]).To(Equal(map[string]interface{}{"traversed": true}))
+		})
+
+		It("records the certificate the route service presented", func() {
+			record := AccessLogRecord{
+				Request: &http.Request{
+					Host:   "FakeRequestHost",
+					Method: "FakeRequestMethod",
+					URL:    &url.URL{Path: "/"},
+					Header: http.Header{},
+				},
+				StartedAt:               time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+				RouteServiceCertSubject: "CN=rs.example.com,O=Example",
+				RouteServiceCertSANs:    []string{"rs.example.com", "10.0.0.1"},
+			}
+
+			var b bytes.Buffer
+			_, err := record.WriteJSONTo(&b)
+			Expect(err).NotTo(HaveOccurred())
+
+			var decoded map[string]interface{}
+			Expect(json.Unmarshal(b.Bytes(), &decoded)).To(Succeed())
+			Expect(decoded["route_service"]).To(Equal(map[string]interface{}{
+				"traversed":     false,
+				"cert_subject":  "CN=rs.example.com,O=Example",
+				"cert_sans":     []interface{}{"rs.example.com", "10.0.0.1"},
+				"cert_verified": false,
+			}))
+		})
+	})
+
+	It("records the certificate the route service presented", func() {
+		record := AccessLogRecord{
+			Request: &http.Request{
+				Host:       "FakeRequestHost",
+				Method:     "FakeRequestMethod",
+				Proto:      "FakeRequestProto",
+				URL:        &url.URL{Opaque: "http://example.com/request"},
+				Header:     http.Header{},
+				RemoteAddr: "FakeRemoteAddr",
+			},
+			RouteEndpoint: &route.Endpoint{
+				ApplicationId: "FakeApplicationId",
+			},
+			StartedAt:                time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC),
+			RouteServiceHost:         "route-service.example.com",
+			RouteServiceCertSubject:  "CN=rs.example.com,O=Example",
+			RouteServiceCertSANs:     []string{"rs.example.com", "10.0.0.1"},
+			RouteServiceCertVerified: true,
+		}
+
+		Expect(record.LogMessage()).To(HaveSuffix("app_id:FakeApplicationId " +
+			"route_service_host:route-service.example.com " +
+			"route_service_cert_subject:\"CN=rs.example.com,O=Example\" " +
+			"route_service_cert_sans:\"rs.example.com,10.0.0.1\" " +
+			"route_service_cert_verified:true" +
+			"\n"))
+	})
 })
@@ -32,6 +32,7 @@ func CreateRunningAccessLogger(config *config.Config) (AccessLogger, error) {
 	}
 
 	accessLogger := NewFileAndLoggregatorAccessLogger(file, dropsondeSourceInstance)
+	accessLogger.SetJSONFormat(config.AccessLogFormat == "json")
 	go accessLogger.Run()
 	return accessLogger, nil
 }
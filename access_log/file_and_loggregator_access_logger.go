@@ -12,6 +12,7 @@ type FileAndLoggregatorAccessLogger struct {
 	channel                 chan AccessLogRecord
 	stopCh                  chan struct{}
 	writer                  io.Writer
+	json                    bool
 }
 
 func NewFileAndLoggregatorAccessLogger(f io.Writer, dropsondeSourceInstance string) *FileAndLoggregatorAccessLogger {
@@ -29,7 +30,9 @@ func (x *FileAndLoggregatorAccessLogger) Run() {
 	for {
 		select {
 		case record := <-x.channel:
-			if x.writer != nil {
+			if x.writer != nil && x.json {
+				record.WriteJSONTo(x.writer)
+			} else if x.writer != nil {
 				record.WriteTo(x.writer)
 			}
 
@@ -42,6 +45,12 @@ func (x *FileAndLoggregatorAccessLogger) Run() {
 	}
 }
 
+// SetJSONFormat writes records to the file as JSON rather than as lines.
+// Application logs sent to loggregator keep the line format.
+func (x *FileAndLoggregatorAccessLogger) SetJSONFormat(json bool) {
+	x.json = json
+}
+
 func (x *FileAndLoggregatorAccessLogger) FileWriter() io.Writer {
 	return x.writer
 }
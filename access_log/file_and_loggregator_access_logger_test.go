@@ -10,6 +10,7 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"encoding/json"
 	"net/http"
 	"net/url"
 	"time"
@@ -76,6 +77,28 @@ var _ = Describe("AccessLog", func() {
 
 			accessLogger.Stop()
 		})
+
+		It("writes JSON to the log file when the JSON format is set", func() {
+			var fakeFile = new(test_util.FakeFile)
+
+			accessLogger := NewFileAndLoggregatorAccessLogger(fakeFile, "")
+			accessLogger.SetJSONFormat(true)
+			go accessLogger.Run()
+			accessLogger.Log(*CreateAccessLogRecord())
+
+			var payload []byte
+			Eventually(func() int {
+				n, _ := fakeFile.Read(&payload)
+				return n
+			}).ShouldNot(Equal(0))
+
+			var record map[string]interface{}
+			Expect(json.Unmarshal(payload, &record)).To(Succeed())
+			Expect(record["host"]).To(Equal("foo.bar"))
+			Expect(record["route_service"]).To(Equal(map[string]interface{}{"traversed": false}))
+
+			accessLogger.Stop()
+		})
 	})
 
 	Measure("Log write speed", func(b Benchmarker) {
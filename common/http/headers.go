@@ -7,4 +7,14 @@ const (
 	VcapRequestIdHeader   = "X-Vcap-Request-Id"
 	VcapTraceHeader       = "X-Vcap-Trace"
 	CfInstanceIdHeader    = "X-CF-InstanceID"
+	CfAppIdHeader         = "X-CF-ApplicationID"
+
+	CfRouteServiceHandledHeader = "X-Cf-RouteServiceHandled"
+	CfRouteServiceUrlHeader     = "X-Cf-RouteServiceUrl"
+
+	B3TraceIdHeader      = "X-B3-TraceId"
+	B3SpanIdHeader       = "X-B3-SpanId"
+	B3ParentSpanIdHeader = "X-B3-ParentSpanId"
+	B3Header             = "B3"
+	TraceparentHeader    = "Traceparent"
 )
@@ -4,18 +4,61 @@ import (
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
+	"errors"
+	"io"
+
+	"github.com/cloudfoundry/gorouter/internal/cryptobuf"
 )
 
+var invalidNonceSize = errors.New("invalid nonce size")
+
+// Crypto seals and opens messages. The WithAAD variants also authenticate
+// associated data that is not part of the message: a message sealed with some
+// only opens with the same. Encrypt and Decrypt are those with none.
 type Crypto interface {
 	Encrypt(plainText []byte) (cipherText []byte, nonce []byte, err error)
 	Decrypt(cipherText, nonce []byte) ([]byte, error)
+	EncryptWithAAD(plainText, aad []byte) (cipherText []byte, nonce []byte, err error)
+	DecryptWithAAD(cipherText, nonce, aad []byte) ([]byte, error)
+}
+
+func init() {
+	cryptobuf.SealerFor = sealerFor
+}
+
+func sealerFor(crypto interface{}) cryptobuf.Sealer {
+	if gcm, ok := crypto.(*AesGCM); ok {
+		return gcmSealer{gcm}
+	}
+	return nil
+}
+
+// gcmSealer seals and opens into scratch buffers for the route service
+// headers, which are done with the result before the buffer is reused.
+type gcmSealer struct {
+	gcm *AesGCM
+}
+
+func (s gcmSealer) EncryptInto(buf *[]byte, plainText, aad []byte) ([]byte, []byte, error) {
+	return s.gcm.encryptInto(buf, plainText, aad)
+}
+
+func (s gcmSealer) DecryptInto(buf *[]byte, cipherText, nonce, aad []byte) ([]byte, error) {
+	return s.gcm.open(cryptobuf.Grow(buf, len(cipherText))[:0], cipherText, nonce, aad)
 }
 
 type AesGCM struct {
 	cipher.AEAD
+	random io.Reader
 }
 
 func NewAesGCM(key []byte) (*AesGCM, error) {
+	return NewAesGCMWithRandom(key, rand.Reader)
+}
+
+// NewAesGCMWithRandom reads nonces from random. A fixed reader makes the
+// output deterministic, for test vectors; it must never be used otherwise.
+func NewAesGCMWithRandom(key []byte, random io.Reader) (*AesGCM, error) {
 	aes, err := aes.NewCipher(key)
 	if err != nil {
 		return &AesGCM{}, err
@@ -26,40 +69,59 @@ func NewAesGCM(key []byte) (*AesGCM, error) {
 		return &AesGCM{}, err
 	}
 
-	aesGCM := AesGCM{aead}
+	aesGCM := AesGCM{AEAD: aead, random: random}
 	return &aesGCM, nil
 }
 
 func (gcm *AesGCM) Encrypt(plainText []byte) (cipherText, nonce []byte, err error) {
-	nonce, err = gcm.generateNonce()
+	return gcm.EncryptWithAAD(plainText, nil)
+}
+
+func (gcm *AesGCM) EncryptWithAAD(plainText, aad []byte) (cipherText, nonce []byte, err error) {
+	var buf []byte
+	return gcm.encryptInto(&buf, plainText, aad)
+}
+
+func (gcm *AesGCM) encryptInto(buf *[]byte, plainText, aad []byte) (cipherText, nonce []byte, err error) {
+	// The nonce and the sealed text share the buffer, with the nonce capped so
+	// that appending to it can never overwrite the cipher text.
+	nonceSize := gcm.NonceSize()
+	dst := cryptobuf.Grow(buf, nonceSize+len(plainText)+gcm.Overhead())
+	nonce = dst[:nonceSize:nonceSize]
+
+	err = gcm.generateNonce(nonce)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	cipherText = gcm.Seal(nil, nonce, plainText, []byte{})
+	cipherText = gcm.Seal(dst[nonceSize:nonceSize], nonce, plainText, aad)
 
 	return cipherText, nonce, nil
 }
 
 func (gcm *AesGCM) Decrypt(cipherText, nonce []byte) ([]byte, error) {
-	plainText, err := gcm.Open(nil, nonce, cipherText, []byte{})
-	if err != nil {
-		return nil, err
-	}
-
-	return plainText, nil
+	return gcm.DecryptWithAAD(cipherText, nonce, nil)
 }
 
-func (gcm *AesGCM) generateNonce() ([]byte, error) {
-	return randomBytes(uint(gcm.NonceSize()))
+func (gcm *AesGCM) DecryptWithAAD(cipherText, nonce, aad []byte) ([]byte, error) {
+	return gcm.open(nil, cipherText, nonce, aad)
 }
 
-func randomBytes(size uint) ([]byte, error) {
-	b := make([]byte, size)
-	_, err := rand.Read(b)
+func (gcm *AesGCM) open(dst, cipherText, nonce, aad []byte) ([]byte, error) {
+	// The nonce comes from request headers; Open panics on the wrong size.
+	if len(nonce) != gcm.NonceSize() {
+		return nil, invalidNonceSize
+	}
+
+	plainText, err := gcm.Open(dst, nonce, cipherText, aad)
 	if err != nil {
 		return nil, err
 	}
 
-	return b, nil
+	return plainText, nil
+}
+
+func (gcm *AesGCM) generateNonce(nonce []byte) error {
+	_, err := io.ReadFull(gcm.random, nonce)
+	return err
 }
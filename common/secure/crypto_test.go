@@ -1,9 +1,12 @@
 package secure_test
 
 import (
+	"bytes"
 	"encoding/base64"
+	"testing"
 
 	"github.com/cloudfoundry/gorouter/common/secure"
+	"github.com/cloudfoundry/gorouter/internal/cryptobuf"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -49,6 +52,30 @@ var _ = Describe("Crypto", func() {
 			})
 		})
 
+		Context("with a fixed random source", func() {
+			It("reads the nonce from it", func() {
+				fixedNonce := []byte("0123456789AB")
+				aesGcm, err := secure.NewAesGCMWithRandom(key, bytes.NewReader(fixedNonce))
+				Expect(err).ToNot(HaveOccurred())
+
+				cipherText, nonce, err := aesGcm.Encrypt(plainText)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(nonce).To(Equal(fixedNonce))
+
+				decryptedText, err := aesGcm.Decrypt(cipherText, nonce)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decryptedText).To(Equal(plainText))
+			})
+
+			It("fails once the source is exhausted", func() {
+				aesGcm, err := secure.NewAesGCMWithRandom(key, bytes.NewReader([]byte("short")))
+				Expect(err).ToNot(HaveOccurred())
+
+				_, _, err = aesGcm.Encrypt(plainText)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		Context("when the key is invalid", func() {
 			BeforeEach(func() {
 				key = []byte("invalid key")
@@ -99,6 +126,17 @@ var _ = Describe("Crypto", func() {
 			})
 		})
 
+		Context("when the nonce is the wrong size", func() {
+			It("returns an error", func() {
+				for _, otherNonce := range [][]byte{nil, []byte("short"), []byte("0123456789ABCDEF")} {
+					decryptedText, err := aesGcm.Decrypt(cipherText, otherNonce)
+					Expect(err).To(HaveOccurred())
+					Expect(err.Error()).Should(ContainSubstring("invalid nonce size"))
+					Expect(decryptedText).To(BeNil())
+				}
+			})
+		})
+
 		Context("when using an invalid nonce", func() {
 			It("returns an error", func() {
 				otherNonce := []byte("0123456789AB")
@@ -109,4 +147,118 @@ var _ = Describe("Crypto", func() {
 			})
 		})
 	})
+
+	Describe("DecryptWithAAD", func() {
+		var (
+			plainText  = []byte("this is a secret message!")
+			aad        = []byte("my_host.com/path")
+			cipherText []byte
+			nonce      []byte
+		)
+
+		BeforeEach(func() {
+			var err error
+			cipherText, nonce, err = aesGcm.EncryptWithAAD(plainText, aad)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("decrypts the cipher text with the same associated data", func() {
+			decryptedText, err := aesGcm.DecryptWithAAD(cipherText, nonce, aad)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decryptedText).To(Equal(plainText))
+		})
+
+		It("fails with other associated data", func() {
+			_, err := aesGcm.DecryptWithAAD(cipherText, nonce, []byte("other_host.com/path"))
+			Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("fails without associated data", func() {
+			_, err := aesGcm.Decrypt(cipherText, nonce)
+			Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+		})
+	})
+
+	Describe("EncryptInto and DecryptInto", func() {
+		var (
+			plainText = []byte("this is a secret message!")
+			aad       = []byte("my_host.com/path")
+			buffered  cryptobuf.Sealer
+			buf       *[]byte
+		)
+
+		BeforeEach(func() {
+			buffered = cryptobuf.SealerFor(aesGcm)
+			buf = cryptobuf.Get()
+		})
+
+		AfterEach(func() {
+			cryptobuf.Put(buf)
+		})
+
+		It("seals into the buffer what DecryptWithAAD opens", func() {
+			cipherText, nonce, err := buffered.EncryptInto(buf, plainText, aad)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nonce).To(HaveLen(12))
+			Expect(cap(*buf)).To(BeNumerically(">=", len(nonce)+len(cipherText)))
+
+			decryptedText, err := aesGcm.DecryptWithAAD(cipherText, nonce, aad)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decryptedText).To(Equal(plainText))
+		})
+
+		It("opens into the buffer what EncryptWithAAD seals", func() {
+			cipherText, nonce, err := aesGcm.EncryptWithAAD(plainText, aad)
+			Expect(err).ToNot(HaveOccurred())
+
+			decryptedText, err := buffered.DecryptInto(buf, cipherText, nonce, aad)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decryptedText).To(Equal(plainText))
+
+			_, err = buffered.DecryptInto(buf, cipherText, nonce, nil)
+			Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("rejects a nonce of the wrong size", func() {
+			cipherText, _, err := aesGcm.Encrypt(plainText)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = buffered.DecryptInto(buf, cipherText, []byte("short"), nil)
+			Expect(err).To(MatchError(ContainSubstring("invalid nonce size")))
+		})
+	})
+
+	Measure("Encrypt", func(b Benchmarker) {
+		plainText := []byte("this is a secret message!")
+
+		allocs := testing.AllocsPerRun(100, func() {
+			aesGcm.Encrypt(plainText)
+		})
+		b.RecordValue("allocations per op", allocs)
+		Expect(allocs).To(BeNumerically("<=", 1))
+
+		buf := cryptobuf.Get()
+		defer cryptobuf.Put(buf)
+		buffered := cryptobuf.SealerFor(aesGcm)
+
+		cipherText, nonce, err := aesGcm.Encrypt(plainText)
+		Expect(err).ToNot(HaveOccurred())
+		decryptAllocs := testing.AllocsPerRun(100, func() {
+			aesGcm.Decrypt(cipherText, nonce)
+		})
+		b.RecordValue("allocations per decrypt", decryptAllocs)
+
+		bufferedAllocs := testing.AllocsPerRun(100, func() {
+			buffered.EncryptInto(buf, plainText, nil)
+			buffered.DecryptInto(buf, cipherText, nonce, nil)
+		})
+		b.RecordValue("allocations per encrypt and decrypt into a buffer", bufferedAllocs)
+		Expect(bufferedAllocs).To(BeNumerically("<", allocs+decryptAllocs))
+
+		b.Time("1000 encryptions", func() {
+			for i := 0; i < 1000; i++ {
+				aesGcm.Encrypt(plainText)
+			}
+		})
+	}, 10)
 })
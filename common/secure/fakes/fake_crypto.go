@@ -28,6 +28,28 @@ type FakeCrypto struct {
 		result1 []byte
 		result2 error
 	}
+	EncryptWithAADStub        func(plainText, aad []byte) (cipherText []byte, nonce []byte, err error)
+	encryptWithAADMutex       sync.RWMutex
+	encryptWithAADArgsForCall []struct {
+		plainText []byte
+		aad       []byte
+	}
+	encryptWithAADReturns struct {
+		result1 []byte
+		result2 []byte
+		result3 error
+	}
+	DecryptWithAADStub        func(cipherText, nonce, aad []byte) ([]byte, error)
+	decryptWithAADMutex       sync.RWMutex
+	decryptWithAADArgsForCall []struct {
+		cipherText []byte
+		nonce      []byte
+		aad        []byte
+	}
+	decryptWithAADReturns struct {
+		result1 []byte
+		result2 error
+	}
 }
 
 func (fake *FakeCrypto) Encrypt(plainText []byte) (cipherText []byte, nonce []byte, err error) {
@@ -98,4 +120,74 @@ func (fake *FakeCrypto) DecryptReturns(result1 []byte, result2 error) {
 	}{result1, result2}
 }
 
+func (fake *FakeCrypto) EncryptWithAAD(plainText []byte, aad []byte) (cipherText []byte, nonce []byte, err error) {
+	fake.encryptWithAADMutex.Lock()
+	fake.encryptWithAADArgsForCall = append(fake.encryptWithAADArgsForCall, struct {
+		plainText []byte
+		aad       []byte
+	}{plainText, aad})
+	fake.encryptWithAADMutex.Unlock()
+	if fake.EncryptWithAADStub != nil {
+		return fake.EncryptWithAADStub(plainText, aad)
+	} else {
+		return fake.encryptWithAADReturns.result1, fake.encryptWithAADReturns.result2, fake.encryptWithAADReturns.result3
+	}
+}
+
+func (fake *FakeCrypto) EncryptWithAADCallCount() int {
+	fake.encryptWithAADMutex.RLock()
+	defer fake.encryptWithAADMutex.RUnlock()
+	return len(fake.encryptWithAADArgsForCall)
+}
+
+func (fake *FakeCrypto) EncryptWithAADArgsForCall(i int) ([]byte, []byte) {
+	fake.encryptWithAADMutex.RLock()
+	defer fake.encryptWithAADMutex.RUnlock()
+	return fake.encryptWithAADArgsForCall[i].plainText, fake.encryptWithAADArgsForCall[i].aad
+}
+
+func (fake *FakeCrypto) EncryptWithAADReturns(result1 []byte, result2 []byte, result3 error) {
+	fake.EncryptWithAADStub = nil
+	fake.encryptWithAADReturns = struct {
+		result1 []byte
+		result2 []byte
+		result3 error
+	}{result1, result2, result3}
+}
+
+func (fake *FakeCrypto) DecryptWithAAD(cipherText []byte, nonce []byte, aad []byte) ([]byte, error) {
+	fake.decryptWithAADMutex.Lock()
+	fake.decryptWithAADArgsForCall = append(fake.decryptWithAADArgsForCall, struct {
+		cipherText []byte
+		nonce      []byte
+		aad        []byte
+	}{cipherText, nonce, aad})
+	fake.decryptWithAADMutex.Unlock()
+	if fake.DecryptWithAADStub != nil {
+		return fake.DecryptWithAADStub(cipherText, nonce, aad)
+	} else {
+		return fake.decryptWithAADReturns.result1, fake.decryptWithAADReturns.result2
+	}
+}
+
+func (fake *FakeCrypto) DecryptWithAADCallCount() int {
+	fake.decryptWithAADMutex.RLock()
+	defer fake.decryptWithAADMutex.RUnlock()
+	return len(fake.decryptWithAADArgsForCall)
+}
+
+func (fake *FakeCrypto) DecryptWithAADArgsForCall(i int) ([]byte, []byte, []byte) {
+	fake.decryptWithAADMutex.RLock()
+	defer fake.decryptWithAADMutex.RUnlock()
+	return fake.decryptWithAADArgsForCall[i].cipherText, fake.decryptWithAADArgsForCall[i].nonce, fake.decryptWithAADArgsForCall[i].aad
+}
+
+func (fake *FakeCrypto) DecryptWithAADReturns(result1 []byte, result2 error) {
+	fake.DecryptWithAADStub = nil
+	fake.decryptWithAADReturns = struct {
+		result1 []byte
+		result2 error
+	}{result1, result2}
+}
+
 var _ secure.Crypto = new(FakeCrypto)
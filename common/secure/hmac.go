@@ -0,0 +1,86 @@
+package secure
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const hmacNonceSize = 12
+
+var hmacInvalidKeySize = errors.New("hmac: invalid key size")
+var hmacAuthenticationFailed = errors.New("hmac: message authentication failed")
+
+// HMACSigner protects the integrity of messages without hiding them. Its
+// "cipher text" is the plain text followed by an HMAC-SHA256 tag over the
+// nonce and the plain text, so it can stand in for AesGCM where the signed
+// fields are not secret. Associated data is covered by the tag, prefixed with
+// its length, but not carried.
+type HMACSigner struct {
+	key []byte
+}
+
+func NewHMACSigner(key []byte) (*HMACSigner, error) {
+	if len(key) < 16 {
+		return &HMACSigner{}, hmacInvalidKeySize
+	}
+
+	return &HMACSigner{key: append([]byte{}, key...)}, nil
+}
+
+func (s *HMACSigner) Encrypt(plainText []byte) (cipherText, nonce []byte, err error) {
+	return s.EncryptWithAAD(plainText, nil)
+}
+
+func (s *HMACSigner) EncryptWithAAD(plainText, aad []byte) (cipherText, nonce []byte, err error) {
+	buf := make([]byte, hmacNonceSize, hmacNonceSize+len(plainText)+sha256.Size)
+	nonce = buf[:hmacNonceSize:hmacNonceSize]
+
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cipherText = append(buf[hmacNonceSize:], plainText...)
+	cipherText = s.sum(cipherText, nonce, aad, plainText)
+
+	return cipherText, nonce, nil
+}
+
+func (s *HMACSigner) Decrypt(cipherText, nonce []byte) ([]byte, error) {
+	return s.DecryptWithAAD(cipherText, nonce, nil)
+}
+
+func (s *HMACSigner) DecryptWithAAD(cipherText, nonce, aad []byte) ([]byte, error) {
+	if len(nonce) != hmacNonceSize {
+		return nil, invalidNonceSize
+	}
+	if len(cipherText) < sha256.Size {
+		return nil, hmacAuthenticationFailed
+	}
+
+	split := len(cipherText) - sha256.Size
+	plainText, tag := cipherText[:split], cipherText[split:]
+
+	if !hmac.Equal(tag, s.sum(nil, nonce, aad, plainText)) {
+		return nil, hmacAuthenticationFailed
+	}
+
+	return append([]byte{}, plainText...), nil
+}
+
+// Without associated data the tag is the one from before it was supported.
+func (s *HMACSigner) sum(dst, nonce, aad, plainText []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(nonce)
+	if len(aad) > 0 {
+		var length [8]byte
+		binary.BigEndian.PutUint64(length[:], uint64(len(aad)))
+		mac.Write(length[:])
+		mac.Write(aad)
+	}
+	mac.Write(plainText)
+	return mac.Sum(dst)
+}
@@ -0,0 +1,154 @@
+package secure_test
+
+import (
+	"encoding/base64"
+	"testing"
+
+	"github.com/cloudfoundry/gorouter/common/secure"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("HMACSigner", func() {
+
+	var (
+		signer    secure.Crypto
+		plainText = []byte("this is a signed message!")
+	)
+
+	BeforeEach(func() {
+		key, err := base64.StdEncoding.DecodeString("6TuytRTJPal4fXkAD5lwZA==")
+		Expect(err).ToNot(HaveOccurred())
+		signer, err = secure.NewHMACSigner(key)
+		Expect(err).ToNot(HaveOccurred())
+	})
+
+	Context("when the key is too short", func() {
+		It("returns an invalid key size error", func() {
+			_, err := secure.NewHMACSigner([]byte("short key"))
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("invalid key size"))
+		})
+	})
+
+	Describe("Encrypt", func() {
+		It("signs the plain text without hiding it and returns a nonce", func() {
+			cipherText, nonce, err := signer.Encrypt(plainText)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cipherText[:len(plainText)]).To(Equal(plainText))
+			Expect(cipherText).To(HaveLen(len(plainText) + 32))
+			Expect(nonce).To(HaveLen(12))
+		})
+
+		It("returns a different nonce and tag for the same plain text", func() {
+			cipherText, nonce, err := signer.Encrypt(plainText)
+			Expect(err).ToNot(HaveOccurred())
+
+			cipherText2, nonce2, err := signer.Encrypt(plainText)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(cipherText).ToNot(Equal(cipherText2))
+			Expect(nonce).ToNot(Equal(nonce2))
+		})
+	})
+
+	Describe("Decrypt", func() {
+		var (
+			cipherText []byte
+			nonce      []byte
+		)
+
+		BeforeEach(func() {
+			var err error
+			cipherText, nonce, err = signer.Encrypt(plainText)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("verifies and returns the plain text", func() {
+			verified, err := signer.Decrypt(cipherText, nonce)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(verified).To(Equal(plainText))
+		})
+
+		It("rejects a tampered message", func() {
+			cipherText[0] ^= 1
+			_, err := signer.Decrypt(cipherText, nonce)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).Should(ContainSubstring("authentication failed"))
+		})
+
+		It("rejects a message signed with another key", func() {
+			other, err := secure.NewHMACSigner([]byte("0123456789ABCDEF"))
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = other.Decrypt(cipherText, nonce)
+			Expect(err).Should(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("rejects a different nonce", func() {
+			_, err := signer.Decrypt(cipherText, []byte("0123456789AB"))
+			Expect(err).Should(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("rejects a nonce of the wrong size", func() {
+			_, err := signer.Decrypt(cipherText, []byte("short"))
+			Expect(err).Should(MatchError(ContainSubstring("invalid nonce size")))
+		})
+
+		It("rejects a message shorter than the tag", func() {
+			_, err := signer.Decrypt(cipherText[:8], nonce)
+			Expect(err).Should(MatchError(ContainSubstring("authentication failed")))
+		})
+	})
+
+	Describe("DecryptWithAAD", func() {
+		var (
+			aad        = []byte("my_host.com/path")
+			cipherText []byte
+			nonce      []byte
+		)
+
+		BeforeEach(func() {
+			var err error
+			cipherText, nonce, err = signer.EncryptWithAAD(plainText, aad)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("verifies the message with the same associated data, which it does not carry", func() {
+			verified, err := signer.DecryptWithAAD(cipherText, nonce, aad)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(verified).To(Equal(plainText))
+			Expect(string(cipherText)).NotTo(ContainSubstring(string(aad)))
+		})
+
+		It("rejects other associated data", func() {
+			_, err := signer.DecryptWithAAD(cipherText, nonce, []byte("other_host.com/path"))
+			Expect(err).Should(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("rejects the message without associated data", func() {
+			_, err := signer.Decrypt(cipherText, nonce)
+			Expect(err).Should(MatchError(ContainSubstring("authentication failed")))
+		})
+	})
+
+	Measure("Encrypt and Decrypt", func(b Benchmarker) {
+		cipherText, nonce, err := signer.Encrypt(plainText)
+		Expect(err).ToNot(HaveOccurred())
+
+		b.RecordValue("allocations per sign", testing.AllocsPerRun(100, func() {
+			signer.Encrypt(plainText)
+		}))
+
+		b.Time("1000 signatures", func() {
+			for i := 0; i < 1000; i++ {
+				signer.Encrypt(plainText)
+			}
+		})
+
+		b.Time("1000 verifications", func() {
+			for i := 0; i < 1000; i++ {
+				signer.Decrypt(cipherText, nonce)
+			}
+		})
+	}, 10)
+})
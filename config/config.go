@@ -2,8 +2,11 @@ package config
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"fmt"
+	"net"
 	"net/url"
+	"path"
 
 	"github.com/cloudfoundry-incubator/candiedyaml"
 	token_fetcher "github.com/cloudfoundry-incubator/uaa-token-fetcher"
@@ -64,10 +67,29 @@ var defaultLoggingConfig = LoggingConfig{
 	MetronAddress: "localhost:3457",
 }
 
+const (
+	SignatureModeAesGcm = "aes-gcm"
+	SignatureModeHmac   = "hmac"
+)
+
+// RouteServiceClientCertConfig is a client certificate presented to route
+// services. One without a host is presented to every route service without
+// one of its own.
+type RouteServiceClientCertConfig struct {
+	Host     string `yaml:"host"`
+	CertPath string `yaml:"cert_path"`
+	KeyPath  string `yaml:"key_path"`
+}
+
+type TracingConfig struct {
+	EnableZipkin bool `yaml:"enable_zipkin"`
+}
+
 type Config struct {
 	Status  StatusConfig  `yaml:"status"`
 	Nats    []NatsConfig  `yaml:"nats"`
 	Logging LoggingConfig `yaml:"logging"`
+	Tracing TracingConfig `yaml:"tracing"`
 
 	Port              uint16 `yaml:"port"`
 	Index             uint   `yaml:"index"`
@@ -75,6 +97,7 @@ type Config struct {
 	GoMaxProcs        int    `yaml:"go_max_procs,omitempty"`
 	TraceKey          string `yaml:"trace_key"`
 	AccessLog         string `yaml:"access_log"`
+	AccessLogFormat   string `yaml:"access_log_format"` // "line" or "json"
 	DebugAddr         string `yaml:"debug_addr"`
 	EnableSSL         bool   `yaml:"enable_ssl"`
 	SSLPort           uint16 `yaml:"ssl_port"`
@@ -102,18 +125,190 @@ type Config struct {
 	RouteServiceSecret     string                    `yaml:"route_services_secret"`
 	RouteServiceSecretPrev string                    `yaml:"route_services_secret_decrypt_only"`
 
+	RouteServiceReservedHeaders []string `yaml:"route_services_reserved_headers"`
+	RouteServiceHopByHopHeaders []string `yaml:"route_services_hop_by_hop_headers"`
+	RouteServiceResponseHeaders []string `yaml:"route_services_stripped_response_headers"`
+	RouteServiceEnforce         bool     `yaml:"route_services_enforce"`
+
+	RouteServiceMaxForwardedUrlLength int `yaml:"route_services_max_forwarded_url_length"`
+
+	RouteServiceMaxIdleConnsPerHost      int `yaml:"route_services_max_idle_conns_per_host"`
+	RouteServiceIdleConnTimeoutInSeconds int `yaml:"route_services_idle_conn_timeout"`
+
+	// Connecting to a route service fails after this many milliseconds, so
+	// that unreachable ones fail fast. Waiting for the response is bounded by
+	// endpoint_timeout instead.
+	RouteServiceDialTimeoutInMilliseconds int `yaml:"route_services_dial_timeout_in_ms"`
+
+	RouteServiceSignatureHeader    string `yaml:"route_services_signature_header"`
+	RouteServiceMetadataHeader     string `yaml:"route_services_metadata_header"`
+	RouteServiceForwardedUrlHeader string `yaml:"route_services_forwarded_url_header"`
+
+	RouteServiceRejectRedirects bool `yaml:"route_services_reject_redirects"`
+
+	RouteServiceCompressionThreshold int `yaml:"route_services_compression_threshold"`
+
+	RouteServiceDeniedHosts []string `yaml:"route_services_denied_hosts"`
+
+	// Glob patterns, matched against the route key or its host, of the routes
+	// that may be bound to a route service. Empty allows all routes.
+	RouteServiceAllowedRoutes []string `yaml:"route_services_allowed_routes"`
+
+	// Glob patterns of request paths that may return from a route service
+	// without the X-CF-Forwarded-Url header, such as health probes. Their
+	// signature is validated against the url of the request instead.
+	RouteServiceForwardedUrlOptionalPaths []string `yaml:"route_services_forwarded_url_optional_paths"`
+
+	// Either "aes-gcm", which encrypts the signature, or "hmac", which only
+	// authenticates it.
+	RouteServiceSignatureMode string `yaml:"route_services_signature_mode"`
+
+	// Refuse to start when a route service key fails its self check, rather
+	// than start with the load balancer heartbeat failing.
+	RouteServiceFailClosed bool `yaml:"route_services_fail_closed"`
+
+	RouteServiceRetries                  int `yaml:"route_services_retries"`
+	RouteServiceRetryDelayInMilliseconds int `yaml:"route_services_retry_delay_in_ms"`
+
+	// Retries of requests returning from a route service to the backend, for
+	// failures to connect and, for idempotent requests, to get a response.
+	RouteServiceBackendRetries int `yaml:"route_services_backend_retries"`
+
+	// TLS server names to present to route services, by the host of their
+	// registered url, for when it differs from the name on their certificate.
+	RouteServiceServerNames map[string]string `yaml:"route_services_server_names"`
+
+	RouteServiceStripForwardedUrlFragment bool `yaml:"route_services_strip_forwarded_url_fragment"`
+
+	// Binds signatures to the application of the route, so that one minted
+	// for a route of one app is rejected on a route of another.
+	RouteServiceBindAppGuid bool `yaml:"route_services_bind_app_guid"`
+
+	// Signs the key of the matched route, and sends it to route services in
+	// the X-CF-Route-Key header.
+	RouteServiceSignRouteKey bool `yaml:"route_services_sign_route_key"`
+
+	// Seals signatures with the key of the matched route as associated data,
+	// so that requests returning with them are only accepted for that route.
+	// Every router validating them must have it set too.
+	RouteServiceBindRouteKey bool `yaml:"route_services_bind_route_key"`
+
+	// Removes the signature and metadata headers from requests for routes
+	// without a route service, unless they were registered as route service
+	// instances. Off by default, as Cloud Controller does not register them so.
+	RouteServiceStripSignatureFromApps bool `yaml:"route_services_strip_signature_from_apps"`
+
+	// Signs the address requests were received from, and sends it to route
+	// services in the X-CF-Client-IP header.
+	RouteServiceSignClientIP bool `yaml:"route_services_sign_client_ip"`
+
+	// Sign the forwarded url as https when the client connected over TLS,
+	// rather than always as http.
+	RouteServiceForwardedUrlClientScheme bool `yaml:"route_services_forwarded_url_client_scheme"`
+
+	// With RouteServiceForwardedUrlClientScheme, take the scheme from
+	// X-Forwarded-Proto when it is present, for when TLS is terminated in
+	// front of the router.
+	RouteServiceTrustForwardedProto bool `yaml:"route_services_trust_forwarded_proto"`
+
+	// Answer 421 Misdirected Request rather than 400 when the forwarded url
+	// returned by a route service is for another host than the request.
+	RouteServiceMisdirectedOnHostMismatch bool `yaml:"route_services_misdirected_on_host_mismatch"`
+
+	// Accept forwarded urls returned by route services with port 80 or 443
+	// added to or removed from the host.
+	RouteServiceIgnoreDefaultPorts bool `yaml:"route_services_ignore_default_ports"`
+
+	// Accept forwarded urls returned by route services with path segments
+	// appended, see route_service.RouteServiceConfig.SetAllowPathExtensions.
+	RouteServiceAllowPathExtensions bool `yaml:"route_services_allow_path_extensions"`
+
+	// Sign and send forwarded urls in canonical form, see
+	// route_service.CanonicalForwardedUrl.
+	RouteServiceCanonicalForwardedUrls bool `yaml:"route_services_canonical_forwarded_urls"`
+
+	// Route service responses with longer bodies fail. Zero is unlimited.
+	RouteServiceMaxResponseBytes int64 `yaml:"route_services_max_response_bytes"`
+
+	// Name the host of the route service a request went through in the
+	// X-Cf-RouteServiceUrl response header. For debugging only, as it
+	// exposes the route services to clients.
+	RouteServiceDebugHeader bool `yaml:"route_services_debug_header"`
+
+	// Requests sent to route services more times than this, e.g. by route
+	// services forwarding to one another in a loop, fail. Zero is unlimited.
+	RouteServiceMaxHops int `yaml:"route_services_max_hops"`
+
+	// An https route service for routes registered without one, e.g. to put
+	// every route behind a WAF. Ignored when route services are disabled.
+	DefaultRouteServiceUrl string `yaml:"default_route_service_url"`
+
+	// Requests to route services beyond this many in flight fail at once
+	// with a 503, so that a slow route service cannot pile them up. Zero is
+	// unlimited.
+	RouteServiceMaxInFlight int `yaml:"route_services_max_in_flight"`
+
+	// Name this router, by its IP and index, in the signatures it mints.
+	RouteServiceSignIssuer bool `yaml:"route_services_sign_issuer"`
+
+	// Log one in every this many route service signature validation
+	// failures, all of which are counted. Zero or one logs every failure.
+	RouteServiceValidationFailureLogSampleRate int `yaml:"route_services_validation_failure_log_sample_rate"`
+
+	// Either "1.2" or "1.3".
+	RouteServiceMinTLSVersionString string `yaml:"route_services_min_tls_version"`
+
+	// The base64 encoding of the signature and metadata headers: "url", the
+	// default, "raw_url" or "std".
+	RouteServiceHeaderEncodingString string `yaml:"route_services_header_encoding"`
+
+	RouteServiceClientCerts []RouteServiceClientCertConfig `yaml:"route_services_client_certs"`
+
+	// An http:// forward proxy that connections to route services tunnel
+	// through with CONNECT. Empty, the default, connects directly. Cannot be
+	// combined with per-host server names or client certificates.
+	RouteServiceProxyUrlString string `yaml:"route_services_proxy_url"`
+
+	// Signatures expired for less than this many seconds are still accepted,
+	// and flagged to the backend. Zero, the default, gives no grace.
+	RouteServiceExpiryGraceInSeconds int `yaml:"route_services_expiry_grace"`
+
+	// Secrets of their own for the route services of these hosts, signed for
+	// and validated with instead of route_services_secret, in the
+	// route_services_signature_mode.
+	RouteServiceHostSecrets map[string]string `yaml:"route_services_host_secrets"`
+
 	// These fields are populated by the `Process` function.
-	PruneStaleDropletsInterval time.Duration `yaml:"-"`
-	DropletStaleThreshold      time.Duration `yaml:"-"`
-	PublishActiveAppsInterval  time.Duration `yaml:"-"`
-	StartResponseDelayInterval time.Duration `yaml:"-"`
-	EndpointTimeout            time.Duration `yaml:"-"`
-	RouteServiceTimeout        time.Duration `yaml:"-"`
-	DrainTimeout               time.Duration `yaml:"-"`
-	Ip                         string        `yaml:"-"`
-	RouteServiceEnabled        bool          `yaml:"-"`
+	PruneStaleDropletsInterval  time.Duration `yaml:"-"`
+	DropletStaleThreshold       time.Duration `yaml:"-"`
+	PublishActiveAppsInterval   time.Duration `yaml:"-"`
+	StartResponseDelayInterval  time.Duration `yaml:"-"`
+	EndpointTimeout             time.Duration `yaml:"-"`
+	RouteServiceTimeout         time.Duration `yaml:"-"`
+	RouteServiceIdleConnTimeout time.Duration `yaml:"-"`
+	RouteServiceRetryDelay      time.Duration `yaml:"-"`
+	RouteServiceDialTimeout     time.Duration `yaml:"-"`
+	RouteServiceExpiryGrace     time.Duration `yaml:"-"`
+	RouteServiceMinTLSVersion   uint16        `yaml:"-"`
+	DrainTimeout                time.Duration `yaml:"-"`
+	Ip                          string        `yaml:"-"`
+	RouteServiceEnabled         bool          `yaml:"-"`
+
+	// Loaded from RouteServiceClientCerts, by host.
+	RouteServiceClientCertificates map[string]tls.Certificate `yaml:"-"`
+
+	RouteServiceHeaderEncoding *base64.Encoding `yaml:"-"`
+
+	RouteServiceProxyUrl *url.URL `yaml:"-"`
+
+	// Set from Ip and Index when RouteServiceSignIssuer is.
+	RouteServiceIssuer string `yaml:"-"`
 
 	ExtraHeadersToLog []string `yaml:"extra_headers_to_log"`
+
+	// Responses of these content types are gzipped for clients accepting
+	// gzip. Empty, the default, disables compression.
+	GzipContentTypes []string `yaml:"gzip_content_types"`
 }
 
 var defaultConfig = Config{
@@ -129,6 +324,25 @@ var defaultConfig = Config{
 
 	EndpointTimeoutInSeconds:     60,
 	RouteServiceTimeoutInSeconds: 60,
+	RouteServiceEnforce:          true,
+
+	RouteServiceMaxForwardedUrlLength: 8 * 1024,
+
+	RouteServiceMaxIdleConnsPerHost:      100,
+	RouteServiceIdleConnTimeoutInSeconds: 90,
+
+	RouteServiceDialTimeoutInMilliseconds: 5000,
+
+	RouteServiceSignatureMode: SignatureModeAesGcm,
+
+	RouteServiceRetries:        2,
+	RouteServiceBackendRetries: 2,
+
+	RouteServiceMinTLSVersionString: "1.2",
+
+	RouteServiceHeaderEncodingString: "url",
+
+	AccessLogFormat: "line",
 
 	PublishStartMessageIntervalInSeconds: 30,
 	PruneStaleDropletsIntervalInSeconds:  30,
@@ -158,6 +372,10 @@ func (c *Config) Process() {
 	c.StartResponseDelayInterval = time.Duration(c.StartResponseDelayIntervalInSeconds) * time.Second
 	c.EndpointTimeout = time.Duration(c.EndpointTimeoutInSeconds) * time.Second
 	c.RouteServiceTimeout = time.Duration(c.RouteServiceTimeoutInSeconds) * time.Second
+	c.RouteServiceIdleConnTimeout = time.Duration(c.RouteServiceIdleConnTimeoutInSeconds) * time.Second
+	c.RouteServiceRetryDelay = time.Duration(c.RouteServiceRetryDelayInMilliseconds) * time.Millisecond
+	c.RouteServiceDialTimeout = time.Duration(c.RouteServiceDialTimeoutInMilliseconds) * time.Millisecond
+	c.RouteServiceExpiryGrace = time.Duration(c.RouteServiceExpiryGraceInSeconds) * time.Second
 	c.Logging.JobName = "router_" + c.Zone + "_" + strconv.Itoa(int(c.Index))
 
 	if c.StartResponseDelayInterval > c.DropletStaleThreshold {
@@ -189,6 +407,116 @@ func (c *Config) Process() {
 	if c.RouteServiceSecret != "" {
 		c.RouteServiceEnabled = true
 	}
+
+	if len(c.RouteServiceClientCerts) > 0 {
+		c.RouteServiceClientCertificates = make(map[string]tls.Certificate, len(c.RouteServiceClientCerts))
+		for _, clientCert := range c.RouteServiceClientCerts {
+			if _, ok := c.RouteServiceClientCertificates[clientCert.Host]; ok {
+				panic(fmt.Sprintf("duplicate route service client certificate for host: %q", clientCert.Host))
+			}
+			cert, err := tls.LoadX509KeyPair(clientCert.CertPath, clientCert.KeyPath)
+			if err != nil {
+				panic(err)
+			}
+			c.RouteServiceClientCertificates[clientCert.Host] = cert
+		}
+	}
+
+	if c.RouteServiceEnabled && c.RouteServiceTimeout <= 0 {
+		panic(fmt.Sprintf("invalid route service timeout: %s, must be positive", c.RouteServiceTimeout))
+	}
+
+	if c.RouteServiceRetries < 0 {
+		panic(fmt.Sprintf("invalid route service retries: %d, must not be negative", c.RouteServiceRetries))
+	}
+
+	if c.RouteServiceRetryDelay < 0 {
+		panic(fmt.Sprintf("invalid route service retry delay: %s, must not be negative", c.RouteServiceRetryDelay))
+	}
+
+	if c.RouteServiceSignatureMode != SignatureModeAesGcm && c.RouteServiceSignatureMode != SignatureModeHmac {
+		panic(fmt.Sprintf("invalid route service signature mode: %q", c.RouteServiceSignatureMode))
+	}
+
+	switch c.RouteServiceMinTLSVersionString {
+	case "1.2":
+		c.RouteServiceMinTLSVersion = tls.VersionTLS12
+	case "1.3":
+		c.RouteServiceMinTLSVersion = tls.VersionTLS13
+	default:
+		panic(fmt.Sprintf("invalid route service min TLS version: %q", c.RouteServiceMinTLSVersionString))
+	}
+
+	switch c.RouteServiceHeaderEncodingString {
+	case "url":
+		c.RouteServiceHeaderEncoding = base64.URLEncoding
+	case "raw_url":
+		c.RouteServiceHeaderEncoding = base64.RawURLEncoding
+	case "std":
+		c.RouteServiceHeaderEncoding = base64.StdEncoding
+	default:
+		panic(fmt.Sprintf("invalid route service header encoding: %q", c.RouteServiceHeaderEncodingString))
+	}
+
+	switch c.AccessLogFormat {
+	case "line", "json":
+	default:
+		panic(fmt.Sprintf("invalid access log format: %q", c.AccessLogFormat))
+	}
+
+	if c.RouteServiceSignIssuer {
+		c.RouteServiceIssuer = fmt.Sprintf("%s/%d", c.Ip, c.Index)
+	}
+
+	if c.DefaultRouteServiceUrl != "" {
+		u, err := url.Parse(c.DefaultRouteServiceUrl)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			panic(fmt.Sprintf("invalid default route service url: %q, must be an https url", c.DefaultRouteServiceUrl))
+		}
+	}
+
+	if c.RouteServiceProxyUrlString != "" {
+		proxyUrl, err := url.Parse(c.RouteServiceProxyUrlString)
+		if err != nil {
+			panic(fmt.Sprintf("invalid route service proxy url: %s", err))
+		}
+		if proxyUrl.Scheme != "http" || proxyUrl.Host == "" {
+			panic(fmt.Sprintf("invalid route service proxy url: %q, must be an http url", c.RouteServiceProxyUrlString))
+		}
+		// Tunnelled connections get the shared TLS config only.
+		if len(c.RouteServiceServerNames) > 0 {
+			panic("route service server names cannot be used with a route service proxy")
+		}
+		for host := range c.RouteServiceClientCertificates {
+			if host != "" {
+				panic(fmt.Sprintf("route service client certificate for host %q cannot be used with a route service proxy", host))
+			}
+		}
+		c.RouteServiceProxyUrl = proxyUrl
+	}
+
+	for _, host := range c.RouteServiceDeniedHosts {
+		if strings.Contains(host, "/") {
+			_, _, err := net.ParseCIDR(host)
+			if err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	for _, pattern := range c.RouteServiceAllowedRoutes {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			panic(fmt.Sprintf("invalid route service allowed route %q: %s", pattern, err))
+		}
+	}
+
+	for _, pattern := range c.RouteServiceForwardedUrlOptionalPaths {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			panic(fmt.Sprintf("invalid route service forwarded url optional path %q: %s", pattern, err))
+		}
+	}
 }
 
 func (c *Config) processCipherSuites() []uint16 {
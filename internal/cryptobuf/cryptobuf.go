@@ -0,0 +1,46 @@
+// Package cryptobuf lets route service headers be sealed and opened into
+// pooled scratch buffers, without the secure package exporting either.
+package cryptobuf
+
+import "sync"
+
+// Scratch buffers for sealing and opening messages that do not outlive the
+// call that needs them, so they are reused instead of being allocated for
+// every message.
+var pool = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+// Get returns a scratch buffer from the pool. It must be handed back with Put
+// once nothing in it is used anymore.
+func Get() *[]byte {
+	return pool.Get().(*[]byte)
+}
+
+func Put(buf *[]byte) {
+	pool.Put(buf)
+}
+
+// Grow returns the first n bytes of buf, growing it first if it is too small.
+// The contents are left as they were.
+func Grow(buf *[]byte, n int) []byte {
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	return (*buf)[:n]
+}
+
+// Sealer seals and opens into a scratch buffer from Get. Results are only
+// valid until the buffer goes back to the pool.
+type Sealer interface {
+	EncryptInto(buf *[]byte, plainText, aad []byte) (cipherText []byte, nonce []byte, err error)
+	DecryptInto(buf *[]byte, cipherText, nonce, aad []byte) ([]byte, error)
+}
+
+// SealerFor returns the Sealer for crypto, or nil if it has none. The secure
+// package sets it for its own cryptos.
+var SealerFor = func(crypto interface{}) Sealer {
+	return nil
+}
@@ -0,0 +1,13 @@
+package cryptobuf_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestCryptobuf(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Cryptobuf Suite")
+}
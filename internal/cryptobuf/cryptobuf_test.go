@@ -0,0 +1,33 @@
+package cryptobuf_test
+
+import (
+	"github.com/cloudfoundry/gorouter/internal/cryptobuf"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Cryptobuf", func() {
+	Describe("Grow", func() {
+		It("grows a buffer that is too small", func() {
+			buf := new([]byte)
+			Expect(cryptobuf.Grow(buf, 16)).To(HaveLen(16))
+			Expect(cap(*buf)).To(BeNumerically(">=", 16))
+		})
+
+		It("reuses a buffer that is large enough", func() {
+			buf := new([]byte)
+			first := cryptobuf.Grow(buf, 16)
+			first[0] = 'x'
+
+			second := cryptobuf.Grow(buf, 8)
+			Expect(second).To(HaveLen(8))
+			Expect(second[0]).To(Equal(byte('x')))
+		})
+	})
+
+	Describe("SealerFor", func() {
+		It("has no sealer for unknown cryptos", func() {
+			Expect(cryptobuf.SealerFor("not a crypto")).To(BeNil())
+		})
+	})
+})
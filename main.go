@@ -81,14 +81,19 @@ func main() {
 
 	var crypto secure.Crypto
 	var cryptoPrev secure.Crypto
+	var hostCrypto map[string]secure.Crypto
 	if c.RouteServiceEnabled {
-		crypto = createCrypto(c.RouteServiceSecret, logger)
+		crypto = createCrypto(c.RouteServiceSecret, c.RouteServiceSignatureMode, logger)
 		if c.RouteServiceSecretPrev != "" {
-			cryptoPrev = createCrypto(c.RouteServiceSecretPrev, logger)
+			cryptoPrev = createCrypto(c.RouteServiceSecretPrev, c.RouteServiceSignatureMode, logger)
+		}
+		hostCrypto = make(map[string]secure.Crypto, len(c.RouteServiceHostSecrets))
+		for host, secret := range c.RouteServiceHostSecrets {
+			hostCrypto[host] = createCrypto(secret, c.RouteServiceSignatureMode, logger)
 		}
 	}
 
-	proxy := buildProxy(c, registry, accessLogger, varz, crypto, cryptoPrev)
+	proxy := buildProxy(c, registry, accessLogger, varz, crypto, cryptoPrev, hostCrypto)
 
 	router, err := router.NewRouter(c, proxy, natsClient, registry, varz, logCounter)
 	if err != nil {
@@ -100,6 +105,7 @@ func main() {
 
 	logger.Info("gorouter.started")
 
+	toggleRouteServiceEnforceOnSignal(proxy, logger)
 	waitOnErrOrSignal(c, logger, errChan, router)
 
 	os.Exit(0)
@@ -153,14 +159,39 @@ func waitOnErrOrSignal(c *config.Config, logger *steno.Logger, errChan <-chan er
 	}
 }
 
-func createCrypto(secret string, logger *steno.Logger) *secure.AesGCM {
+// SIGUSR2 turns route service signature enforcement off, or back on, so that
+// it can be relaxed during an incident without a redeploy.
+func toggleRouteServiceEnforceOnSignal(p proxy.Proxy, logger *steno.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+
+	go func() {
+		for range signals {
+			enforce := !p.RouteServiceEnforce()
+			p.SetRouteServiceEnforce(enforce)
+			logger.Infod(
+				map[string]interface{}{
+					"enforce": enforce,
+				},
+				"gorouter.route-service-enforce",
+			)
+		}
+	}()
+}
+
+func createCrypto(secret string, mode string, logger *steno.Logger) secure.Crypto {
 	secretDecoded, err := base64.StdEncoding.DecodeString(secret)
 	if err != nil {
 		logger.Errorf("Error decoding route service secret: %s\n", err)
 		os.Exit(1)
 	}
 
-	crypto, err := secure.NewAesGCM(secretDecoded)
+	var crypto secure.Crypto
+	if mode == config.SignatureModeHmac {
+		crypto, err = secure.NewHMACSigner(secretDecoded)
+	} else {
+		crypto, err = secure.NewAesGCM(secretDecoded)
+	}
 	if err != nil {
 		logger.Errorf("Error creating route service crypto: %s\n", err)
 		os.Exit(1)
@@ -168,7 +199,7 @@ func createCrypto(secret string, logger *steno.Logger) *secure.AesGCM {
 	return crypto
 }
 
-func buildProxy(c *config.Config, registry rregistry.RegistryInterface, accessLogger access_log.AccessLogger, varz rvarz.Varz, crypto secure.Crypto, cryptoPrev secure.Crypto) proxy.Proxy {
+func buildProxy(c *config.Config, registry rregistry.RegistryInterface, accessLogger access_log.AccessLogger, varz rvarz.Varz, crypto secure.Crypto, cryptoPrev secure.Crypto, hostCrypto map[string]secure.Crypto) proxy.Proxy {
 	args := proxy.ProxyArgs{
 		EndpointTimeout: c.EndpointTimeout,
 		Ip:              c.Ip,
@@ -182,10 +213,67 @@ func buildProxy(c *config.Config, registry rregistry.RegistryInterface, accessLo
 			InsecureSkipVerify: c.SSLSkipValidation,
 		},
 		RouteServiceEnabled: c.RouteServiceEnabled,
+		RouteServiceEnforce: c.RouteServiceEnforce,
 		RouteServiceTimeout: c.RouteServiceTimeout,
 		Crypto:              crypto,
 		CryptoPrev:          cryptoPrev,
 		ExtraHeadersToLog:   c.ExtraHeadersToLog,
+		GzipContentTypes:    c.GzipContentTypes,
+
+		RouteServiceReservedHeaders:       c.RouteServiceReservedHeaders,
+		RouteServiceHopByHopHeaders:       c.RouteServiceHopByHopHeaders,
+		RouteServiceResponseHeaders:       c.RouteServiceResponseHeaders,
+		RouteServiceMaxForwardedUrlLength: c.RouteServiceMaxForwardedUrlLength,
+		RouteServiceMaxIdleConnsPerHost:   c.RouteServiceMaxIdleConnsPerHost,
+		RouteServiceIdleConnTimeout:       c.RouteServiceIdleConnTimeout,
+		RouteServiceDialTimeout:           c.RouteServiceDialTimeout,
+
+		RouteServiceSignatureHeader:    c.RouteServiceSignatureHeader,
+		RouteServiceMetadataHeader:     c.RouteServiceMetadataHeader,
+		RouteServiceForwardedUrlHeader: c.RouteServiceForwardedUrlHeader,
+		RouteServiceHeaderEncoding:     c.RouteServiceHeaderEncoding,
+		RouteServiceRejectRedirects:    c.RouteServiceRejectRedirects,
+
+		RouteServiceCompressionThreshold: c.RouteServiceCompressionThreshold,
+		RouteServiceDeniedHosts:          c.RouteServiceDeniedHosts,
+
+		EnableZipkin: c.Tracing.EnableZipkin,
+
+		RouteServiceRetries:    c.RouteServiceRetries,
+		RouteServiceRetryDelay: c.RouteServiceRetryDelay,
+
+		RouteServiceBackendRetries: c.RouteServiceBackendRetries,
+
+		RouteServiceServerNames:        c.RouteServiceServerNames,
+		RouteServiceClientCertificates: c.RouteServiceClientCertificates,
+
+		RouteServiceStripForwardedUrlFragment: c.RouteServiceStripForwardedUrlFragment,
+		RouteServiceBindAppGuid:               c.RouteServiceBindAppGuid,
+		RouteServiceSignRouteKey:              c.RouteServiceSignRouteKey,
+		RouteServiceBindRouteKey:              c.RouteServiceBindRouteKey,
+		RouteServiceStripSignatureFromApps:    c.RouteServiceStripSignatureFromApps,
+		RouteServiceSignClientIP:              c.RouteServiceSignClientIP,
+		RouteServiceForwardedUrlClientScheme:  c.RouteServiceForwardedUrlClientScheme,
+		RouteServiceTrustForwardedProto:       c.RouteServiceTrustForwardedProto,
+		RouteServiceMisdirectedOnHostMismatch: c.RouteServiceMisdirectedOnHostMismatch,
+		RouteServiceMinTLSVersion:             c.RouteServiceMinTLSVersion,
+		RouteServiceIgnoreDefaultPorts:        c.RouteServiceIgnoreDefaultPorts,
+		RouteServiceAllowPathExtensions:       c.RouteServiceAllowPathExtensions,
+		RouteServiceCanonicalForwardedUrls:    c.RouteServiceCanonicalForwardedUrls,
+		RouteServiceMaxResponseBytes:          c.RouteServiceMaxResponseBytes,
+		RouteServiceDebugHeader:               c.RouteServiceDebugHeader,
+		RouteServiceMaxHops:                   c.RouteServiceMaxHops,
+		RouteServiceProxyUrl:                  c.RouteServiceProxyUrl,
+		DefaultRouteServiceUrl:                c.DefaultRouteServiceUrl,
+		RouteServiceIssuer:                    c.RouteServiceIssuer,
+		RouteServiceExpiryGrace:               c.RouteServiceExpiryGrace,
+		RouteServiceHostCrypto:                hostCrypto,
+		RouteServiceFailClosed:                c.RouteServiceFailClosed,
+
+		RouteServiceForwardedUrlOptionalPaths: c.RouteServiceForwardedUrlOptionalPaths,
+		RouteServiceMaxInFlight:               c.RouteServiceMaxInFlight,
+
+		RouteServiceValidationFailureLogSampleRate: c.RouteServiceValidationFailureLogSampleRate,
 	}
 	return proxy.NewProxy(args)
 }
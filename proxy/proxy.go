@@ -2,16 +2,20 @@ package proxy
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"errors"
 	"io"
 	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/textproto"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/cloudfoundry/dropsonde"
+	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/gorouter/access_log"
 	router_http "github.com/cloudfoundry/gorouter/common/http"
 	"github.com/cloudfoundry/gorouter/common/secure"
@@ -24,9 +28,15 @@ const (
 	VcapCookieId    = "__VCAP_ID__"
 	StickyCookieKey = "JSESSIONID"
 	maxRetries      = 3
+
+	routeServiceTLSHandshakeTimeout = 10 * time.Second
+	routeServiceDialTimeout         = 5 * time.Second
 )
 
 var noEndpointsAvailable = errors.New("No endpoints available")
+var routeServiceRedirectRejected = errors.New("Route service responded with a redirect")
+var routeServiceResponseTooLarge = errors.New("Route service response too large")
+var routeServiceOverloaded = errors.New("Too many requests in flight to route services")
 
 type LookupRegistry interface {
 	Lookup(uri route.Uri) *route.Pool
@@ -39,10 +49,24 @@ type ProxyReporter interface {
 	CaptureBadGateway(req *http.Request)
 	CaptureRoutingRequest(b *route.Endpoint, req *http.Request)
 	CaptureRoutingResponse(b *route.Endpoint, res *http.Response, t time.Time, d time.Duration)
+	CaptureRouteServiceResponse(host string, res *http.Response, d time.Duration)
+	CaptureRouteServiceRequestStarted()
+	CaptureRouteServiceRequestFinished()
+	CaptureRouteServiceSignatureAge(d time.Duration)
 }
 
 type Proxy interface {
 	ServeHTTP(responseWriter http.ResponseWriter, request *http.Request)
+
+	// CloseIdleConnections closes the idle connections to route services;
+	// those to backends are not kept alive. It may be called any number of
+	// times, and later requests open new connections.
+	CloseIdleConnections()
+
+	// SetRouteServiceEnforce turns the rejection of requests failing route
+	// service signature validation on or off for the requests that follow.
+	SetRouteServiceEnforce(enforce bool)
+	RouteServiceEnforce() bool
 }
 
 type ProxyArgs struct {
@@ -55,10 +79,128 @@ type ProxyArgs struct {
 	SecureCookies       bool
 	TLSConfig           *tls.Config
 	RouteServiceEnabled bool
+	RouteServiceEnforce bool
 	RouteServiceTimeout time.Duration
 	Crypto              secure.Crypto
 	CryptoPrev          secure.Crypto
 	ExtraHeadersToLog   []string
+
+	// Mints route service signatures instead of Crypto when set.
+	RouteServiceSigner route_service.Signer
+
+	// Responses of these content types are gzipped for clients accepting
+	// gzip, whether or not they went through a route service.
+	GzipContentTypes []string
+
+	RouteServiceReservedHeaders       []string
+	RouteServiceHopByHopHeaders       []string
+	RouteServiceResponseHeaders       []string
+	RouteServiceMaxForwardedUrlLength int
+	RouteServiceMaxIdleConnsPerHost   int
+	RouteServiceIdleConnTimeout       time.Duration
+
+	// Connecting to a route service fails after this long, 5 seconds when
+	// zero.
+	RouteServiceDialTimeout time.Duration
+
+	RouteServiceSignatureHeader    string
+	RouteServiceMetadataHeader     string
+	RouteServiceForwardedUrlHeader string
+
+	// The base64 encoding of the signature and metadata headers. Nil is
+	// base64.URLEncoding.
+	RouteServiceHeaderEncoding *base64.Encoding
+
+	RouteServiceErrors RouteServiceErrorProvider
+
+	// Redirects from a route service are passed back to the client with
+	// their Location and other headers untouched, so that browsers follow
+	// them. When set, they are instead rejected with a 502.
+	RouteServiceRejectRedirects bool
+
+	RouteServiceCompressionThreshold int
+
+	RouteServiceDeniedHosts []string
+
+	EnableZipkin bool
+
+	// Retries after failing to connect to a route service.
+	RouteServiceRetries    int
+	RouteServiceRetryDelay time.Duration
+
+	// Retries of requests returning from a route service to the backend.
+	RouteServiceBackendRetries int
+
+	// TLS server names for route services, by registered host.
+	RouteServiceServerNames map[string]string
+
+	// Client certificates for route services, by registered host. The one for
+	// the empty host is presented to the others.
+	RouteServiceClientCertificates map[string]tls.Certificate
+
+	RouteServiceStripForwardedUrlFragment bool
+	RouteServiceBindAppGuid               bool
+	RouteServiceSignRouteKey              bool
+	RouteServiceBindRouteKey              bool
+	RouteServiceStripSignatureFromApps    bool
+	RouteServiceSignClientIP              bool
+	RouteServiceForwardedUrlClientScheme  bool
+	RouteServiceTrustForwardedProto       bool
+
+	// Answer 421 rather than 400 when the forwarded url returned by a route
+	// service is for another host.
+	RouteServiceMisdirectedOnHostMismatch bool
+	RouteServiceIgnoreDefaultPorts        bool
+	RouteServiceAllowPathExtensions       bool
+	RouteServiceCanonicalForwardedUrls    bool
+
+	// Route service responses with longer bodies fail. Zero is unlimited.
+	RouteServiceMaxResponseBytes int64
+
+	// Names the route service host used in the X-Cf-RouteServiceUrl
+	// response header.
+	RouteServiceDebugHeader bool
+
+	// Requests sent to route services more times fail. Zero is unlimited.
+	RouteServiceMaxHops int
+
+	// Overrides the minimum TLS version of TLSConfig for route services.
+	RouteServiceMinTLSVersion uint16
+
+	// An http:// proxy to tunnel route service connections through. The
+	// per-host server names and client certificates above do not apply to
+	// tunnelled connections.
+	RouteServiceProxyUrl *url.URL
+
+	// Glob patterns of request paths that may return from a route service
+	// without the forwarded url header.
+	RouteServiceForwardedUrlOptionalPaths []string
+
+	// Names this router in the signatures it mints, when not empty.
+	RouteServiceIssuer string
+
+	// Signatures expired for less than this are still accepted, and flagged
+	// to the backend.
+	RouteServiceExpiryGrace time.Duration
+
+	// Keys of their own for the route services of these hosts, to sign for
+	// them and validate requests for their routes with.
+	RouteServiceHostCrypto map[string]secure.Crypto
+
+	// Refuse to build a proxy with a route service key, current, previous or
+	// of a host, that fails its self check. NewProxy panics instead.
+	RouteServiceFailClosed bool
+
+	// The route service for routes registered without one.
+	DefaultRouteServiceUrl string
+
+	// Requests to route services beyond this many in flight fail with a 503.
+	// Zero is unlimited.
+	RouteServiceMaxInFlight int
+
+	// Logs one in every this many signature validation failures. Zero or
+	// one logs all of them.
+	RouteServiceValidationFailureLogSampleRate int
 }
 
 type proxy struct {
@@ -69,13 +211,70 @@ type proxy struct {
 	reporter           ProxyReporter
 	accessLogger       access_log.AccessLogger
 	transport          *http.Transport
+	rsTransport        *http.Transport
+	rsSkipTransport    *http.Transport
 	secureCookies      bool
 	routeServiceConfig *route_service.RouteServiceConfig
+	routeServiceErrors RouteServiceErrorProvider
+	rejectRedirects    bool
+	enableZipkin       bool
+	rsRetries          int
+	rsRetryDelay       time.Duration
+	rsBackendRetries   int
+	bindAppGuid        bool
+	signRouteKey       bool
+	bindRouteKey       bool
+	stripAppSignature  bool
+	signClientIP       bool
+	clientScheme       bool
+	forwardedProto     bool
+	misdirectedHost    bool
+	rsMaxResponseBytes int64
+	rsDebugHeader      bool
+	rsFailureLogs      *logSampler
+	defaultRsUrl       string
+	rsInFlight         chan struct{}
+	selfCheckErr       error
+	gzipContentTypes   []string
 	ExtraHeadersToLog  []string
 }
 
 func NewProxy(args ProxyArgs) Proxy {
-	routeServiceConfig := route_service.NewRouteServiceConfig(args.RouteServiceEnabled, args.RouteServiceTimeout, args.Crypto, args.CryptoPrev)
+	routeServiceConfig, err := route_service.NewRouteServiceConfig(args.RouteServiceEnabled, args.RouteServiceTimeout, args.Crypto, args.CryptoPrev)
+	if err != nil {
+		// config.Process and main reject these before the proxy is built.
+		panic(err)
+	}
+	routeServiceConfig.SetRouteServiceEnforce(args.RouteServiceEnforce)
+	routeServiceConfig.AddReservedHeaders(args.RouteServiceReservedHeaders...)
+	routeServiceConfig.AddHopByHopHeaders(args.RouteServiceHopByHopHeaders...)
+	routeServiceConfig.AddResponseHeaders(args.RouteServiceResponseHeaders...)
+	routeServiceConfig.SetSigner(args.RouteServiceSigner)
+	routeServiceConfig.SetCompressionThreshold(args.RouteServiceCompressionThreshold)
+	routeServiceConfig.SetStripForwardedUrlFragment(args.RouteServiceStripForwardedUrlFragment)
+	routeServiceConfig.SetIgnoreDefaultPorts(args.RouteServiceIgnoreDefaultPorts)
+	routeServiceConfig.SetAllowPathExtensions(args.RouteServiceAllowPathExtensions)
+	routeServiceConfig.SetCanonicalForwardedUrls(args.RouteServiceCanonicalForwardedUrls)
+	routeServiceConfig.SetMaxHops(args.RouteServiceMaxHops)
+	routeServiceConfig.SetIssuer(args.RouteServiceIssuer)
+	routeServiceConfig.SetExpiryGrace(args.RouteServiceExpiryGrace)
+	routeServiceConfig.SetHostCrypto(args.RouteServiceHostCrypto)
+	routeServiceConfig.SetBindRouteKey(args.RouteServiceBindRouteKey)
+	routeServiceConfig.SetSignatureAgeObserver(args.Reporter.CaptureRouteServiceSignatureAge)
+	routeServiceConfig.SetForwardedUrlOptionalPaths(args.RouteServiceForwardedUrlOptionalPaths)
+	err = routeServiceConfig.SetDeniedHosts(args.RouteServiceDeniedHosts)
+	if err != nil {
+		panic(err)
+	}
+	routeServiceConfig.SetHeaderNames(args.RouteServiceSignatureHeader, args.RouteServiceMetadataHeader, args.RouteServiceForwardedUrlHeader)
+	routeServiceConfig.SetHeaderEncoding(args.RouteServiceHeaderEncoding)
+	if args.RouteServiceMaxForwardedUrlLength > 0 {
+		routeServiceConfig.SetMaxForwardedUrlLength(args.RouteServiceMaxForwardedUrlLength)
+	}
+	err = routeServiceConfig.CheckKeysOnStartup(args.RouteServiceFailClosed)
+	if err != nil {
+		panic(err)
+	}
 
 	p := &proxy{
 		accessLogger: args.AccessLogger,
@@ -99,14 +298,144 @@ func NewProxy(args ProxyArgs) Proxy {
 			DisableCompression: true,
 			TLSClientConfig:    args.TLSConfig,
 		},
+		rsTransport:        newRouteServiceTransport(args, routeServiceConfig, false),
+		rsSkipTransport:    newRouteServiceTransport(args, routeServiceConfig, true),
 		secureCookies:      args.SecureCookies,
 		routeServiceConfig: routeServiceConfig,
+		routeServiceErrors: args.RouteServiceErrors,
+		rejectRedirects:    args.RouteServiceRejectRedirects,
+		enableZipkin:       args.EnableZipkin,
+		rsRetries:          args.RouteServiceRetries,
+		rsRetryDelay:       args.RouteServiceRetryDelay,
+		rsBackendRetries:   args.RouteServiceBackendRetries,
+		bindAppGuid:        args.RouteServiceBindAppGuid,
+		signRouteKey:       args.RouteServiceSignRouteKey,
+		bindRouteKey:       args.RouteServiceBindRouteKey,
+		stripAppSignature:  args.RouteServiceStripSignatureFromApps,
+		signClientIP:       args.RouteServiceSignClientIP,
+		clientScheme:       args.RouteServiceForwardedUrlClientScheme,
+		forwardedProto:     args.RouteServiceTrustForwardedProto,
+		misdirectedHost:    args.RouteServiceMisdirectedOnHostMismatch,
+		rsMaxResponseBytes: args.RouteServiceMaxResponseBytes,
+		rsDebugHeader:      args.RouteServiceDebugHeader,
+		rsFailureLogs:      newLogSampler(args.RouteServiceValidationFailureLogSampleRate),
+		defaultRsUrl:       args.DefaultRouteServiceUrl,
+		gzipContentTypes:   args.GzipContentTypes,
 		ExtraHeadersToLog:  args.ExtraHeadersToLog,
 	}
 
+	if args.RouteServiceMaxInFlight > 0 {
+		p.rsInFlight = make(chan struct{}, args.RouteServiceMaxInFlight)
+	}
+
+	// A key failing its self check fails the load balancer heartbeat, so that
+	// the router is not put into rotation only to fail route service requests.
+	p.selfCheckErr = routeServiceConfig.SelfCheck()
+	if p.selfCheckErr != nil {
+		p.logger.Errord(map[string]interface{}{"error": p.selfCheckErr.Error()}, "proxy.route-service.self-check.failed")
+	}
+
 	return p
 }
 
+// Route services are few in number but see a lot of traffic, so unlike
+// backends their connections are kept alive and pooled per host. Deadlines
+// are not set on the pooled connections; the endpoint timeout is applied
+// to waiting for the response headers instead, so that route services doing
+// slow work are not bounded by the shorter dial timeout.
+//
+// Route services registered to be connected to without verifying their
+// certificate get a transport of their own, built with skipSslValidation.
+func newRouteServiceTransport(args ProxyArgs, routeServiceConfig *route_service.RouteServiceConfig, skipSslValidation bool) *http.Transport {
+	dialTimeout := args.RouteServiceDialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = routeServiceDialTimeout
+	}
+
+	dial := func(network, addr string) (net.Conn, error) {
+		conn, err := net.DialTimeout(network, addr, dialTimeout)
+		if err != nil {
+			return conn, err
+		}
+		// Through a proxy, this is the proxy's address; route service hosts
+		// are then only checked by name before the request is sent, and what
+		// they resolve to is up to the proxy.
+		if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && args.RouteServiceProxyUrl == nil {
+			err = routeServiceConfig.ValidateIP(tcpAddr.IP)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if args.TLSConfig != nil {
+		tlsConfig = args.TLSConfig.Clone()
+	}
+	if args.RouteServiceMinTLSVersion != 0 {
+		tlsConfig.MinVersion = args.RouteServiceMinTLSVersion
+	}
+	if skipSslValidation {
+		tlsConfig.InsecureSkipVerify = true
+	}
+
+	transport := &http.Transport{
+		Dial:                  dial,
+		MaxIdleConnsPerHost:   args.RouteServiceMaxIdleConnsPerHost,
+		IdleConnTimeout:       args.RouteServiceIdleConnTimeout,
+		ResponseHeaderTimeout: args.EndpointTimeout,
+		TLSHandshakeTimeout:   routeServiceTLSHandshakeTimeout,
+		DisableCompression:    true,
+		TLSClientConfig:       tlsConfig,
+	}
+
+	if args.RouteServiceProxyUrl != nil {
+		transport.Proxy = http.ProxyURL(args.RouteServiceProxyUrl)
+	}
+
+	if cert, ok := args.RouteServiceClientCertificates[""]; ok {
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(args.RouteServiceServerNames) > 0 || len(args.RouteServiceClientCertificates) > 0 {
+		transport.DialTLS = func(network, addr string) (net.Conn, error) {
+			conn, err := dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+
+			serverTLSConfig := tlsConfig.Clone()
+			serverTLSConfig.ServerName = host
+			if serverName, ok := args.RouteServiceServerNames[host]; ok {
+				serverTLSConfig.ServerName = serverName
+			}
+			if cert, ok := args.RouteServiceClientCertificates[host]; ok {
+				serverTLSConfig.Certificates = []tls.Certificate{cert}
+			}
+
+			tlsConn := tls.Client(conn, serverTLSConfig)
+			conn.SetDeadline(time.Now().Add(routeServiceTLSHandshakeTimeout))
+			err = tlsConn.Handshake()
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn.SetDeadline(time.Time{})
+			return tlsConn, nil
+		}
+	}
+
+	return transport
+}
+
 func hostWithoutPort(req *http.Request) string {
 	host := req.Host
 
@@ -119,6 +448,16 @@ func hostWithoutPort(req *http.Request) string {
 	return host
 }
 
+// forwardedUrlForOtherHost reports whether the forwarded url of a request
+// returning from a route service is for a host other than the one requested.
+func forwardedUrlForOtherHost(request *http.Request, forwardedUrlHeader string) bool {
+	forwardedUrl, err := url.Parse(request.Header.Get(forwardedUrlHeader))
+	if err != nil || forwardedUrl.Host == "" {
+		return false
+	}
+	return !strings.EqualFold(forwardedUrl.Hostname(), hostWithoutPort(request))
+}
+
 func (p *proxy) getStickySession(request *http.Request) string {
 	// Try choosing a backend using sticky session
 	if _, err := request.Cookie(StickyCookieKey); err == nil {
@@ -134,6 +473,19 @@ func (p *proxy) lookup(request *http.Request) *route.Pool {
 	return p.registry.Lookup(uri)
 }
 
+func (p *proxy) CloseIdleConnections() {
+	p.rsTransport.CloseIdleConnections()
+	p.rsSkipTransport.CloseIdleConnections()
+}
+
+func (p *proxy) SetRouteServiceEnforce(enforce bool) {
+	p.routeServiceConfig.SetRouteServiceEnforce(enforce)
+}
+
+func (p *proxy) RouteServiceEnforce() bool {
+	return p.routeServiceConfig.RouteServiceEnforce()
+}
+
 func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
 	startedAt := time.Now()
 	accessLog := access_log.AccessLogRecord{
@@ -147,6 +499,7 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 
 	proxyWriter := NewProxyResponseWriter(responseWriter)
 	handler := NewRequestHandler(request, proxyWriter, p.reporter, &accessLog)
+	handler.SetRouteServiceErrorProvider(p.routeServiceErrors)
 
 	defer func() {
 		accessLog.RequestBytesReceived = requestBodyCounter.count
@@ -159,6 +512,10 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 	}
 
 	if isLoadBalancerHeartbeat(request) {
+		if p.selfCheckErr != nil {
+			handler.HandleFailedHeartbeat(p.selfCheckErr)
+			return
+		}
 		handler.HandleHeartbeat()
 		return
 	}
@@ -188,45 +545,168 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 		return
 	}
 
-	if isWebSocketUpgrade(request) {
-		handler.HandleWebSocketRequest(iter)
-		return
-	}
-
 	backend := true
 
 	routeServiceUrl := routePool.RouteServiceUrl()
-	// Attempted to use a route service when it is not supported
-	if routeServiceUrl != "" && !p.routeServiceConfig.RouteServiceEnabled() {
-		handler.HandleUnsupportedRouteService()
-		return
+	// Route services registered with the router are not sent through the
+	// default one, which could then be sent through itself.
+	if routeServiceUrl == "" && p.defaultRsUrl != "" && !routePool.IsRouteService() && p.routeServiceConfig.RouteServiceEnabled() {
+		routeServiceUrl = p.defaultRsUrl
 	}
 
+	// Routes without a route service, the common case, do none of the work
+	// below.
 	var routeServiceArgs route_service.RouteServiceArgs
-	if routeServiceUrl != "" {
-		rsSignature := request.Header.Get(route_service.RouteServiceSignature)
+	if routeServiceUrl == "" {
+		// Optionally, only route services are handed the signature; every
+		// other route that is not behind one has it removed.
+		if p.stripAppSignature && !routePool.IsRouteService() {
+			request.Header.Del(p.routeServiceConfig.SignatureHeader())
+			request.Header.Del(p.routeServiceConfig.MetadataHeader())
+		}
+
+		// WebSocket handshakes for routes behind a route service are only
+		// upgraded once they return from it, below.
+		if isWebSocketUpgrade(request) {
+			handler.HandleWebSocketRequest(iter)
+			return
+		}
+	} else {
+		// Attempted to use a route service when it is not supported
+		if !p.routeServiceConfig.RouteServiceEnabled() {
+			handler.HandleUnsupportedRouteService()
+			return
+		}
+
+		rsConfig := p.routeServiceConfig.ForRouteService(routeServiceUrl)
+		rsSignature := request.Header.Get(p.routeServiceConfig.SignatureHeader())
 		if hasBeenToRouteService(routeServiceUrl, rsSignature) {
 			// A request from a route service destined for a backend instances
 			routeServiceArgs.UrlString = routeServiceUrl
-			err := p.routeServiceConfig.ValidateSignature(&request.Header)
+
+			// The signature must then have been minted for this very url.
+			forwardedUrlHeader := p.routeServiceConfig.ForwardedUrlHeader()
+			if request.Header.Get(forwardedUrlHeader) == "" && p.routeServiceConfig.ForwardedUrlOptional(request.URL.Path) {
+				request.Header.Set(forwardedUrlHeader, p.routeServiceConfig.ForwardedUrlFromRequest(p.forwardedUrlScheme(request), request))
+			}
+
+			opts := route_service.ValidateOptions{
+				AppGuid:     routePool.ApplicationId(),
+				BindAppGuid: p.bindAppGuid,
+			}
+			if p.bindRouteKey {
+				opts.RouteKey = routePool.RouteKey().String()
+			}
+			signature, err := rsConfig.Validate(&request.Header, opts)
+
+			// Handlers and round trippers further along can read the outcome
+			// without decrypting the signature again.
+			result := &route_service.ValidationResult{Signature: signature, Err: err}
+			request = request.WithContext(route_service.WithValidationResult(request.Context(), result))
+			accessLog.Request = request
+			accessLog.RouteServiceTraversed = err == nil
+			request.Header.Del(route_service.RouteServiceSoftExpired)
+
 			if err != nil {
-				handler.HandleBadSignature(err)
-				return
+				accessLog.RouteServiceValidationError = err.Error()
+				metrics.IncrementCounter("route_services.validation_failures")
+				logFailure := p.rsFailureLogs.Sample()
+				if !logFailure {
+					handler.SuppressValidationFailureLog()
+				}
+
+				if p.routeServiceConfig.RouteServiceEnforce() {
+					if p.misdirectedHost && err == route_service.RouteServiceForwardedUrlMismatch &&
+						forwardedUrlForOtherHost(request, p.routeServiceConfig.ForwardedUrlHeader()) {
+						handler.HandleMisdirectedRequest(err)
+						return
+					}
+					handler.HandleBadSignature(err)
+					return
+				}
+
+				if logFailure {
+					handler.Logger().Set("Error", err.Error())
+					handler.Logger().Warnf("proxy.signature.validation.not-enforced")
+				}
+				metrics.IncrementCounter("route_services.validation_failures_not_enforced")
+				logRouteDecision(handler.Logger(), "backend", "signature-invalid-not-enforced")
+			} else {
+				if p.routeServiceConfig.SoftExpired(signature) {
+					request.Header.Set(route_service.RouteServiceSoftExpired, "true")
+				}
+				logRouteDecision(handler.Logger(), "backend", "signature-valid")
 			}
 		} else {
 			var err error
 
-			// should not hardcode http, will be addressed by #100982038
-			forwardedUrlRaw := "http" + "://" + request.Host + request.RequestURI
-			routeServiceArgs, err = buildRouteServiceArgs(p.routeServiceConfig, routeServiceUrl, forwardedUrlRaw)
+			// Metadata without a signature cannot have come from the route
+			// service; it is not sent back there either.
+			if request.Header.Get(p.routeServiceConfig.MetadataHeader()) != "" && p.routeServiceConfig.RouteServiceEnforce() {
+				_, err = rsConfig.Validate(&request.Header, route_service.ValidateOptions{})
+				metrics.IncrementCounter("route_services.validation_failures")
+				if !p.rsFailureLogs.Sample() {
+					handler.SuppressValidationFailureLog()
+				}
+				handler.HandleMissingSignature(err)
+				return
+			}
+
+			hops, err := p.routeServiceConfig.NextHop(&request.Header)
+			if err != nil {
+				handler.HandleRouteServiceLoop(err)
+				return
+			}
+
+			opts := route_service.SignatureOptions{
+				ForwardedUrlRaw: p.routeServiceConfig.ForwardedUrlFromRequest(p.forwardedUrlScheme(request), request),
+			}
+			if p.bindAppGuid {
+				opts.AppGuid = routePool.ApplicationId()
+			}
+			if p.signRouteKey || p.bindRouteKey {
+				opts.RouteKey = routePool.RouteKey().String()
+			}
+			if p.signClientIP {
+				opts.ClientIP, _, _ = net.SplitHostPort(request.RemoteAddr)
+			}
+			routeServiceArgs, err = buildRouteServiceArgs(rsConfig, routeServiceUrl, opts)
+			// A bound route key is only sealed into the signature; the route
+			// service is told it when it is signed.
+			if !p.signRouteKey {
+				routeServiceArgs.RouteKey = ""
+			}
+			routeServiceArgs.StartedAt = startedAt
+			routeServiceArgs.Hops = hops
 			backend = false
+			logRouteDecision(handler.Logger(), "route-service", "no-signature")
 			if err != nil {
 				handler.HandleRouteServiceFailure(err)
 				return
 			}
+
+			err = p.routeServiceConfig.ValidateHost(routeServiceArgs.ParsedUrl.Host)
+			if err != nil {
+				handler.HandleDeniedRouteService(err)
+				return
+			}
+			accessLog.RouteServiceHost = routeServiceArgs.ParsedUrl.Host
+
+			if p.enableZipkin {
+				setRouteServiceTraceHeaders(request.Header)
+			}
 		}
 	}
 
+	// Handshakes sent back by a route service are upgraded like direct ones,
+	// over a connection without the deadline of the backend transport.
+	if backend && routeServiceUrl != "" && isWebSocketUpgrade(request) {
+		stripRouteServiceHeaders(request.Header, p.routeServiceConfig)
+		handler.HandleWebSocketRequest(iter)
+		return
+	}
+
+	var routeServiceStartedAt time.Time
 	after := func(rsp *http.Response, endpoint *route.Endpoint, err error) {
 		accessLog.FirstByteAt = time.Now()
 		if rsp != nil {
@@ -241,20 +721,106 @@ func (p *proxy) ServeHTTP(responseWriter http.ResponseWriter, request *http.Requ
 
 		p.reporter.CaptureRoutingResponse(endpoint, rsp, startedAt, latency)
 
+		// Set on the response writer so that error responses carry it too;
+		// one sent by the route service itself is dropped.
+		if !backend && p.rsDebugHeader {
+			responseWriter.Header().Set(router_http.CfRouteServiceUrlHeader, routeServiceArgs.ParsedUrl.Host)
+			if rsp != nil {
+				rsp.Header.Del(router_http.CfRouteServiceUrlHeader)
+			}
+		}
+		if !backend {
+			accessLog.RouteServiceLatency = time.Since(routeServiceStartedAt)
+			if rsp != nil {
+				recordRouteServiceCertificate(&accessLog, rsp.TLS)
+			}
+			p.reporter.CaptureRouteServiceResponse(routeServiceArgs.ParsedUrl.Host, rsp, accessLog.RouteServiceLatency)
+		}
+
 		if err != nil {
 			p.reporter.CaptureBadGateway(request)
+			if !backend && errors.Is(err, route_service.RouteServiceHostDenied) {
+				handler.HandleDeniedRouteService(err)
+				return
+			}
+			if !backend && isNotTLS(err) {
+				handler.HandleRouteServiceNotTLS(err)
+				return
+			}
+			if !backend && isBadResponse(err) {
+				handler.HandleRouteServiceBadResponse(err)
+				return
+			}
+			if err == routeServiceResponseTooLarge {
+				handler.HandleRouteServiceResponseTooLarge(err)
+				return
+			}
 			handler.HandleBadGateway(err)
 			return
 		}
 
+		// A route service answering the request itself, rather than sending
+		// it back to the backend, may say so. The marker is not passed on to
+		// the client.
+		if !backend && rsp.Header.Get(router_http.CfRouteServiceHandledHeader) != "" {
+			if rsp.Header.Get(router_http.CfRouteServiceHandledHeader) == "true" {
+				handler.Logger().Debug("proxy.route-service.handled")
+				metrics.IncrementCounter("route_services.handled")
+			}
+			rsp.Header.Del(router_http.CfRouteServiceHandledHeader)
+		}
+
+		if !backend {
+			p.routeServiceConfig.StripResponseHeaders(&rsp.Header)
+		}
+
 		if endpoint.PrivateInstanceId != "" {
 			setupStickySession(responseWriter, rsp, endpoint, stickyEndpointId, p.secureCookies, routePool.ContextPath())
 		}
 	}
 
-	roundTripper := NewProxyRoundTripper(backend,
-		dropsonde.InstrumentedRoundTripper(p.transport), iter, handler, after)
+	transport := dropsonde.InstrumentedRoundTripper(p.transport)
+	if !backend {
+		rsTransport := p.rsTransport
+		if routePool.RouteServiceSkipSslValidation() {
+			rsTransport = p.rsSkipTransport
+		}
+		transport = dropsonde.InstrumentedRoundTripper(rsTransport)
+		if p.rejectRedirects {
+			transport = &redirectRejectingRoundTripper{transport: transport}
+		}
+		if p.rsMaxResponseBytes > 0 {
+			transport = &sizeLimitingRoundTripper{transport: transport, max: p.rsMaxResponseBytes}
+		}
+	}
+
+	var roundTripper http.RoundTripper
+	if backend && routeServiceArgs.UrlString != "" {
+		roundTripper = NewReturningBackendRoundTripper(transport, iter, handler, after, p.rsBackendRetries)
+	} else if backend {
+		roundTripper = NewProxyRoundTripper(backend, transport, iter, handler, after)
+	} else {
+		roundTripper = NewRouteServiceRoundTripper(transport, handler, after, p.rsRetries, p.rsRetryDelay)
+	}
+	if len(p.gzipContentTypes) > 0 {
+		roundTripper = newGzippingRoundTripper(roundTripper, p.gzipContentTypes)
+	}
 
+	if !backend && p.rsInFlight != nil {
+		select {
+		case p.rsInFlight <- struct{}{}:
+			defer func() { <-p.rsInFlight }()
+		default:
+			handler.HandleRouteServiceOverloaded(routeServiceOverloaded)
+			return
+		}
+	}
+
+	routeServiceStartedAt = time.Now()
+	if !backend {
+		p.reporter.CaptureRouteServiceRequestStarted()
+		defer p.reporter.CaptureRouteServiceRequestFinished()
+	}
 	newReverseProxy(roundTripper, request, routeServiceArgs, p.routeServiceConfig).ServeHTTP(proxyWriter, request)
 
 	accessLog.FinishedAt = time.Now()
@@ -284,16 +850,70 @@ func SetupProxyRequest(source *http.Request, target *http.Request,
 	target.URL.RawQuery = ""
 
 	setRequestXRequestStart(source)
-	setRequestXVcapRequestId(source, nil)
 
-	sig := target.Header.Get(route_service.RouteServiceSignature)
+	// Routes without a route service, the common case, skip the route service
+	// headers altogether.
+	if routeServiceArgs.UrlString == "" {
+		setRequestXVcapRequestId(source, nil)
+		target.Header.Set(router_http.VcapRequestIdHeader, source.Header.Get(router_http.VcapRequestIdHeader))
+		return
+	}
+
+	sig := target.Header.Get(routeServiceConfig.SignatureHeader())
+
+	// Requests returning from a route service with a valid signature keep the
+	// request id given to them on the way there, so that both legs can be
+	// correlated. Any other id could have been chosen by the client.
+	result, returning := route_service.ValidationResultFromContext(source.Context())
+	if !returning || !result.Valid() || source.Header.Get(router_http.VcapRequestIdHeader) == "" {
+		setRequestXVcapRequestId(source, nil)
+	}
+	target.Header.Set(router_http.VcapRequestIdHeader, source.Header.Get(router_http.VcapRequestIdHeader))
+
 	if forwardingToRouteService(routeServiceArgs.UrlString, sig) {
 		// An endpoint has a route service and this request did not come from the service
 		routeServiceConfig.SetupRouteServiceRequest(target, routeServiceArgs)
 	} else if hasBeenToRouteService(routeServiceArgs.UrlString, sig) {
 		// Remove the headers since the backend should not see it
-		target.Header.Del(route_service.RouteServiceSignature)
-		target.Header.Del(route_service.RouteServiceMetadata)
+		stripRouteServiceHeaders(target.Header, routeServiceConfig)
+		removeDuplicateXForwardedFor(source, target)
+	}
+}
+
+func stripRouteServiceHeaders(header http.Header, routeServiceConfig *route_service.RouteServiceConfig) {
+	header.Del(routeServiceConfig.SignatureHeader())
+	header.Del(routeServiceConfig.MetadataHeader())
+	header.Del(route_service.RouteServiceRouteKey)
+	header.Del(route_service.RouteServiceClientIP)
+	header.Del(route_service.RouteServiceTimeoutMs)
+	header.Del(route_service.RouteServiceHops)
+	routeServiceConfig.StripReservedHeaders(&header)
+}
+
+// The reverse proxy appends the remote address to X-Forwarded-For. When a
+// route service has already appended its own address before calling back into
+// the router, drop that entry so it is not listed twice.
+func removeDuplicateXForwardedFor(source *http.Request, target *http.Request) {
+	remoteIP, _, err := net.SplitHostPort(source.RemoteAddr)
+	if err != nil {
+		return
+	}
+
+	prior, ok := target.Header["X-Forwarded-For"]
+	if !ok {
+		return
+	}
+
+	hops := strings.Split(strings.Join(prior, ", "), ",")
+	if strings.TrimSpace(hops[len(hops)-1]) != remoteIP {
+		return
+	}
+
+	hops = hops[:len(hops)-1]
+	if len(hops) == 0 {
+		target.Header.Del("X-Forwarded-For")
+	} else {
+		target.Header.Set("X-Forwarded-For", strings.TrimSpace(strings.Join(hops, ",")))
 	}
 }
 
@@ -320,9 +940,9 @@ func (i *wrappedIterator) EndpointFailed() {
 	i.nested.EndpointFailed()
 }
 
-func buildRouteServiceArgs(routeServiceConfig *route_service.RouteServiceConfig, routeServiceUrl, forwardedUrlRaw string) (route_service.RouteServiceArgs, error) {
+func buildRouteServiceArgs(routeServiceConfig *route_service.RouteServiceConfig, routeServiceUrl string, opts route_service.SignatureOptions) (route_service.RouteServiceArgs, error) {
 	var routeServiceArgs route_service.RouteServiceArgs
-	sig, metadata, err := routeServiceConfig.GenerateSignatureAndMetadata(forwardedUrlRaw)
+	sig, metadata, err := routeServiceConfig.Generate(opts)
 	if err != nil {
 		return routeServiceArgs, err
 	}
@@ -330,7 +950,9 @@ func buildRouteServiceArgs(routeServiceConfig *route_service.RouteServiceConfig,
 	routeServiceArgs.UrlString = routeServiceUrl
 	routeServiceArgs.Signature = sig
 	routeServiceArgs.Metadata = metadata
-	routeServiceArgs.ForwardedUrlRaw = forwardedUrlRaw
+	routeServiceArgs.ForwardedUrlRaw = opts.ForwardedUrlRaw
+	routeServiceArgs.RouteKey = opts.RouteKey
+	routeServiceArgs.ClientIP = opts.ClientIP
 
 	rsURL, err := url.Parse(routeServiceUrl)
 	if err != nil {
@@ -376,10 +998,91 @@ func setupStickySession(responseWriter http.ResponseWriter, response *http.Respo
 	}
 }
 
+// forwardedUrlScheme is the scheme of the forwarded url signed for a route
+// service. It is http unless the client scheme is configured to be used.
+func (p *proxy) forwardedUrlScheme(request *http.Request) string {
+	if !p.clientScheme {
+		return "http"
+	}
+
+	if p.forwardedProto {
+		switch proto := strings.ToLower(request.Header.Get("X-Forwarded-Proto")); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+
+	if request.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
 func forwardingToRouteService(rsUrl, sigHeader string) bool {
 	return sigHeader == "" && rsUrl != ""
 }
 
+// logRouteDecision records whether a request for a route bound to a route
+// service is sent to the route service or, having been there already, to the
+// backend.
+func logRouteDecision(logger *steno.Logger, leg, reason string) {
+	logger.Debugd(map[string]interface{}{"Leg": leg, "Reason": reason}, "proxy.route-service.decision")
+}
+
+// isNotTLS reports whether a TLS handshake failed because the peer answered
+// with something other than TLS, as a plain HTTP server does.
+func isNotTLS(err error) bool {
+	var recordErr tls.RecordHeaderError
+	return errors.As(err, &recordErr)
+}
+
+// recordRouteServiceCertificate records the identity the route service
+// presented in the TLS handshake, whether or not it was verified.
+func recordRouteServiceCertificate(accessLog *access_log.AccessLogRecord, state *tls.ConnectionState) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+
+	cert := state.PeerCertificates[0]
+	sans := append([]string{}, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+
+	accessLog.RouteServiceCertSubject = cert.Subject.String()
+	accessLog.RouteServiceCertSANs = sans
+	accessLog.RouteServiceCertVerified = len(state.VerifiedChains) > 0
+}
+
+// isBadResponse reports whether err is the transport failing to parse the
+// response it read. net/http does not export an error type for a malformed
+// status line, so it is recognised by its message.
+func isBadResponse(err error) bool {
+	var protocolErr textproto.ProtocolError
+	if errors.As(err, &protocolErr) {
+		return true
+	}
+	return strings.Contains(err.Error(), "malformed HTTP")
+}
+
+// logSampler lets one in every n calls to Sample through, starting with the
+// first.
+type logSampler struct {
+	n     uint64
+	count uint64
+}
+
+func newLogSampler(n int) *logSampler {
+	if n < 1 {
+		n = 1
+	}
+	return &logSampler{n: uint64(n)}
+}
+
+func (s *logSampler) Sample() bool {
+	return (atomic.AddUint64(&s.count, 1)-1)%s.n == 0
+}
+
 func hasBeenToRouteService(rsUrl, sigHeader string) bool {
 	return sigHeader != "" && rsUrl != ""
 }
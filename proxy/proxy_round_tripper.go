@@ -1,9 +1,18 @@
 package proxy
 
 import (
+	"compress/gzip"
+	"context"
+	"io"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	router_http "github.com/cloudfoundry/gorouter/common/http"
 	"github.com/cloudfoundry/gorouter/route"
 )
 
@@ -15,13 +24,42 @@ func NewProxyRoundTripper(backend bool, transport http.RoundTripper, endpointIte
 			iter:      endpointIterator,
 			handler:   &handler,
 			after:     afterRoundTrip,
+			retries:   maxRetries - 1,
 		}
 	} else {
-		return &RouteServiceRoundTripper{
-			transport: transport,
-			handler:   &handler,
-			after:     afterRoundTrip,
-		}
+		return NewRouteServiceRoundTripper(transport, handler, afterRoundTrip, maxRetries-1, 0)
+	}
+}
+
+// NewRouteServiceRoundTripper retries requests to a route service that fail
+// to connect up to retries times, waiting around retryDelay, with jitter,
+// before each retry.
+func NewRouteServiceRoundTripper(transport http.RoundTripper, handler RequestHandler,
+	afterRoundTrip AfterRoundTrip, retries int, retryDelay time.Duration) http.RoundTripper {
+	return &RouteServiceRoundTripper{
+		transport:  transport,
+		handler:    &handler,
+		after:      afterRoundTrip,
+		retries:    retries,
+		retryDelay: retryDelay,
+	}
+}
+
+// NewReturningBackendRoundTripper is the backend round tripper for requests
+// returning from a route service, which has already approved them. Besides
+// failing to connect, requests with an idempotent method and no body are
+// retried when failing before a response, other than by timing out. Either
+// is retried up to retries times, without contacting the route service
+// again.
+func NewReturningBackendRoundTripper(transport http.RoundTripper, endpointIterator route.EndpointIterator,
+	handler RequestHandler, afterRoundTrip AfterRoundTrip, retries int) http.RoundTripper {
+	return &BackendRoundTripper{
+		transport:  transport,
+		iter:       endpointIterator,
+		handler:    &handler,
+		after:      afterRoundTrip,
+		retries:    retries,
+		idempotent: true,
 	}
 }
 
@@ -30,6 +68,10 @@ type BackendRoundTripper struct {
 	transport http.RoundTripper
 	after     AfterRoundTrip
 	handler   *RequestHandler
+	retries   int
+
+	// Set to also retry idempotent requests failing after connecting.
+	idempotent bool
 }
 
 func (rt *BackendRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
@@ -37,7 +79,7 @@ func (rt *BackendRoundTripper) RoundTrip(request *http.Request) (*http.Response,
 	var res *http.Response
 	var endpoint *route.Endpoint
 
-	for retry := 0; retry < maxRetries; retry++ {
+	for attempt := 0; ; attempt++ {
 		endpoint, err = rt.selectEndpoint(request)
 		if err != nil {
 			return nil, err
@@ -46,11 +88,15 @@ func (rt *BackendRoundTripper) RoundTrip(request *http.Request) (*http.Response,
 		rt.setupRequest(request, endpoint)
 
 		res, err = rt.transport.RoundTrip(request)
-		if err == nil || !retryableError(err) {
+		if err == nil || !rt.retryable(request, err) {
 			break
 		}
 
 		rt.reportError(err)
+
+		if attempt >= rt.retries {
+			break
+		}
 	}
 
 	if rt.after != nil {
@@ -75,10 +121,35 @@ func (rt *BackendRoundTripper) selectEndpoint(request *http.Request) (*route.End
 func (rt *BackendRoundTripper) setupRequest(request *http.Request, endpoint *route.Endpoint) {
 	rt.handler.Logger().Debug("proxy.backend")
 	request.URL.Host = endpoint.CanonicalAddr()
-	request.Header.Set("X-CF-ApplicationID", endpoint.ApplicationId)
+	request.Header.Set(router_http.CfAppIdHeader, endpoint.ApplicationId)
 	setRequestXCfInstanceId(request, endpoint)
 }
 
+func (rt *BackendRoundTripper) retryable(request *http.Request, err error) bool {
+	if retryableError(err) {
+		return true
+	}
+	if !rt.idempotent || !idempotentRequest(request) {
+		return false
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return false
+	}
+	return err != context.Canceled
+}
+
+func idempotentRequest(request *http.Request) bool {
+	if request.Body != nil && request.Body != http.NoBody {
+		return false
+	}
+
+	switch request.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
 func (rt *BackendRoundTripper) reportError(err error) {
 	rt.iter.EndpointFailed()
 	rt.handler.Logger().Set("Error", err.Error())
@@ -86,22 +157,28 @@ func (rt *BackendRoundTripper) reportError(err error) {
 }
 
 type RouteServiceRoundTripper struct {
-	transport http.RoundTripper
-	after     AfterRoundTrip
-	handler   *RequestHandler
+	transport  http.RoundTripper
+	after      AfterRoundTrip
+	handler    *RequestHandler
+	retries    int
+	retryDelay time.Duration
 }
 
 func (rt *RouteServiceRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
 	var err error
 	var res *http.Response
 
-	for retry := 0; retry < maxRetries; retry++ {
+	for attempt := 0; ; attempt++ {
 		res, err = rt.transport.RoundTrip(request)
 		if err == nil || !retryableError(err) {
 			break
 		}
 
 		rt.reportError(err)
+
+		if attempt >= rt.retries || !rt.wait(request) {
+			break
+		}
 	}
 
 	if rt.after != nil {
@@ -112,11 +189,184 @@ func (rt *RouteServiceRoundTripper) RoundTrip(request *http.Request) (*http.Resp
 	return res, err
 }
 
+// wait sleeps for between half and one and a half times the retry delay, so
+// that routers retrying after the same blip do not all reconnect at once. It
+// returns false, without waiting any longer, once the client has gone away.
+func (rt *RouteServiceRoundTripper) wait(request *http.Request) bool {
+	if rt.retryDelay <= 0 {
+		return true
+	}
+	jitter := time.Duration(rand.Int63n(int64(rt.retryDelay)))
+
+	timer := time.NewTimer(rt.retryDelay/2 + jitter)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-request.Context().Done():
+		return false
+	}
+}
+
 func (rs *RouteServiceRoundTripper) reportError(err error) {
 	rs.handler.Logger().Set("Error", err.Error())
 	rs.handler.Logger().Warnf("proxy.route-service.failed")
 }
 
+// redirectRejectingRoundTripper fails responses that are redirects, for route
+// services that are not expected to send clients elsewhere.
+type redirectRejectingRoundTripper struct {
+	transport http.RoundTripper
+}
+
+func (rt *redirectRejectingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	res, err := rt.transport.RoundTrip(request)
+	if err != nil {
+		return res, err
+	}
+
+	if res.StatusCode >= 300 && res.StatusCode < 400 && res.StatusCode != http.StatusNotModified {
+		res.Body.Close()
+		return nil, routeServiceRedirectRejected
+	}
+
+	return res, nil
+}
+
+// sizeLimitingRoundTripper fails responses declaring a body longer than max
+// and cuts off bodies that turn out longer while being streamed.
+type sizeLimitingRoundTripper struct {
+	transport http.RoundTripper
+	max       int64
+}
+
+func (rt *sizeLimitingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	res, err := rt.transport.RoundTrip(request)
+	if err != nil {
+		return res, err
+	}
+
+	// Responses to HEAD requests declare the length of a body they do not
+	// carry, and upgraded connections have none.
+	if request.Method == "HEAD" || res.StatusCode == http.StatusSwitchingProtocols {
+		return res, nil
+	}
+
+	if res.ContentLength > rt.max {
+		res.Body.Close()
+		return nil, routeServiceResponseTooLarge
+	}
+
+	res.Body = &limitedReadCloser{ReadCloser: res.Body, remaining: rt.max}
+	return res, nil
+}
+
+type limitedReadCloser struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (r *limitedReadCloser) Read(p []byte) (int, error) {
+	if r.remaining <= 0 {
+		// Only fail once there is more to read than allowed.
+		var b [1]byte
+		n, err := r.ReadCloser.Read(b[:])
+		if n > 0 {
+			return 0, routeServiceResponseTooLarge
+		}
+		return 0, err
+	}
+
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.remaining -= int64(n)
+	return n, err
+}
+
+// gzippingRoundTripper gzips responses of the given content types for clients
+// accepting gzip. Responses already encoded, e.g. by a route service, are left
+// alone.
+type gzippingRoundTripper struct {
+	transport    http.RoundTripper
+	contentTypes map[string]bool
+}
+
+func newGzippingRoundTripper(transport http.RoundTripper, contentTypes []string) *gzippingRoundTripper {
+	rt := &gzippingRoundTripper{
+		transport:    transport,
+		contentTypes: make(map[string]bool, len(contentTypes)),
+	}
+	for _, contentType := range contentTypes {
+		rt.contentTypes[strings.ToLower(contentType)] = true
+	}
+	return rt
+}
+
+func (rt *gzippingRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	res, err := rt.transport.RoundTrip(request)
+	if err != nil || !rt.compressible(request, res) {
+		return res, err
+	}
+
+	body := res.Body
+	pr, pw := io.Pipe()
+	go func() {
+		w := gzip.NewWriter(pw)
+		_, err := io.Copy(w, body)
+		if err == nil {
+			err = w.Close()
+		}
+		body.Close()
+		pw.CloseWithError(err)
+	}()
+
+	res.Body = pr
+	res.ContentLength = -1
+	res.Header.Del("Content-Length")
+	res.Header.Set("Content-Encoding", "gzip")
+	res.Header.Add("Vary", "Accept-Encoding")
+	return res, nil
+}
+
+func (rt *gzippingRoundTripper) compressible(request *http.Request, res *http.Response) bool {
+	if request.Method == "HEAD" || !acceptsGzip(request.Header.Get("Accept-Encoding")) {
+		return false
+	}
+
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusPartialContent, http.StatusNotModified:
+		return false
+	}
+
+	if res.Header.Get("Content-Encoding") != "" || res.Header.Get("Content-Range") != "" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return err == nil && rt.contentTypes[mediaType]
+}
+
+func acceptsGzip(acceptEncoding string) bool {
+	for _, coding := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(coding, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[len("q="):], 64)
+				return err == nil && q > 0
+			}
+		}
+		return true
+	}
+	return false
+}
+
 func retryableError(err error) bool {
 	ne, netErr := err.(*net.OpError)
 	if netErr && ne.Op == "dial" {
@@ -1,9 +1,14 @@
 package proxy_test
 
 import (
+	"context"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/cloudfoundry/gorouter/access_log"
 	"github.com/cloudfoundry/gorouter/proxy"
@@ -113,6 +118,92 @@ var _ = Describe("ProxyRoundTripper", func() {
 					Expect(endpointIterator.NextCallCount()).To(Equal(2))
 				})
 			})
+
+			Context("when the backend drops the connection", func() {
+				BeforeEach(func() {
+					transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+						return nil, io.EOF
+					}
+				})
+
+				It("does not retry", func() {
+					_, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).To(Equal(io.EOF))
+					Expect(endpointIterator.NextCallCount()).To(Equal(1))
+				})
+			})
+		})
+
+		Context("backend for a request returning from a route service", func() {
+			var roundTripErrors []error
+
+			BeforeEach(func() {
+				endpointIterator.NextReturns(&route.Endpoint{Tags: map[string]string{}})
+				roundTripErrors = nil
+				transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+					if len(roundTripErrors) > 0 {
+						err := roundTripErrors[0]
+						roundTripErrors = roundTripErrors[1:]
+						return nil, err
+					}
+					return &http.Response{StatusCode: http.StatusOK}, nil
+				}
+				proxyRoundTripper = proxy.NewReturningBackendRoundTripper(transport, endpointIterator, handler, after, 2)
+			})
+
+			It("retries a failed connection", func() {
+				roundTripErrors = []error{dialError}
+
+				res, err := proxyRoundTripper.RoundTrip(req)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(transport.RoundTripCallCount()).To(Equal(2))
+			})
+
+			It("retries an idempotent request that gets no response", func() {
+				roundTripErrors = []error{io.EOF, io.ErrUnexpectedEOF}
+
+				res, err := proxyRoundTripper.RoundTrip(req)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(transport.RoundTripCallCount()).To(Equal(3))
+			})
+
+			It("gives up after the configured retries", func() {
+				roundTripErrors = []error{dialError, io.EOF, dialError, dialError}
+
+				_, err := proxyRoundTripper.RoundTrip(req)
+				Expect(err).To(Equal(dialError))
+				Expect(transport.RoundTripCallCount()).To(Equal(3))
+			})
+
+			It("does not retry requests with a body that get no response", func() {
+				req.Method = "PUT"
+				req.Body = ioutil.NopCloser(strings.NewReader("body"))
+				roundTripErrors = []error{io.EOF}
+
+				_, err := proxyRoundTripper.RoundTrip(req)
+				Expect(err).To(Equal(io.EOF))
+				Expect(transport.RoundTripCallCount()).To(Equal(1))
+			})
+
+			It("does not retry requests with other methods that get no response", func() {
+				req.Method = "POST"
+				roundTripErrors = []error{io.EOF}
+
+				_, err := proxyRoundTripper.RoundTrip(req)
+				Expect(err).To(Equal(io.EOF))
+				Expect(transport.RoundTripCallCount()).To(Equal(1))
+			})
+
+			It("does not retry timeouts", func() {
+				timeout := &net.OpError{Op: "read", Err: timeoutError{}}
+				roundTripErrors = []error{timeout}
+
+				_, err := proxyRoundTripper.RoundTrip(req)
+				Expect(err).To(Equal(timeout))
+				Expect(transport.RoundTripCallCount()).To(Equal(1))
+			})
 		})
 
 		Context("route service", func() {
@@ -175,6 +266,100 @@ var _ = Describe("ProxyRoundTripper", func() {
 					Expect(roundTripCallCount).To(Equal(3))
 				})
 			})
+
+			Context("with a retry policy", func() {
+				var roundTripCallCount int
+
+				BeforeEach(func() {
+					roundTripCallCount = 0
+					transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+						roundTripCallCount++
+						if roundTripCallCount == 1 {
+							return nil, dialError
+						}
+						return &http.Response{StatusCode: http.StatusOK}, nil
+					}
+				})
+
+				It("retries a failed connection after the delay", func() {
+					proxyRoundTripper = proxy.NewRouteServiceRoundTripper(transport, handler, after, 1, 20*time.Millisecond)
+
+					start := time.Now()
+					res, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+					Expect(roundTripCallCount).To(Equal(2))
+					Expect(time.Since(start)).To(BeNumerically(">=", 10*time.Millisecond))
+				})
+
+				It("does not retry when retries are disabled", func() {
+					proxyRoundTripper = proxy.NewRouteServiceRoundTripper(transport, handler, after, 0, 20*time.Millisecond)
+
+					_, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).To(Equal(dialError))
+					Expect(roundTripCallCount).To(Equal(1))
+				})
+
+				It("does not retry forever with a negative retry count", func() {
+					transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+						roundTripCallCount++
+						return nil, dialError
+					}
+					proxyRoundTripper = proxy.NewRouteServiceRoundTripper(transport, handler, after, -1, 0)
+
+					_, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).To(Equal(dialError))
+					Expect(roundTripCallCount).To(Equal(1))
+				})
+
+				It("stops waiting to retry once the client has gone away", func() {
+					ctx, cancel := context.WithCancel(req.Context())
+					req = req.WithContext(ctx)
+					transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+						roundTripCallCount++
+						cancel()
+						return nil, dialError
+					}
+					proxyRoundTripper = proxy.NewRouteServiceRoundTripper(transport, handler, after, 1, 10*time.Second)
+
+					start := time.Now()
+					_, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).To(Equal(dialError))
+					Expect(roundTripCallCount).To(Equal(1))
+					Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+				})
+
+				It("does not retry errors after connecting", func() {
+					transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+						roundTripCallCount++
+						return nil, errors.New("connection reset by peer")
+					}
+					proxyRoundTripper = proxy.NewRouteServiceRoundTripper(transport, handler, after, 1, 0)
+
+					_, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).To(HaveOccurred())
+					Expect(roundTripCallCount).To(Equal(1))
+				})
+
+				It("does not retry a response the route service produced", func() {
+					transport.RoundTripStub = func(req *http.Request) (*http.Response, error) {
+						roundTripCallCount++
+						return &http.Response{StatusCode: http.StatusBadGateway}, nil
+					}
+					proxyRoundTripper = proxy.NewRouteServiceRoundTripper(transport, handler, after, 1, 0)
+
+					res, err := proxyRoundTripper.RoundTrip(req)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+					Expect(roundTripCallCount).To(Equal(1))
+				})
+			})
 		})
 	})
 })
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
@@ -2,6 +2,7 @@ package proxy_test
 
 import (
 	"crypto/tls"
+	"crypto/x509"
 	"net"
 	"net/http"
 
@@ -31,6 +32,11 @@ var (
 	accessLogFile *test_util.FakeFile
 	crypto        secure.Crypto
 	cryptoPrev    secure.Crypto
+	hostCrypto    map[string]secure.Crypto
+
+	routeServiceErrors proxy.RouteServiceErrorProvider
+	reporter           proxy.ProxyReporter
+	rootCAs            *x509.CertPool
 )
 
 func TestProxy(t *testing.T) {
@@ -45,10 +51,15 @@ var _ = BeforeEach(func() {
 	Expect(err).NotTo(HaveOccurred())
 
 	cryptoPrev = nil
+	hostCrypto = nil
+	routeServiceErrors = nil
+	reporter = nullVarz{}
+	rootCAs = nil
 
 	conf = config.DefaultConfig()
 	conf.TraceKey = "my_trace_key"
 	conf.EndpointTimeout = 500 * time.Millisecond
+	conf.CipherSuites = []uint16{tls.TLS_RSA_WITH_AES_256_CBC_SHA}
 })
 
 var _ = JustBeforeEach(func() {
@@ -60,15 +71,17 @@ var _ = JustBeforeEach(func() {
 	dropsonde.InitializeWithEmitter(fakeEmitter)
 
 	accessLogFile = new(test_util.FakeFile)
-	accessLog = access_log.NewFileAndLoggregatorAccessLogger(accessLogFile, "")
+	fileAccessLogger := access_log.NewFileAndLoggregatorAccessLogger(accessLogFile, "")
+	fileAccessLogger.SetJSONFormat(conf.AccessLogFormat == "json")
+	accessLog = fileAccessLogger
 	go accessLog.Run()
 
 	conf.EnableSSL = true
-	conf.CipherSuites = []uint16{tls.TLS_RSA_WITH_AES_256_CBC_SHA}
 
 	tlsConfig := &tls.Config{
 		CipherSuites:       conf.CipherSuites,
 		InsecureSkipVerify: conf.SSLSkipValidation,
+		RootCAs:            rootCAs,
 	}
 
 	p = proxy.NewProxy(proxy.ProxyArgs{
@@ -76,14 +89,72 @@ var _ = JustBeforeEach(func() {
 		Ip:                  conf.Ip,
 		TraceKey:            conf.TraceKey,
 		Registry:            r,
-		Reporter:            nullVarz{},
+		Reporter:            reporter,
 		AccessLogger:        accessLog,
 		SecureCookies:       conf.SecureCookies,
 		TLSConfig:           tlsConfig,
 		RouteServiceEnabled: conf.RouteServiceEnabled,
+		RouteServiceEnforce: conf.RouteServiceEnforce,
 		RouteServiceTimeout: conf.RouteServiceTimeout,
 		Crypto:              crypto,
 		CryptoPrev:          cryptoPrev,
+		GzipContentTypes:    conf.GzipContentTypes,
+
+		RouteServiceReservedHeaders:       conf.RouteServiceReservedHeaders,
+		RouteServiceHopByHopHeaders:       conf.RouteServiceHopByHopHeaders,
+		RouteServiceResponseHeaders:       conf.RouteServiceResponseHeaders,
+		RouteServiceMaxForwardedUrlLength: conf.RouteServiceMaxForwardedUrlLength,
+		RouteServiceMaxIdleConnsPerHost:   conf.RouteServiceMaxIdleConnsPerHost,
+		RouteServiceIdleConnTimeout:       conf.RouteServiceIdleConnTimeout,
+		RouteServiceDialTimeout:           conf.RouteServiceDialTimeout,
+
+		RouteServiceSignatureHeader:    conf.RouteServiceSignatureHeader,
+		RouteServiceMetadataHeader:     conf.RouteServiceMetadataHeader,
+		RouteServiceForwardedUrlHeader: conf.RouteServiceForwardedUrlHeader,
+		RouteServiceRejectRedirects:    conf.RouteServiceRejectRedirects,
+
+		RouteServiceCompressionThreshold: conf.RouteServiceCompressionThreshold,
+		RouteServiceDeniedHosts:          conf.RouteServiceDeniedHosts,
+
+		EnableZipkin: conf.Tracing.EnableZipkin,
+
+		RouteServiceRetries:    conf.RouteServiceRetries,
+		RouteServiceRetryDelay: conf.RouteServiceRetryDelay,
+
+		RouteServiceBackendRetries: conf.RouteServiceBackendRetries,
+
+		RouteServiceServerNames:        conf.RouteServiceServerNames,
+		RouteServiceClientCertificates: conf.RouteServiceClientCertificates,
+
+		RouteServiceStripForwardedUrlFragment: conf.RouteServiceStripForwardedUrlFragment,
+		RouteServiceBindAppGuid:               conf.RouteServiceBindAppGuid,
+		RouteServiceSignRouteKey:              conf.RouteServiceSignRouteKey,
+		RouteServiceBindRouteKey:              conf.RouteServiceBindRouteKey,
+		RouteServiceStripSignatureFromApps:    conf.RouteServiceStripSignatureFromApps,
+		RouteServiceSignClientIP:              conf.RouteServiceSignClientIP,
+		RouteServiceForwardedUrlClientScheme:  conf.RouteServiceForwardedUrlClientScheme,
+		RouteServiceTrustForwardedProto:       conf.RouteServiceTrustForwardedProto,
+		RouteServiceMisdirectedOnHostMismatch: conf.RouteServiceMisdirectedOnHostMismatch,
+		RouteServiceMinTLSVersion:             conf.RouteServiceMinTLSVersion,
+		RouteServiceIgnoreDefaultPorts:        conf.RouteServiceIgnoreDefaultPorts,
+		RouteServiceAllowPathExtensions:       conf.RouteServiceAllowPathExtensions,
+		RouteServiceCanonicalForwardedUrls:    conf.RouteServiceCanonicalForwardedUrls,
+		RouteServiceMaxResponseBytes:          conf.RouteServiceMaxResponseBytes,
+		RouteServiceDebugHeader:               conf.RouteServiceDebugHeader,
+		RouteServiceMaxHops:                   conf.RouteServiceMaxHops,
+		RouteServiceProxyUrl:                  conf.RouteServiceProxyUrl,
+		DefaultRouteServiceUrl:                conf.DefaultRouteServiceUrl,
+		RouteServiceIssuer:                    conf.RouteServiceIssuer,
+		RouteServiceExpiryGrace:               conf.RouteServiceExpiryGrace,
+		RouteServiceHostCrypto:                hostCrypto,
+		RouteServiceFailClosed:                conf.RouteServiceFailClosed,
+
+		RouteServiceForwardedUrlOptionalPaths: conf.RouteServiceForwardedUrlOptionalPaths,
+		RouteServiceMaxInFlight:               conf.RouteServiceMaxInFlight,
+
+		RouteServiceValidationFailureLogSampleRate: conf.RouteServiceValidationFailureLogSampleRate,
+
+		RouteServiceErrors: routeServiceErrors,
 	})
 
 	proxyServer, err = net.Listen("tcp", "127.0.0.1:0")
@@ -2,12 +2,19 @@ package proxy_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
 	"net/http"
 	"net/url"
@@ -42,6 +49,10 @@ func (_ nullVarz) CaptureBadGateway(*http.Request)                            {}
 func (_ nullVarz) CaptureRoutingRequest(b *route.Endpoint, req *http.Request) {}
 func (_ nullVarz) CaptureRoutingResponse(b *route.Endpoint, res *http.Response, t time.Time, d time.Duration) {
 }
+func (_ nullVarz) CaptureRouteServiceResponse(host string, res *http.Response, d time.Duration) {}
+func (_ nullVarz) CaptureRouteServiceRequestStarted()                                           {}
+func (_ nullVarz) CaptureRouteServiceRequestFinished()                                          {}
+func (_ nullVarz) CaptureRouteServiceSignatureAge(d time.Duration)                              {}
 
 var _ = Describe("Proxy", func() {
 
@@ -63,6 +74,23 @@ var _ = Describe("Proxy", func() {
 		conn.CheckLine("HTTP/1.0 200 OK")
 	})
 
+	It("matches hosts regardless of case", func() {
+		ln := registerHandler(r, "my_host.com", func(conn *test_util.HttpConn) {
+			conn.ReadRequest()
+			conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+			conn.Close()
+		})
+		defer ln.Close()
+
+		conn := dialProxy(proxyServer)
+
+		req := test_util.NewRequest("GET", "My_Host.COM", "/", nil)
+		conn.WriteRequest(req)
+
+		res, _ := conn.ReadResponse()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+	})
+
 	It("responds transparently to a trailing slash versus no trailing slash", func() {
 		lnWithoutSlash := registerHandler(r, "test/my%20path/your_path", func(conn *test_util.HttpConn) {
 			conn.CheckLine("GET /my%20path/your_path/ HTTP/1.1")
@@ -967,6 +995,91 @@ var _ = Describe("Proxy", func() {
 		Expect(resp.StatusCode).To(Equal(http.StatusOK))
 	})
 
+	Context("when gzip content types are configured", func() {
+		var body = strings.Repeat("compress me ", 100)
+
+		BeforeEach(func() {
+			conf.GzipContentTypes = []string{"text/plain"}
+		})
+
+		registerBackend := func(contentType, contentEncoding, responseBody string) net.Listener {
+			return registerHandler(r, "gzip", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				resp := test_util.NewResponse(http.StatusOK)
+				resp.Header.Set("Content-Type", contentType)
+				if contentEncoding != "" {
+					resp.Header.Set("Content-Encoding", contentEncoding)
+				}
+				resp.Body = ioutil.NopCloser(strings.NewReader(responseBody))
+				resp.ContentLength = int64(len(responseBody))
+				conn.WriteResponse(resp)
+				conn.Close()
+			})
+		}
+
+		It("gzips responses of those types for clients accepting gzip", func() {
+			ln := registerBackend("text/plain; charset=utf-8", "", body)
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "gzip", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip, deflate")
+			conn.WriteRequest(req)
+
+			res, resBody := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(res.Header.Get("Vary")).To(Equal("Accept-Encoding"))
+			Expect(gunzip(resBody)).To(Equal(body))
+		})
+
+		It("does not gzip responses for clients not accepting gzip", func() {
+			ln := registerBackend("text/plain", "", body)
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "gzip", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip;q=0, deflate")
+			conn.WriteRequest(req)
+
+			res, resBody := conn.ReadResponse()
+			Expect(res.Header.Get("Content-Encoding")).To(BeEmpty())
+			Expect(resBody).To(Equal(body))
+		})
+
+		It("does not gzip responses of other types", func() {
+			ln := registerBackend("image/png", "", body)
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "gzip", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			conn.WriteRequest(req)
+
+			res, resBody := conn.ReadResponse()
+			Expect(res.Header.Get("Content-Encoding")).To(BeEmpty())
+			Expect(resBody).To(Equal(body))
+		})
+
+		It("does not gzip responses that are already encoded", func() {
+			ln := registerBackend("text/plain", "gzip", gzipString(body))
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "gzip", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			conn.WriteRequest(req)
+
+			res, resBody := conn.ReadResponse()
+			Expect(res.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(gunzip(resBody)).To(Equal(body))
+		})
+	})
+
 	It("retries when failed endpoints exist", func() {
 		ln := registerHandler(r, "retries", func(conn *test_util.HttpConn) {
 			conn.CheckLine("GET / HTTP/1.1")
@@ -1053,6 +1166,25 @@ func registerHandlerWithRouteService(reg *registry.RouteRegistry, path string, r
 	return registerHandlerWithInstanceId(reg, path, routeServiceUrl, handler, "")
 }
 
+func registerRouteServiceInstance(reg *registry.RouteRegistry, path string, handler connHandler) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Ω(err).NotTo(HaveOccurred())
+
+	go runBackendInstance(ln, handler)
+
+	host, portStr, err := net.SplitHostPort(ln.Addr().String())
+	Ω(err).NotTo(HaveOccurred())
+
+	port, err := strconv.Atoi(portStr)
+	Ω(err).NotTo(HaveOccurred())
+
+	endpoint := route.NewEndpoint("", host, uint16(port), "", nil, -1, "")
+	endpoint.IsRouteService = true
+	reg.Register(route.Uri(path), endpoint)
+
+	return ln
+}
+
 func registerHandlerWithInstanceId(reg *registry.RouteRegistry, path string, routeServiceUrl string, handler connHandler, instanceId string) net.Listener {
 	ln, err := net.Listen("tcp", "127.0.0.1:0")
 	Ω(err).NotTo(HaveOccurred())
@@ -1109,3 +1241,61 @@ func newTlsListener(listener net.Listener) net.Listener {
 
 	return tls.NewListener(listener, tlsConfig)
 }
+
+func newCertificate(serverName string) (tls.Certificate, *x509.CertPool) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: serverName},
+		DNSNames:              []string{serverName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	Expect(err).ToNot(HaveOccurred())
+
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, pool
+}
+
+func gzipString(s string) string {
+	var b bytes.Buffer
+	w := gzip.NewWriter(&b)
+	_, err := w.Write([]byte(s))
+	Expect(err).NotTo(HaveOccurred())
+	Expect(w.Close()).To(Succeed())
+	return b.String()
+}
+
+func gunzip(s string) string {
+	r, err := gzip.NewReader(strings.NewReader(s))
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	b, err := ioutil.ReadAll(r)
+	ExpectWithOffset(1, err).NotTo(HaveOccurred())
+	return string(b)
+}
+
+// newConnStateServer returns a server answering every request with a 200,
+// and a channel receiving the states its connections go through.
+func newConnStateServer() (*http.Server, <-chan http.ConnState) {
+	states := make(chan http.ConnState, 100)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ConnState: func(conn net.Conn, state http.ConnState) {
+			states <- state
+		},
+	}
+	return server, states
+}
@@ -24,6 +24,10 @@ type RequestHandler struct {
 
 	request  *http.Request
 	response ProxyResponseWriter
+
+	routeServiceErrors RouteServiceErrorProvider
+
+	quietValidationFailure bool
 }
 
 func NewRequestHandler(request *http.Request, response ProxyResponseWriter, r ProxyReporter,
@@ -54,6 +58,26 @@ func (h *RequestHandler) Logger() *steno.Logger {
 	return h.StenoLogger
 }
 
+// SetRouteServiceErrorProvider replaces the plain text responses written for
+// route service failures.
+func (h *RequestHandler) SetRouteServiceErrorProvider(provider RouteServiceErrorProvider) {
+	h.routeServiceErrors = provider
+}
+
+// SuppressValidationFailureLog leaves signature validation failures of this
+// request unlogged, for when they are sampled.
+func (h *RequestHandler) SuppressValidationFailureLog() {
+	h.quietValidationFailure = true
+}
+
+func (h *RequestHandler) logValidationFailure(err error, message string) {
+	if h.quietValidationFailure {
+		return
+	}
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warn(message)
+}
+
 func (h *RequestHandler) HandleHeartbeat() {
 	h.response.Header().Set("Cache-Control", "private, max-age=0")
 	h.response.Header().Set("Expires", "0")
@@ -63,6 +87,18 @@ func (h *RequestHandler) HandleHeartbeat() {
 	h.request.Close = true
 }
 
+// HandleFailedHeartbeat takes the router out of the load balancer's rotation
+// while it cannot serve requests.
+func (h *RequestHandler) HandleFailedHeartbeat(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.heartbeat.failed")
+
+	h.response.Header().Set("Cache-Control", "private, max-age=0")
+	h.response.Header().Set("Expires", "0")
+	h.writeStatus(http.StatusServiceUnavailable, "Router is not ready to serve requests.")
+	h.request.Close = true
+}
+
 func (h *RequestHandler) HandleUnsupportedProtocol() {
 	// must be hijacked, otherwise no response is sent back
 	conn, buf, err := h.hijack()
@@ -95,10 +131,27 @@ func (h *RequestHandler) HandleBadGateway(err error) {
 }
 
 func (h *RequestHandler) HandleBadSignature(err error) {
-	h.StenoLogger.Set("Error", err.Error())
-	h.StenoLogger.Warnf("proxy.signature.validation.failed")
+	h.logValidationFailure(err, "proxy.signature.validation.failed")
+
+	h.writeRouteServiceError(RouteServiceBadSignature, err, http.StatusBadRequest, "Failed to validate Route Service Signature")
+	h.response.Done()
+}
+
+// HandleMissingSignature is HandleBadSignature for a metadata header sent
+// without a signature header.
+func (h *RequestHandler) HandleMissingSignature(err error) {
+	h.logValidationFailure(err, "proxy.signature.validation.missing")
+
+	h.writeRouteServiceError(RouteServiceMissingSignature, err, http.StatusBadRequest, "Route service metadata sent without a signature.")
+	h.response.Done()
+}
+
+// HandleMisdirectedRequest is HandleBadSignature for a forwarded url for
+// another host than the one requested.
+func (h *RequestHandler) HandleMisdirectedRequest(err error) {
+	h.logValidationFailure(err, "proxy.signature.validation.misdirected")
 
-	h.writeStatus(http.StatusBadRequest, "Failed to validate Route Service Signature")
+	h.writeRouteServiceError(RouteServiceMisdirected, err, http.StatusMisdirectedRequest, "Forwarded url is for another host.")
 	h.response.Done()
 }
 
@@ -106,15 +159,64 @@ func (h *RequestHandler) HandleRouteServiceFailure(err error) {
 	h.StenoLogger.Set("Error", err.Error())
 	h.StenoLogger.Warnf("proxy.route-service.failed")
 
-	h.writeStatus(http.StatusInternalServerError, "Route service request failed.")
+	h.writeRouteServiceError(RouteServiceFailed, err, http.StatusInternalServerError, "Route service request failed.")
 	h.response.Done()
 }
 
 func (h *RequestHandler) HandleUnsupportedRouteService() {
 	h.StenoLogger.Warnf("proxy.route-service.unsupported")
 
-	h.response.Header().Set("X-Cf-RouterError", "route_service_unsupported")
-	h.writeStatus(http.StatusBadGateway, "Support for route services is disabled.")
+	h.writeRouteServiceError(RouteServiceUnsupported, nil, http.StatusBadGateway, "Support for route services is disabled.")
+	h.response.Done()
+}
+
+func (h *RequestHandler) HandleDeniedRouteService(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.route-service.denied")
+
+	h.writeRouteServiceError(RouteServiceDenied, err, http.StatusBadGateway, "Route service host is not allowed.")
+	h.response.Done()
+}
+
+func (h *RequestHandler) HandleRouteServiceNotTLS(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.route-service.not-tls")
+
+	h.writeRouteServiceError(RouteServiceNotTLS, err, http.StatusBadGateway, "Route service did not respond with TLS.")
+	h.response.Done()
+}
+
+func (h *RequestHandler) HandleRouteServiceBadResponse(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.route-service.bad-response")
+
+	h.writeRouteServiceError(RouteServiceBadResponse, err, http.StatusBadGateway, "Route service sent an invalid response.")
+	h.response.Done()
+}
+
+func (h *RequestHandler) HandleRouteServiceLoop(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.route-service.loop")
+
+	h.writeRouteServiceError(RouteServiceLoop, err, http.StatusBadGateway, "Route service loop detected.")
+	h.response.Done()
+}
+
+func (h *RequestHandler) HandleRouteServiceResponseTooLarge(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.route-service.response-too-large")
+
+	h.writeRouteServiceError(RouteServiceResponseTooLarge, err, http.StatusBadGateway, "Route service response is too large.")
+	h.response.Done()
+}
+
+// HandleRouteServiceOverloaded fails a request at once, rather than queueing
+// it, while as many requests as allowed are in flight to route services.
+func (h *RequestHandler) HandleRouteServiceOverloaded(err error) {
+	h.StenoLogger.Set("Error", err.Error())
+	h.StenoLogger.Warnf("proxy.route-service.overloaded")
+
+	h.writeRouteServiceError(RouteServiceOverloaded, err, http.StatusServiceUnavailable, "Too many requests in flight to route services.")
 	h.response.Done()
 }
 
@@ -152,6 +254,27 @@ func (h *RequestHandler) writeStatus(code int, message string) {
 	}
 }
 
+// writeRouteServiceError answers with the provider's response, if one is set,
+// or with message. Either way the reason is given in X-Cf-RouterError.
+func (h *RequestHandler) writeRouteServiceError(reason string, err error, code int, message string) {
+	h.response.Header().Set("X-Cf-RouterError", reason)
+
+	if h.routeServiceErrors == nil {
+		h.writeStatus(code, message)
+		return
+	}
+
+	code, contentType, body := h.routeServiceErrors.RouteServiceError(reason, err, h.request)
+
+	h.StenoLogger.Warn(fmt.Sprintf("%d %s: %s", code, http.StatusText(code), message))
+	h.logrecord.StatusCode = code
+
+	h.response.Header().Set("Content-Type", contentType)
+	h.response.Header().Set("X-Content-Type-Options", "nosniff")
+	h.response.WriteHeader(code)
+	h.response.Write(body)
+}
+
 func (h *RequestHandler) serveTcp(iter route.EndpointIterator) error {
 	var err error
 	var connection net.Conn
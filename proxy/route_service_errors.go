@@ -0,0 +1,26 @@
+package proxy
+
+import "net/http"
+
+// Reasons passed to a RouteServiceErrorProvider.
+const (
+	RouteServiceUnsupported  = "route_service_unsupported"
+	RouteServiceBadSignature = "route_service_bad_signature"
+	RouteServiceFailed       = "route_service_failed"
+	RouteServiceDenied       = "route_service_denied"
+	RouteServiceNotTLS       = "route_service_not_tls"
+	RouteServiceMisdirected  = "route_service_misdirected"
+
+	RouteServiceMissingSignature = "route_service_missing_signature"
+	RouteServiceLoop             = "route_service_loop"
+	RouteServiceResponseTooLarge = "route_service_response_too_large"
+	RouteServiceBadResponse      = "route_service_bad_response"
+	RouteServiceOverloaded       = "route_service_overloaded"
+)
+
+// RouteServiceErrorProvider renders the response returned to the client when
+// a request fails because of a route service. err is nil when the failure
+// has no underlying error, such as route services being disabled.
+type RouteServiceErrorProvider interface {
+	RouteServiceError(reason string, err error, request *http.Request) (code int, contentType string, body []byte)
+}
@@ -1,15 +1,38 @@
 package proxy_test
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
 	"time"
 
+	fake_metric_sender "github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
+	"github.com/cloudfoundry/gorouter/access_log"
+	router_http "github.com/cloudfoundry/gorouter/common/http"
 	"github.com/cloudfoundry/gorouter/common/secure"
+	"github.com/cloudfoundry/gorouter/common/secure/fakes"
+	"github.com/cloudfoundry/gorouter/proxy"
+	"github.com/cloudfoundry/gorouter/route"
 	"github.com/cloudfoundry/gorouter/route_service"
 	"github.com/cloudfoundry/gorouter/test_util"
+	steno "github.com/cloudfoundry/gosteno"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 )
@@ -93,6 +116,7 @@ var _ = Describe("Route Services", func() {
 
 			res, body := conn.ReadResponse()
 			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_unsupported"))
 			Expect(body).To(ContainSubstring("Support for route services is disabled."))
 		})
 	})
@@ -204,23 +228,3773 @@ var _ = Describe("Route Services", func() {
 				})
 			})
 
+			Context("when stripping the signature from apps is enabled", func() {
+				BeforeEach(func() {
+					conf.RouteServiceStripSignatureFromApps = true
+				})
+
+				It("passes the signature and metadata on to a registered route service", func() {
+					ln := registerRouteServiceInstance(r, "test/my_path", func(conn *test_util.HttpConn) {
+						req, _ := conn.ReadRequest()
+						Expect(req.Header.Get(route_service.RouteServiceSignature)).To(Equal(signatureHeader))
+						Expect(req.Header.Get(route_service.RouteServiceMetadata)).To(Equal(metadataHeader))
+
+						conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+						conn.Close()
+					})
+					defer ln.Close()
+
+					conn := dialProxy(proxyServer)
+
+					req := test_util.NewRequest("GET", "test", "/my_path", nil)
+					req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+					req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+					conn.WriteRequest(req)
+
+					res, _ := conn.ReadResponse()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				})
+
+				It("strips the signature and metadata headers from routes without a route service", func() {
+					ln := registerHandler(r, "test/my_path", func(conn *test_util.HttpConn) {
+						req, _ := conn.ReadRequest()
+						Expect(req.Header.Get(route_service.RouteServiceSignature)).To(Equal(""))
+						Expect(req.Header.Get(route_service.RouteServiceMetadata)).To(Equal(""))
+
+						conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+						conn.Close()
+					})
+					defer ln.Close()
+
+					conn := dialProxy(proxyServer)
+
+					req := test_util.NewRequest("GET", "test", "/my_path", nil)
+					req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+					req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+					conn.WriteRequest(req)
+
+					res, _ := conn.ReadResponse()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				})
+			})
+
 			It("returns 502 when backend not available", func() {
 				ip, err := net.ResolveTCPAddr("tcp", "localhost:81")
 				Expect(err).To(BeNil())
 
-				// register route service, should NOT route to it
-				registerAddr(r, "mybadapp.com", "https://"+routeServiceListener.Addr().String(), ip, "instanceId")
+				// register route service, should NOT route to it
+				registerAddr(r, "mybadapp.com", "https://"+routeServiceListener.Addr().String(), ip, "instanceId")
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "mybadapp.com", "/", nil)
+				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+				conn.WriteRequest(req)
+				resp, _ := conn.ReadResponse()
+
+				Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+			})
+		})
+	})
+
+	Context("with custom route service header names", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceSignatureHeader = "X-Signature"
+			conf.RouteServiceMetadataHeader = "X-Metadata"
+			conf.RouteServiceForwardedUrlHeader = "X-Original-Url"
+
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				crypto, err := secure.NewAesGCM([]byte(cryptoKey))
+				Expect(err).ToNot(HaveOccurred())
+				_, err = route_service.SignatureFromHeaders(r.Header.Get("X-Signature"), r.Header.Get("X-Metadata"), crypto)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(r.Header.Get("X-Original-Url")).To(Equal("http://my_host.com/"))
+				Expect(r.Header.Get(route_service.RouteServiceSignature)).To(Equal(""))
+
+				w.Write([]byte("My Special Snowflake Route Service\n"))
+			})
+		})
+
+		It("sends the signature to the route service using the custom headers", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+		})
+
+		It("validates requests returning with the custom headers and strips them", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				Expect(req.Header.Get("X-Signature")).To(Equal(""))
+				Expect(req.Header.Get("X-Metadata")).To(Equal(""))
+
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set("X-Signature", signatureHeader)
+			req.Header.Set("X-Metadata", metadataHeader)
+			req.Header.Set("X-Original-Url", forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("with a custom route service error provider", func() {
+		BeforeEach(func() {
+			routeServiceErrors = jsonRouteServiceErrors{}
+		})
+
+		sendRequest := func(accept string) (*http.Response, string) {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set("Accept", accept)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+			conn.WriteRequest(req)
+
+			return conn.ReadResponse()
+		}
+
+		Context("when the signature is invalid", func() {
+			It("returns the JSON error for API clients", func() {
+				res, body := sendRequest("application/json")
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(res.Header.Get("Content-Type")).To(Equal("application/json"))
+
+				var payload map[string]string
+				Expect(json.Unmarshal([]byte(body), &payload)).To(Succeed())
+				Expect(payload["reason"]).To(Equal(proxy.RouteServiceBadSignature))
+				Expect(payload["error"]).To(Equal(route_service.RouteServiceForwardedUrlMismatch.Error()))
+			})
+
+			It("returns the provider's page for other clients", func() {
+				res, body := sendRequest("text/html")
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(res.Header.Get("Content-Type")).To(Equal("text/html"))
+				Expect(body).To(ContainSubstring("<h1>" + proxy.RouteServiceBadSignature + "</h1>"))
+			})
+		})
+
+		Context("when route services are disabled", func() {
+			BeforeEach(func() {
+				conf.RouteServiceEnabled = false
+			})
+
+			It("returns the JSON error for API clients", func() {
+				res, body := sendRequest("application/json")
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+				Expect(res.Header.Get("Content-Type")).To(Equal("application/json"))
+				Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_unsupported"))
+
+				var payload map[string]string
+				Expect(json.Unmarshal([]byte(body), &payload)).To(Succeed())
+				Expect(payload["reason"]).To(Equal(proxy.RouteServiceUnsupported))
+			})
+		})
+	})
+
+	Context("when the route service responds with a redirect", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.SetCookie(w, &http.Cookie{Name: "rs-session", Value: "abc"})
+				w.Header().Set("Location", "https://login.example.com/authorize?state=xyz")
+				w.WriteHeader(http.StatusFound)
+			})
+		})
+
+		sendRequest := func() (*http.Response, string) {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			return conn.ReadResponse()
+		}
+
+		It("passes the redirect back to the client untouched", func() {
+			res, _ := sendRequest()
+			Expect(res.StatusCode).To(Equal(http.StatusFound))
+			Expect(res.Header.Get("Location")).To(Equal("https://login.example.com/authorize?state=xyz"))
+			Expect(res.Header.Get("Set-Cookie")).To(ContainSubstring("rs-session=abc"))
+		})
+
+		Context("when route service redirects are rejected", func() {
+			BeforeEach(func() {
+				conf.RouteServiceRejectRedirects = true
+			})
+
+			It("returns a 502 without the redirect", func() {
+				res, _ := sendRequest()
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+				Expect(res.Header.Get("Location")).To(Equal(""))
+			})
+		})
+	})
+
+	Context("when route service hosts are denied", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceDeniedHosts = []string{"169.254.0.0/16"}
+		})
+
+		It("refuses to forward to a denied address", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://169.254.169.254/latest/meta-data", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_denied"))
+			Expect(body).To(ContainSubstring("Route service host is not allowed."))
+		})
+
+		Context("when a hostname resolves into a denied range", func() {
+			BeforeEach(func() {
+				conf.RouteServiceDeniedHosts = []string{"127.0.0.0/8", "::1"}
+			})
+
+			It("refuses to connect to it", func() {
+				_, port, err := net.SplitHostPort(routeServiceListener.Addr().String())
+				Expect(err).ToNot(HaveOccurred())
+
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://localhost:"+port, func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+				Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_denied"))
+			})
+		})
+
+		It("forwards to an allowed route service", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+		})
+	})
+
+	Context("when the request has a body", func() {
+		var requestBody string
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			requestBody = strings.Repeat("route service body ", 4096)
+
+			// Inspects the body and calls back into the router with it, the
+			// way a route service forwards the request on to the app.
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+
+				Expect(r.Method).To(Equal("POST"))
+				body, err := ioutil.ReadAll(r.Body)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(string(body)).To(Equal(requestBody))
+
+				forwardedUrl, err := url.Parse(r.Header.Get(route_service.RouteServiceForwardedUrl))
+				Expect(err).ToNot(HaveOccurred())
+
+				req, err := http.NewRequest(r.Method, "http://"+proxyServer.Addr().String()+forwardedUrl.RequestURI(), bytes.NewReader(body))
+				Expect(err).ToNot(HaveOccurred())
+				req.Host = forwardedUrl.Host
+				for _, header := range []string{route_service.RouteServiceSignature, route_service.RouteServiceMetadata, route_service.RouteServiceForwardedUrl} {
+					req.Header.Set(header, r.Header.Get(header))
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				w.WriteHeader(res.StatusCode)
+				io.Copy(w, res.Body)
+			})
+		})
+
+		It("passes the method and the full body through the route service to the backend", func() {
+			received := make(chan string, 1)
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				req, body := conn.ReadRequest()
+				Expect(req.Method).To(Equal("POST"))
+				received <- body
+
+				conn.WriteResponse(test_util.NewResponse(http.StatusCreated))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("POST", "my_host.com", "/upload", strings.NewReader(requestBody))
+			req.ContentLength = int64(len(requestBody))
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusCreated))
+
+			var body string
+			Eventually(received).Should(Receive(&body))
+			Expect(body).To(Equal(requestBody))
+		})
+	})
+
+	Context("trace headers", func() {
+		const (
+			traceId     = "463ac35c9f6413ad48485a3953bb6124"
+			spanId      = "a2fb4a1d1a96d312"
+			traceparent = "00-" + traceId + "-" + spanId + "-01"
+		)
+
+		var rsHeaders chan http.Header
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			rsHeaders = make(chan http.Header, 1)
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				rsHeaders <- r.Header
+				w.Write([]byte("My Special Snowflake Route Service\n"))
+			})
+		})
+
+		sendToRouteService := func(header http.Header) http.Header {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			for name, values := range header {
+				req.Header[name] = values
+			}
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var received http.Header
+			Eventually(rsHeaders).Should(Receive(&received))
+			return received
+		}
+
+		It("passes trace headers to the route service", func() {
+			received := sendToRouteService(http.Header{
+				"Traceparent":  {traceparent},
+				"X-B3-Traceid": {traceId},
+				"X-B3-Spanid":  {spanId},
+			})
+
+			Expect(received.Get("traceparent")).To(Equal(traceparent))
+			Expect(received.Get("X-B3-TraceId")).To(Equal(traceId))
+			Expect(received.Get("X-B3-SpanId")).To(Equal(spanId))
+		})
+
+		It("passes trace headers set by the route service to the backend", func() {
+			received := make(chan http.Header, 1)
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				received <- req.Header
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			req.Header.Set("traceparent", traceparent)
+			req.Header.Set("b3", traceId+"-"+spanId+"-1")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var header http.Header
+			Eventually(received).Should(Receive(&header))
+			Expect(header.Get("traceparent")).To(Equal(traceparent))
+			Expect(header.Get("b3")).To(Equal(traceId + "-" + spanId + "-1"))
+		})
+
+		Context("when tracing is enabled", func() {
+			BeforeEach(func() {
+				conf.Tracing.EnableZipkin = true
+			})
+
+			It("starts a span for the route service hop under the incoming span", func() {
+				received := sendToRouteService(http.Header{
+					"Traceparent":  {traceparent},
+					"B3":           {traceId + "-" + spanId + "-1"},
+					"X-B3-Traceid": {traceId},
+					"X-B3-Spanid":  {spanId},
+				})
+
+				newSpanId := received.Get("X-B3-SpanId")
+				Expect(newSpanId).To(MatchRegexp("^[0-9a-f]{16}$"))
+				Expect(newSpanId).NotTo(Equal(spanId))
+				Expect(received.Get("X-B3-TraceId")).To(Equal(traceId))
+				Expect(received.Get("X-B3-ParentSpanId")).To(Equal(spanId))
+
+				Expect(received.Get("b3")).To(Equal(traceId + "-" + newSpanId + "-1-" + spanId))
+				Expect(received.Get("traceparent")).To(Equal("00-" + traceId + "-" + newSpanId + "-01"))
+			})
+
+			It("starts a trace when the request has none", func() {
+				received := sendToRouteService(http.Header{})
+
+				Expect(received.Get("X-B3-TraceId")).To(MatchRegexp("^[0-9a-f]{32}$"))
+				Expect(received.Get("X-B3-SpanId")).To(MatchRegexp("^[0-9a-f]{16}$"))
+			})
+		})
+	})
+
+	Context("connection reuse", func() {
+		var remoteAddrs chan string
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			remoteAddrs = make(chan string, 2)
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				remoteAddrs <- r.RemoteAddr
+				w.Write([]byte("My Special Snowflake Route Service\n"))
+			})
+		})
+
+		It("reuses the connection to the route service for subsequent requests", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			for i := 0; i < 2; i++ {
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, body := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+			}
+
+			var first, second string
+			Eventually(remoteAddrs).Should(Receive(&first))
+			Eventually(remoteAddrs).Should(Receive(&second))
+			Expect(second).To(Equal(first))
+		})
+	})
+
+	Context("access log", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+		})
+
+		readAccessLog := func() string {
+			var payload []byte
+			Eventually(func() int {
+				accessLogFile.Read(&payload)
+				return len(payload)
+			}).ShouldNot(BeZero())
+			return string(payload)
+		}
+
+		It("records the route service host for requests sent to a route service", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(readAccessLog()).To(ContainSubstring("route_service_host:" + routeServiceListener.Addr().String()))
+		})
+
+		It("records the certificate the route service presented as unverified when validation is skipped", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil))
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(readAccessLog()).To(ContainSubstring(`route_service_cert_subject:"O=Internet Widgits Pty Ltd,ST=Some-State,C=AU" route_service_cert_sans:"" route_service_cert_verified:false`))
+		})
+
+		It("does not record a route service host for requests returning from a route service", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(readAccessLog()).NotTo(ContainSubstring("route_service_host:"))
+		})
+
+		It("does not record a route service host for routes without a route service", func() {
+			ln := registerHandler(r, "test/my_path", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(readAccessLog()).NotTo(ContainSubstring("route_service_host:"))
+		})
+
+		Context("in the JSON format", func() {
+			type jsonRecord struct {
+				Host         string `json:"host"`
+				StatusCode   int    `json:"status_code"`
+				RouteService struct {
+					Traversed       bool     `json:"traversed"`
+					Host            string   `json:"host"`
+					Latency         *float64 `json:"latency"`
+					ValidationError string   `json:"validation_error"`
+				} `json:"route_service"`
+			}
+
+			BeforeEach(func() {
+				conf.AccessLogFormat = "json"
+			})
+
+			readJSONRecord := func() jsonRecord {
+				var record jsonRecord
+				Expect(json.Unmarshal([]byte(readAccessLog()), &record)).To(Succeed())
+				return record
+			}
+
+			It("records the route service host and latency for requests sent to a route service", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				record := readJSONRecord()
+				Expect(record.Host).To(Equal("my_host.com"))
+				Expect(record.StatusCode).To(Equal(http.StatusOK))
+				Expect(record.RouteService.Traversed).To(BeFalse())
+				Expect(record.RouteService.Host).To(Equal(routeServiceListener.Addr().String()))
+				Expect(record.RouteService.Latency).NotTo(BeNil())
+				Expect(*record.RouteService.Latency).To(BeNumerically(">", 0))
+				Expect(record.RouteService.ValidationError).To(BeEmpty())
+			})
+
+			It("records that a request with a valid signature traversed the route service", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				record := readJSONRecord()
+				Expect(record.RouteService.Traversed).To(BeTrue())
+				Expect(record.RouteService.Host).To(BeEmpty())
+				Expect(record.RouteService.Latency).To(BeNil())
+				Expect(record.RouteService.ValidationError).To(BeEmpty())
+			})
+
+			It("records why the signature of a returning request was rejected", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+
+				record := readJSONRecord()
+				Expect(record.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(record.RouteService.Traversed).To(BeFalse())
+				Expect(record.RouteService.ValidationError).To(Equal(route_service.RouteServiceForwardedUrlMismatch.Error()))
+			})
+		})
+	})
+
+	Context("with a proxy configured for route service connections", func() {
+		var (
+			proxyListener net.Listener
+			tunnels       chan string
+		)
+
+		BeforeEach(func() {
+			var err error
+			proxyListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			tunnels = make(chan string, 10)
+			go http.Serve(proxyListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "CONNECT" {
+					w.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				tunnels <- r.Host
+
+				upstream, err := net.Dial("tcp", r.Host)
+				if err != nil {
+					w.WriteHeader(http.StatusBadGateway)
+					return
+				}
+				conn, _, err := w.(http.Hijacker).Hijack()
+				if err != nil {
+					upstream.Close()
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go func() {
+					io.Copy(upstream, conn)
+					upstream.Close()
+				}()
+				io.Copy(conn, upstream)
+				conn.Close()
+			}))
+
+			conf.SSLSkipValidation = true
+			conf.RouteServiceProxyUrl = &url.URL{Scheme: "http", Host: proxyListener.Addr().String()}
+		})
+
+		AfterEach(func() {
+			proxyListener.Close()
+		})
+
+		It("tunnels the route service request through the proxy", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+
+			var tunnelled string
+			Expect(tunnels).To(Receive(&tunnelled))
+			Expect(tunnelled).To(Equal(routeServiceListener.Addr().String()))
+		})
+
+		It("sends requests returning from the route service to the backend directly", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(tunnels).NotTo(Receive())
+		})
+	})
+
+	Context("with a TLS server name configured for the route service", func() {
+		var serverListener net.Listener
+
+		BeforeEach(func() {
+			cert, pool := newCertificate("rs.internal")
+			rootCAs = pool
+
+			var err error
+			serverListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			tlsListener := tls.NewListener(serverListener, &tls.Config{Certificates: []tls.Certificate{cert}})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("My Special Snowflake Route Service\n"))
+			})}
+			go server.Serve(tlsListener)
+		})
+
+		AfterEach(func() {
+			serverListener.Close()
+		})
+
+		Context("when the server name matches the certificate", func() {
+			BeforeEach(func() {
+				conf.RouteServiceServerNames = map[string]string{"127.0.0.1": "rs.internal"}
+			})
+
+			It("presents it in the handshake while connecting to the registered address", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+serverListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, body := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+			})
+
+			It("records the verified certificate in the access log", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+serverListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				var payload []byte
+				Eventually(func() int {
+					accessLogFile.Read(&payload)
+					return len(payload)
+				}).ShouldNot(BeZero())
+				Expect(string(payload)).To(ContainSubstring(`route_service_cert_subject:"CN=rs.internal" route_service_cert_sans:"rs.internal" route_service_cert_verified:true`))
+			})
+		})
+
+		Context("when no server name is configured for the host", func() {
+			BeforeEach(func() {
+				conf.RouteServiceServerNames = map[string]string{"10.0.0.5": "rs.internal"}
+			})
+
+			It("fails to verify the certificate against the registered address", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+serverListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			})
+		})
+	})
+
+	Context("with ssl validation skipped for a route's route service", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = false
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("verifies the certificate of the route services of other routes only", func() {
+			strict := registerHandlerWithRouteService(r, "strict.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer strict.Close()
+
+			legacy, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer legacy.Close()
+			_, port, err := net.SplitHostPort(legacy.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			portNum, err := strconv.Atoi(port)
+			Expect(err).NotTo(HaveOccurred())
+			endpoint := route.NewEndpoint("", "127.0.0.1", uint16(portNum), "", nil, -1, routeService.Url())
+			endpoint.RouteServiceSkipSslValidation = true
+			r.Register(route.Uri("legacy.com"), endpoint)
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "strict.com", "/", nil))
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+
+			conn = dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "legacy.com", "/", nil))
+			res, _ = conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(routeService.Requests()).To(HaveLen(1))
+		})
+	})
+
+	Context("when the route service requires a client certificate", func() {
+		var (
+			serverListener net.Listener
+			clientCert     tls.Certificate
+		)
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+
+			var clientCAs *x509.CertPool
+			clientCert, clientCAs = newCertificate("router")
+
+			serverCert, err := tls.LoadX509KeyPair("../test/assets/public.pem", "../test/assets/private.pem")
+			Expect(err).NotTo(HaveOccurred())
+
+			serverListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			tlsListener := tls.NewListener(serverListener, &tls.Config{
+				Certificates: []tls.Certificate{serverCert},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    clientCAs,
+			})
+			server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("Hello " + r.TLS.PeerCertificates[0].Subject.CommonName))
+			})}
+			go server.Serve(tlsListener)
+		})
+
+		AfterEach(func() {
+			serverListener.Close()
+		})
+
+		sendRequest := func() (*http.Response, string) {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+serverListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			return conn.ReadResponse()
+		}
+
+		Context("when a default client certificate is configured", func() {
+			BeforeEach(func() {
+				conf.RouteServiceClientCertificates = map[string]tls.Certificate{"": clientCert}
+			})
+
+			It("presents it to the route service", func() {
+				res, body := sendRequest()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(Equal("Hello router"))
+			})
+		})
+
+		Context("when a client certificate is configured for the route service host", func() {
+			BeforeEach(func() {
+				otherCert, _ := newCertificate("other")
+				conf.RouteServiceClientCertificates = map[string]tls.Certificate{
+					"":          otherCert,
+					"127.0.0.1": clientCert,
+				}
+			})
+
+			It("presents it instead of the default", func() {
+				res, body := sendRequest()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(Equal("Hello router"))
+			})
+		})
+
+		Context("when no client certificate is configured", func() {
+			It("fails the handshake", func() {
+				res, _ := sendRequest()
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			})
+		})
+	})
+
+	Context("CloseIdleConnections", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+		})
+
+		It("closes idle route service connections and reconnects for later requests", func() {
+			server, states := newConnStateServer()
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer ln.Close()
+			go server.Serve(newTlsListener(ln))
+
+			backend := registerHandlerWithRouteService(r, "my_host.com", "https://"+ln.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer backend.Close()
+
+			sendRequest := func() {
+				conn := dialProxy(proxyServer)
+				conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			}
+
+			sendRequest()
+			Eventually(states).Should(Receive(Equal(http.StateIdle)))
+
+			p.CloseIdleConnections()
+			p.CloseIdleConnections()
+			Eventually(states).Should(Receive(Equal(http.StateClosed)))
+
+			sendRequest()
+			Eventually(states).Should(Receive(Equal(http.StateNew)))
+		})
+	})
+
+	Context("when the route service is temporarily unavailable", func() {
+		var (
+			routeService *test_util.RouteService
+			calls        int32
+		)
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceRetries = 2
+			atomic.StoreInt32(&calls, 0)
+
+			routeService = test_util.NewRouteService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&calls, 1)
+				w.Header().Set("Retry-After", "120")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write([]byte("degraded"))
+			}))
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("relays its 503 and Retry-After to the client unchanged", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(res.Header.Get("Retry-After")).To(Equal("120"))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(BeEmpty())
+			Expect(body).To(Equal("degraded"))
+			Expect(atomic.LoadInt32(&calls)).To(Equal(int32(1)))
+		})
+	})
+
+	Context("with a dial timeout shorter than the endpoint timeout", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceRetries = 0
+			conf.RouteServiceDialTimeout = 200 * time.Millisecond
+			conf.EndpointTimeout = 2 * time.Second
+
+			routeService = test_util.NewRouteService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(3 * time.Second)
+			}))
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("fails within the dial timeout for an unreachable route service", func() {
+			// TEST-NET-1, which nothing answers on.
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://192.0.2.1", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+			startedAt := time.Now()
+			res, _ := conn.ReadResponse()
+			Expect(time.Since(startedAt)).To(BeNumerically("<", time.Second))
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+		})
+
+		It("bounds a slow route service by the endpoint timeout", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+			startedAt := time.Now()
+			res, _ := conn.ReadResponse()
+			Expect(time.Since(startedAt)).To(BeNumerically(">=", conf.EndpointTimeout))
+			Expect(time.Since(startedAt)).To(BeNumerically("<", 3*time.Second))
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+		})
+	})
+
+	Context("with a limit on requests in flight to route services", func() {
+		var (
+			routeService *test_util.RouteService
+			received     chan bool
+			release      chan bool
+		)
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceMaxInFlight = 1
+
+			received = make(chan bool, 2)
+			release = make(chan bool)
+			routeService = test_util.NewRouteService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received <- true
+				<-release
+				w.WriteHeader(http.StatusOK)
+			}))
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		sendRequest := func() *http.Response {
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		It("fails requests beyond the limit at once with a 503", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			first := make(chan *http.Response, 1)
+			go func() {
+				defer GinkgoRecover()
+				first <- sendRequest()
+			}()
+			Eventually(received).Should(Receive())
+
+			overflow := make(chan *http.Response, 1)
+			go func() {
+				defer GinkgoRecover()
+				overflow <- sendRequest()
+			}()
+
+			var res *http.Response
+			Eventually(overflow, time.Second).Should(Receive(&res))
+			Expect(res.StatusCode).To(Equal(http.StatusServiceUnavailable))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal(proxy.RouteServiceOverloaded))
+			Expect(received).NotTo(Receive())
+
+			close(release)
+			Eventually(first).Should(Receive(&res))
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(sendRequest().StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("with a default route service", func() {
+		var defaultRouteService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			defaultRouteService = test_util.NewRouteService(nil)
+			conf.DefaultRouteServiceUrl = defaultRouteService.Url()
+		})
+
+		AfterEach(func() {
+			defaultRouteService.Close()
+		})
+
+		It("sends requests for routes without a route service to it", func() {
+			ln := registerHandler(r, "my_host.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(defaultRouteService.Requests()).To(HaveLen(1))
+			Expect(defaultRouteService.Requests()[0].ForwardedUrl).To(Equal("http://my_host.com/"))
+		})
+
+		It("sends requests for routes with a route service to their own", func() {
+			routeService := test_util.NewRouteService(nil)
+			defer routeService.Close()
+
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(routeService.Requests()).To(HaveLen(1))
+			Expect(defaultRouteService.Requests()).To(BeEmpty())
+		})
+
+		It("does not send requests for route services registered with the router to it", func() {
+			ln := registerRouteServiceInstance(r, "my_route_service.com", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			conn.WriteRequest(test_util.NewRequest("GET", "my_route_service.com", "/", nil))
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(defaultRouteService.Requests()).To(BeEmpty())
+		})
+
+		Context("when route services are disabled", func() {
+			BeforeEach(func() {
+				conf.RouteServiceEnabled = false
+			})
+
+			It("is ignored", func() {
+				ln := registerHandler(r, "my_host.com", func(conn *test_util.HttpConn) {
+					conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				conn.WriteRequest(test_util.NewRequest("GET", "my_host.com", "/", nil))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(defaultRouteService.Requests()).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the route service responds with an error status", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		for _, code := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusTooManyRequests} {
+			code := code
+
+			It(fmt.Sprintf("relays a %d to the client verbatim", code), func() {
+				routeService.SetHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Type", "application/json")
+					w.Header().Set("X-Policy", "deny-all")
+					w.WriteHeader(code)
+					w.Write([]byte(`{"error":"denied by policy"}`))
+				}))
+
+				ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, body := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(code))
+				Expect(res.Header.Get("Content-Type")).To(Equal("application/json"))
+				Expect(res.Header.Get("X-Policy")).To(Equal("deny-all"))
+				Expect(res.Header.Get("X-Cf-RouterError")).To(BeEmpty())
+				Expect(body).To(Equal(`{"error":"denied by policy"}`))
+
+				Expect(routeService.Requests()).To(HaveLen(1))
+				received := routeService.Requests()[0]
+				Expect(received.ForwardedUrl).To(Equal("http://my_host.com/"))
+
+				crypto, err := secure.NewAesGCM([]byte(cryptoKey))
+				Expect(err).ToNot(HaveOccurred())
+				signature, err := route_service.SignatureFromHeaders(received.Signature, received.Metadata, crypto)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signature.ForwardedUrl).To(Equal(received.ForwardedUrl))
+			})
+		}
+	})
+
+	Context("with canonical forwarded urls", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceCanonicalForwardedUrls = true
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("signs and sends the canonical form of the request url", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			req := test_util.NewRequest("GET", "My_Host.com:80", "/%7euser/caf%c3%a9?q=%2f", nil)
+			req.RequestURI = "/%7euser/caf%c3%a9?q=%2f"
+			req.RemoteAddr = "127.0.0.1:12345"
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			Expect(routeService.Requests()).To(HaveLen(1))
+			received := routeService.Requests()[0]
+			Expect(received.ForwardedUrl).To(Equal("http://my_host.com/~user/caf%C3%A9?q=%2F"))
+
+			signature, err := route_service.SignatureFromHeaders(received.Signature, received.Metadata, crypto)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(signature.ForwardedUrl).To(Equal(received.ForwardedUrl))
+		})
+	})
+
+	Context("with path extensions allowed", func() {
+		var signature, metadata string
+
+		BeforeEach(func() {
+			conf.RouteServiceAllowPathExtensions = true
+
+			var err error
+			signature, metadata, err = route_service.BuildSignatureAndMetadata(crypto, &route_service.Signature{
+				RequestedTime: time.Now(),
+				ForwardedUrl:  "http://my_host.com/login",
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		sendReturning := func(path, forwardedUrl string) *http.Response {
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", path, nil)
+			req.Header.Set(route_service.RouteServiceSignature, signature)
+			req.Header.Set(route_service.RouteServiceMetadata, metadata)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		It("forwards a request with a path appended by the route service to the backend", func() {
+			paths := make(chan string, 1)
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				paths <- req.URL.Path
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			res := sendReturning("/login/callback", "http://my_host.com/login/callback")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(paths).To(Receive(Equal("/login/callback")))
+		})
+
+		It("still rejects a forwarded url for another host", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			res := sendReturning("/login/callback", "http://my_host.com.evil.com/login/callback")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("with paths that may omit the forwarded url", func() {
+		BeforeEach(func() {
+			conf.RouteServiceForwardedUrlOptionalPaths = []string{"/health"}
+		})
+
+		sendWithoutForwardedUrl := func(path, signedUrl string) *http.Response {
+			signature, metadata, err := route_service.BuildSignatureAndMetadata(crypto, &route_service.Signature{
+				RequestedTime: time.Now(),
+				ForwardedUrl:  signedUrl,
+			})
+			Expect(err).NotTo(HaveOccurred())
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", path, nil)
+			req.Header.Set(route_service.RouteServiceSignature, signature)
+			req.Header.Set(route_service.RouteServiceMetadata, metadata)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		It("validates a request for a configured path against its own url", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			res := sendWithoutForwardedUrl("/health", "http://my_host.com/health")
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("still rejects a signature minted for another url", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			res := sendWithoutForwardedUrl("/health", "http://my_host.com/admin")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
+		It("still requires the forwarded url for other paths", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			res := sendWithoutForwardedUrl("/admin", "http://my_host.com/admin")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("forwarded url scheme", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		forwardedUrlFor := func(overTLS bool, forwardedProto string) string {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource", nil)
+			req.RequestURI = "/resource"
+			req.RemoteAddr = "127.0.0.1:12345"
+			if overTLS {
+				req.TLS = &tls.ConnectionState{}
+			}
+			if forwardedProto != "" {
+				req.Header.Set("X-Forwarded-Proto", forwardedProto)
+			}
+
+			w := httptest.NewRecorder()
+			p.ServeHTTP(w, req)
+			Expect(w.Code).To(Equal(http.StatusOK))
+
+			requests := routeService.Requests()
+			Expect(requests).NotTo(BeEmpty())
+			return requests[len(requests)-1].ForwardedUrl
+		}
+
+		It("is http by default, even for clients connected over TLS", func() {
+			Expect(forwardedUrlFor(true, "https")).To(Equal("http://my_host.com/resource"))
+		})
+
+		Context("when the client scheme is used", func() {
+			BeforeEach(func() {
+				conf.RouteServiceForwardedUrlClientScheme = true
+			})
+
+			It("is https for clients connected over TLS", func() {
+				Expect(forwardedUrlFor(true, "")).To(Equal("https://my_host.com/resource"))
+			})
+
+			It("is http for clients connected without TLS", func() {
+				Expect(forwardedUrlFor(false, "")).To(Equal("http://my_host.com/resource"))
+			})
+
+			It("ignores X-Forwarded-Proto", func() {
+				Expect(forwardedUrlFor(false, "https")).To(Equal("http://my_host.com/resource"))
+			})
+
+			Context("when X-Forwarded-Proto is trusted", func() {
+				BeforeEach(func() {
+					conf.RouteServiceTrustForwardedProto = true
+				})
+
+				It("takes the scheme from X-Forwarded-Proto", func() {
+					Expect(forwardedUrlFor(false, "https")).To(Equal("https://my_host.com/resource"))
+					Expect(forwardedUrlFor(true, "http")).To(Equal("http://my_host.com/resource"))
+				})
+
+				It("falls back to the connection without a valid X-Forwarded-Proto", func() {
+					Expect(forwardedUrlFor(true, "gopher")).To(Equal("https://my_host.com/resource"))
+				})
+			})
+		})
+	})
+
+	Context("when gzip content types are configured", func() {
+		var (
+			routeService *test_util.RouteService
+			body         = strings.Repeat("compress me ", 100)
+		)
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.GzipContentTypes = []string{"text/html"}
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		sendThroughRouteService := func(handler http.HandlerFunc) (*http.Response, string) {
+			routeService.SetHandler(handler)
+
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			req.Header.Set("Accept-Encoding", "gzip")
+			conn.WriteRequest(req)
+
+			return conn.ReadResponse()
+		}
+
+		It("gzips a compressible response returned by the route service", func() {
+			res, resBody := sendThroughRouteService(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(body))
+			})
+
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(gunzip(resBody)).To(Equal(body))
+
+			Expect(routeService.Requests()).To(HaveLen(1))
+			Expect(routeService.Requests()[0].Header.Get("Accept-Encoding")).To(Equal("gzip"))
+		})
+
+		It("does not gzip a response the route service already compressed", func() {
+			res, resBody := sendThroughRouteService(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Write([]byte(gzipString(body)))
+			})
+
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Encoding")).To(Equal("gzip"))
+			Expect(gunzip(resBody)).To(Equal(body))
+		})
+	})
+
+	Context("when the request carries hop-by-hop headers", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceHopByHopHeaders = []string{"X-Per-Hop"}
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("strips them before the request reaches the route service", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			req.Header.Set("Connection", "X-Custom")
+			req.Header.Set("X-Custom", "value")
+			req.Header.Set("X-Per-Hop", "value")
+			req.Header.Set("X-Other", "other")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(routeService.Requests()).To(HaveLen(1))
+			received := routeService.Requests()[0]
+			Expect(received.Header.Get("X-Custom")).To(BeEmpty())
+			Expect(received.Header.Get("X-Per-Hop")).To(BeEmpty())
+			Expect(received.Header.Get("X-Other")).To(Equal("other"))
+			Expect(received.ForwardedUrl).To(Equal("http://my_host.com/"))
+		})
+	})
+
+	Context("when the route service answers the request itself", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(router_http.CfRouteServiceHandledHeader, "true")
+				w.Write([]byte("Down for maintenance\n"))
+			})
+		})
+
+		It("returns its response without calling the backend", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("Down for maintenance"))
+			Expect(res.Header.Get(router_http.CfRouteServiceHandledHeader)).To(BeEmpty())
+		})
+	})
+
+	Context("when the route service sends the request back to the backend", func() {
+		var routeServiceRequestIds chan string
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeServiceRequestIds = make(chan string, 1)
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				routeServiceRequestIds <- r.Header.Get(router_http.VcapRequestIdHeader)
+
+				req, err := http.NewRequest("GET", "http://"+proxyServer.Addr().String()+"/", nil)
+				Expect(err).ToNot(HaveOccurred())
+				req.Host = "my_host.com"
+				for _, h := range []string{route_service.RouteServiceSignature, route_service.RouteServiceMetadata, route_service.RouteServiceForwardedUrl, router_http.VcapRequestIdHeader} {
+					req.Header.Set(h, r.Header.Get(h))
+				}
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				w.WriteHeader(res.StatusCode)
+				io.Copy(w, res.Body)
+			})
+		})
+
+		It("relays the backend response", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				resp := test_util.NewResponse(http.StatusOK)
+				resp.Body = ioutil.NopCloser(strings.NewReader("Hello from the backend"))
+				conn.WriteResponse(resp)
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("Hello from the backend"))
+		})
+
+		Context("when the backend drops the first connection", func() {
+			var attempts int32
+
+			registerFlakyBackend := func() net.Listener {
+				atomic.StoreInt32(&attempts, 0)
+				return registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					conn.ReadRequest()
+					if atomic.AddInt32(&attempts, 1) == 1 {
+						conn.Close()
+						return
+					}
+					resp := test_util.NewResponse(http.StatusOK)
+					resp.Body = ioutil.NopCloser(strings.NewReader("Hello from the backend"))
+					conn.WriteResponse(resp)
+					conn.Close()
+				})
+			}
+
+			It("retries the backend without going back to the route service", func() {
+				ln := registerFlakyBackend()
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, body := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring("Hello from the backend"))
+				Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(2)))
+
+				Expect(routeServiceRequestIds).To(Receive())
+				Consistently(routeServiceRequestIds).ShouldNot(Receive())
+			})
+
+			Context("when backend retries are disabled", func() {
+				BeforeEach(func() {
+					conf.RouteServiceBackendRetries = 0
+				})
+
+				It("fails the request", func() {
+					ln := registerFlakyBackend()
+					defer ln.Close()
+
+					conn := dialProxy(proxyServer)
+
+					req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+					conn.WriteRequest(req)
+
+					res, _ := conn.ReadResponse()
+					Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+					Expect(atomic.LoadInt32(&attempts)).To(Equal(int32(1)))
+				})
+			})
+		})
+
+		It("uses the same request id on both legs", func() {
+			backendRequestIds := make(chan string, 1)
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				backendRequestIds <- req.Header.Get(router_http.VcapRequestIdHeader)
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			req.Header.Set(router_http.VcapRequestIdHeader, "client-chosen-id")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var routeServiceRequestId, backendRequestId string
+			Eventually(routeServiceRequestIds).Should(Receive(&routeServiceRequestId))
+			Eventually(backendRequestIds).Should(Receive(&backendRequestId))
+			Expect(routeServiceRequestId).To(MatchRegexp(uuid_regex))
+			Expect(backendRequestId).To(Equal(routeServiceRequestId))
+
+			Eventually(func() string {
+				var payload []byte
+				accessLogFile.Read(&payload)
+				return string(payload)
+			}).Should(ContainSubstring(`vcap_request_id:` + routeServiceRequestId))
+		})
+
+		Context("when validation is not enforced", func() {
+			BeforeEach(func() {
+				conf.RouteServiceEnforce = false
+			})
+
+			It("gives requests returning with an invalid signature a fresh request id", func() {
+				backendRequestIds := make(chan string, 1)
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					req, _ := conn.ReadRequest()
+					backendRequestIds <- req.Header.Get(router_http.VcapRequestIdHeader)
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				req.Header.Set(route_service.RouteServiceSignature, "invalid")
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, "http://my_host.com/")
+				req.Header.Set(router_http.VcapRequestIdHeader, "client-chosen-id")
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				var backendRequestId string
+				Eventually(backendRequestIds).Should(Receive(&backendRequestId))
+				Expect(backendRequestId).To(MatchRegexp(uuid_regex))
+				Expect(routeServiceRequestIds).ToNot(Receive())
+			})
+		})
+	})
+
+	Context("with signatures bound to the app", func() {
+		var appRouteServiceConfig *route_service.RouteServiceConfig
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceBindAppGuid = true
+
+			crypto, err := secure.NewAesGCM([]byte(cryptoKey))
+			Expect(err).ToNot(HaveOccurred())
+			appRouteServiceConfig, err = route_service.NewRouteServiceConfig(true, time.Hour, crypto, nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		registerApp := func(path, appGuid string) net.Listener {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			go runBackendInstance(ln, func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+
+			host, portStr, err := net.SplitHostPort(ln.Addr().String())
+			Expect(err).NotTo(HaveOccurred())
+			port, err := strconv.Atoi(portStr)
+			Expect(err).NotTo(HaveOccurred())
+
+			r.Register(route.Uri(path), route.NewEndpoint(appGuid, host, uint16(port), "", nil, -1, "https://"+routeServiceListener.Addr().String()))
+			return ln
+		}
+
+		sendSignedFor := func(host, appGuid string) *http.Response {
+			forwardedUrl := "http://" + host + "/"
+			signatureHeader, metadataHeader, err := appRouteServiceConfig.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, AppGuid: appGuid})
+			Expect(err).ToNot(HaveOccurred())
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", host, "/", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		It("forwards a request signed for the app of the route", func() {
+			ln := registerApp("app-b.com", "app-b")
+			defer ln.Close()
+
+			Expect(sendSignedFor("app-b.com", "app-b").StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("rejects a signature minted for another app", func() {
+			ln := registerApp("app-b.com", "app-b")
+			defer ln.Close()
+
+			Expect(sendSignedFor("app-b.com", "app-a").StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("when an https route service does not speak TLS", func() {
+		var plainListener net.Listener
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+
+			var err error
+			plainListener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+
+			go http.Serve(plainListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("plain http"))
+			}))
+		})
+
+		AfterEach(func() {
+			plainListener.Close()
+		})
+
+		It("returns a 502 saying so, without waiting for a timeout", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+plainListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			startedAt := time.Now()
+			res, body := conn.ReadResponse()
+			Expect(time.Since(startedAt)).To(BeNumerically("<", time.Second))
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_not_tls"))
+			Expect(body).To(ContainSubstring("Route service did not respond with TLS."))
+		})
+	})
+
+	Context("when the route service sends back something that is not HTTP", func() {
+		var garbageListener net.Listener
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			garbageListener = newTlsListener(ln)
+
+			go func() {
+				for {
+					conn, err := garbageListener.Accept()
+					if err != nil {
+						return
+					}
+					go func() {
+						defer conn.Close()
+						http.ReadRequest(bufio.NewReader(conn))
+						conn.Write([]byte("not an http response\r\n\r\n"))
+					}()
+				}
+			}()
+		})
+
+		AfterEach(func() {
+			garbageListener.Close()
+		})
+
+		It("returns a 502 saying so", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+garbageListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_bad_response"))
+			Expect(body).To(ContainSubstring("Route service sent an invalid response."))
+			Expect(body).ToNot(ContainSubstring("not an http response"))
+		})
+	})
+
+	Context("minimum TLS version", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+		})
+
+		Context("when the route service only offers TLS 1.0", func() {
+			var oldListener net.Listener
+
+			BeforeEach(func() {
+				cert, _ := newCertificate("rs.internal")
+
+				var err error
+				oldListener, err = net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).NotTo(HaveOccurred())
+
+				tlsListener := tls.NewListener(oldListener, &tls.Config{
+					Certificates: []tls.Certificate{cert},
+					MinVersion:   tls.VersionTLS10,
+					MaxVersion:   tls.VersionTLS10,
+				})
+				go http.Serve(tlsListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Fail("Should not get here")
+				}))
+			})
+
+			AfterEach(func() {
+				oldListener.Close()
+			})
+
+			It("refuses to connect with the default minimum of TLS 1.2", func() {
+				Expect(conf.RouteServiceMinTLSVersion).To(Equal(uint16(tls.VersionTLS12)))
+
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+oldListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			})
+		})
+
+		Context("when TLS 1.3 is required", func() {
+			BeforeEach(func() {
+				conf.RouteServiceMinTLSVersion = tls.VersionTLS13
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.TLS.Version).To(Equal(uint16(tls.VersionTLS13)))
+					w.Write([]byte("My Special Snowflake Route Service\n"))
+				})
+			})
+
+			It("connects to route services offering it", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				conn.WriteRequest(req)
+
+				res, body := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+			})
+
+			Context("when the route service only offers up to TLS 1.2", func() {
+				var tls12Listener net.Listener
+
+				BeforeEach(func() {
+					// A TLS 1.2 cipher suite both sides support, so that only the
+					// minimum version can fail the handshake.
+					conf.CipherSuites = []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}
+					cert, _ := newCertificate("rs.internal")
+
+					var err error
+					tls12Listener, err = net.Listen("tcp", "127.0.0.1:0")
+					Expect(err).NotTo(HaveOccurred())
+
+					tlsListener := tls.NewListener(tls12Listener, &tls.Config{
+						Certificates: []tls.Certificate{cert},
+						CipherSuites: conf.CipherSuites,
+						MaxVersion:   tls.VersionTLS12,
+					})
+					go http.Serve(tlsListener, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						w.Write([]byte("TLS 1.2 Route Service\n"))
+					}))
+				})
+
+				AfterEach(func() {
+					tls12Listener.Close()
+				})
+
+				It("refuses to connect", func() {
+					ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+tls12Listener.Addr().String(), func(conn *test_util.HttpConn) {
+						Fail("Should not get here")
+					})
+					defer ln.Close()
+
+					conn := dialProxy(proxyServer)
+
+					req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+					conn.WriteRequest(req)
+
+					res, _ := conn.ReadResponse()
+					Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+				})
+			})
+		})
+	})
+
+	Context("with a cap on route service response size", func() {
+		var (
+			responseBody string
+			ln           net.Listener
+		)
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceMaxResponseBytes = 1024
+		})
+
+		JustBeforeEach(func() {
+			ln = registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+		})
+
+		AfterEach(func() {
+			ln.Close()
+		})
+
+		sendRequest := func() *test_util.HttpConn {
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+			return conn
+		}
+
+		Context("when the route service declares a longer body", func() {
+			BeforeEach(func() {
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Header().Set("Content-Length", "4096")
+					w.Write(bytes.Repeat([]byte("a"), 4096))
+				})
+			})
+
+			It("returns a 502 saying so", func() {
+				res, body := sendRequest().ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+				Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_response_too_large"))
+				Expect(body).To(ContainSubstring("Route service response is too large."))
+			})
+		})
+
+		Context("when the route service streams past the limit", func() {
+			BeforeEach(func() {
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					for i := 0; i < 8; i++ {
+						w.Write(bytes.Repeat([]byte("a"), 512))
+						w.(http.Flusher).Flush()
+					}
+				})
+			})
+
+			It("cuts the response off", func() {
+				conn := sendRequest()
+
+				res, err := http.ReadResponse(conn.Reader, &http.Request{})
+				Expect(err).ToNot(HaveOccurred())
+
+				body, err := ioutil.ReadAll(res.Body)
+				Expect(err).To(HaveOccurred())
+				Expect(len(body)).To(BeNumerically("<=", 1024))
+			})
+		})
+
+		Context("when the route service body is within the limit", func() {
+			BeforeEach(func() {
+				responseBody = strings.Repeat("a", 1024)
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(responseBody))
+				})
+			})
+
+			It("relays it", func() {
+				res, body := sendRequest().ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(body).To(Equal(responseBody))
+			})
+		})
+	})
+
+	Context("HEAD requests", func() {
+		var methods chan string
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			methods = make(chan string, 2)
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				methods <- r.Method
+				Expect(r.Header.Get(route_service.RouteServiceForwardedUrl)).To(Equal("http://my_host.com/resource"))
+				w.Header().Set("Content-Length", "4096")
+				w.Header().Set("X-Route-Service", "seen")
+			})
+		})
+
+		sendHead := func(conn *test_util.HttpConn) *http.Response {
+			req := test_util.NewRequest("HEAD", "my_host.com", "/resource", nil)
+			conn.WriteRequest(req)
+
+			res, err := http.ReadResponse(conn.Reader, req)
+			Expect(err).ToNot(HaveOccurred())
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(BeEmpty())
+			return res
+		}
+
+		It("sends a HEAD to the route service and relays its headers without a body", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			res := sendHead(conn)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.ContentLength).To(Equal(int64(4096)))
+			Expect(res.Header.Get("X-Route-Service")).To(Equal("seen"))
+			Expect(methods).To(Receive(Equal("HEAD")))
+
+			// No body was written, so the connection is ready for the next
+			// response.
+			res = sendHead(conn)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(methods).To(Receive(Equal("HEAD")))
+		})
+
+		It("sends a HEAD back to the backend", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				Expect(req.Method).To(Equal("HEAD"))
+
+				conn.WriteLines([]string{
+					"HTTP/1.1 200 OK",
+					"Content-Length: 12",
+				})
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("HEAD", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, err := http.ReadResponse(conn.Reader, req)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.ContentLength).To(Equal(int64(12)))
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(BeEmpty())
+		})
+
+		Context("with a cap on route service response size", func() {
+			BeforeEach(func() {
+				conf.RouteServiceMaxResponseBytes = 1024
+			})
+
+			It("does not count the declared length against the cap", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				res := sendHead(dialProxy(proxyServer))
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(res.ContentLength).To(Equal(int64(4096)))
+			})
+		})
+	})
+
+	Context("response framing", func() {
+		var chunked bool
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			chunked = false
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !chunked {
+					w.Header().Set("Content-Length", "11")
+					w.Write([]byte("hello world"))
+					return
+				}
+
+				w.Write([]byte("hello "))
+				w.(http.Flusher).Flush()
+				w.Write([]byte("world"))
+			})
+		})
+
+		sendRequest := func() (*http.Response, string) {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, err := http.ReadResponse(conn.Reader, req)
+			Expect(err).ToNot(HaveOccurred())
+			body, err := ioutil.ReadAll(res.Body)
+			Expect(err).ToNot(HaveOccurred())
+			res.Body.Close()
+			return res, string(body)
+		}
+
+		It("relays the Content-Length of the route service response", func() {
+			res, body := sendRequest()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.ContentLength).To(Equal(int64(11)))
+			Expect(res.TransferEncoding).To(BeEmpty())
+			Expect(body).To(Equal("hello world"))
+		})
+
+		It("relays a chunked route service response chunked", func() {
+			chunked = true
+
+			res, body := sendRequest()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.ContentLength).To(Equal(int64(-1)))
+			Expect(res.TransferEncoding).To(Equal([]string{"chunked"}))
+			Expect(body).To(Equal("hello world"))
+		})
+
+		Context("with a cap on route service response size", func() {
+			BeforeEach(func() {
+				conf.RouteServiceMaxResponseBytes = 1024
+			})
+
+			It("still relays the Content-Length", func() {
+				res, body := sendRequest()
+				Expect(res.ContentLength).To(Equal(int64(11)))
+				Expect(body).To(Equal("hello world"))
+			})
+
+			It("still relays a chunked response chunked", func() {
+				chunked = true
+
+				res, body := sendRequest()
+				Expect(res.TransferEncoding).To(Equal([]string{"chunked"}))
+				Expect(body).To(Equal("hello world"))
+			})
+		})
+	})
+
+	Context("route decision logging", func() {
+		var sink *steno.TestingSink
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			sink = steno.NewTestingSink()
+			steno.Init(&steno.Config{
+				Sinks: []steno.Sink{sink},
+				Level: steno.LOG_DEBUG,
+			})
+		})
+
+		AfterEach(func() {
+			steno.Init(&steno.Config{})
+		})
+
+		decision := func() map[string]interface{} {
+			for _, record := range sink.Records() {
+				if record.Message == "proxy.route-service.decision" {
+					return record.Data
+				}
+			}
+			return nil
+		}
+
+		It("logs that the request is sent to the route service", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(decision()).To(HaveKeyWithValue("Leg", "route-service"))
+			Expect(decision()).To(HaveKeyWithValue("Reason", "no-signature"))
+			Expect(decision()).To(HaveKeyWithValue("Host", "my_host.com"))
+		})
+
+		It("logs that the request is sent to the backend with a valid signature", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(decision()).To(HaveKeyWithValue("Leg", "backend"))
+			Expect(decision()).To(HaveKeyWithValue("Reason", "signature-valid"))
+		})
+	})
+
+	Context("validation failure logging", func() {
+		var (
+			sink         *steno.TestingSink
+			metricSender *fake_metric_sender.FakeMetricSender
+		)
+
+		BeforeEach(func() {
+			conf.RouteServiceValidationFailureLogSampleRate = 3
+			sink = steno.NewTestingSink()
+			steno.Init(&steno.Config{
+				Sinks: []steno.Sink{sink},
+				Level: steno.LOG_DEBUG,
+			})
+		})
+
+		JustBeforeEach(func() {
+			metricSender = fake_metric_sender.NewFakeMetricSender()
+			metrics.Initialize(metricSender)
+		})
+
+		AfterEach(func() {
+			steno.Init(&steno.Config{})
+		})
+
+		logged := func(message string) int {
+			count := 0
+			for _, record := range sink.Records() {
+				if record.Message == message {
+					count++
+				}
+			}
+			return count
+		}
+
+		It("logs one in every sample rate failures and counts all of them", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			for i := 0; i < 7; i++ {
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			}
+
+			Expect(logged("proxy.signature.validation.failed")).To(Equal(3))
+			Expect(metricSender.GetCounter("route_services.validation_failures")).To(Equal(uint64(7)))
+		})
+
+		It("samples requests with metadata but no signature alike", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			for i := 0; i < 4; i++ {
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			}
+
+			Expect(logged("proxy.signature.validation.missing")).To(Equal(2))
+			Expect(metricSender.GetCounter("route_services.validation_failures")).To(Equal(uint64(4)))
+		})
+
+		Context("when validation is not enforced", func() {
+			BeforeEach(func() {
+				conf.RouteServiceEnforce = false
+			})
+
+			It("samples the not enforced failure log", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+					conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+				})
+				defer ln.Close()
+
+				for i := 0; i < 4; i++ {
+					conn := dialProxy(proxyServer)
+
+					req := test_util.NewRequest("GET", "test", "/my_path", nil)
+					req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+					req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+					req.Header.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+					conn.WriteRequest(req)
+
+					res, _ := conn.ReadResponse()
+					Expect(res.StatusCode).To(Equal(http.StatusOK))
+				}
+
+				Expect(logged("proxy.signature.validation.not-enforced")).To(Equal(2))
+				Expect(metricSender.GetCounter("route_services.validation_failures")).To(Equal(uint64(4)))
+				Expect(metricSender.GetCounter("route_services.validation_failures_not_enforced")).To(Equal(uint64(4)))
+			})
+		})
+	})
+
+	Context("when enforcement is toggled at runtime", func() {
+		It("rejects or lets through the requests that follow accordingly", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			sendMismatched := func() int {
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				return res.StatusCode
+			}
+
+			Expect(p.RouteServiceEnforce()).To(BeTrue())
+			Expect(sendMismatched()).To(Equal(http.StatusBadRequest))
+
+			p.SetRouteServiceEnforce(false)
+			Expect(p.RouteServiceEnforce()).To(BeFalse())
+			Expect(sendMismatched()).To(Equal(http.StatusOK))
+
+			p.SetRouteServiceEnforce(true)
+			Expect(sendMismatched()).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("route service latency", func() {
+		var latencies *routeServiceLatencyReporter
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			latencies = &routeServiceLatencyReporter{hosts: make(chan string, 2)}
+			reporter = latencies
+		})
+
+		It("is recorded once for requests sent to a route service", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(latencies.hosts).To(Receive(Equal(routeServiceListener.Addr().String())))
+			Consistently(latencies.hosts).ShouldNot(Receive())
+		})
+
+		It("is not recorded for routes without a route service", func() {
+			ln := registerHandler(r, "test/my_path", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Consistently(latencies.hosts).ShouldNot(Receive())
+		})
+	})
+
+	Context("when the forwarded url fragment is stripped", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceStripForwardedUrlFragment = true
+			forwardedUrl = "http://my_host.com/resource+9-9_9?query=123&query$2=345"
+		})
+
+		It("sends the route service the forwarded url that was signed", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(body).To(ContainSubstring("My Special Snowflake Route Service"))
+		})
+	})
+
+	Context("route service signature age", func() {
+		var ages *signatureAgeReporter
+
+		BeforeEach(func() {
+			ages = &signatureAgeReporter{ages: make(chan time.Duration, 2)}
+			reporter = ages
+
+			var err error
+			signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, &route_service.Signature{
+				RequestedTime: time.Now().Add(-30 * time.Second),
+				ForwardedUrl:  forwardedUrl,
+			})
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("is recorded for requests returning from a route service", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			var age time.Duration
+			Expect(ages.ages).To(Receive(&age))
+			Expect(age).To(BeNumerically("~", 30*time.Second, 5*time.Second))
+			Consistently(ages.ages).ShouldNot(Receive())
+		})
+	})
+
+	Context("when route services forward to one another in a loop", func() {
+		var routeServiceCalls int32
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceMaxHops = 2
+			atomic.StoreInt32(&routeServiceCalls, 0)
+
+			// Sends requests for a.com to b.com and the other way round, both
+			// of which are bound to this route service.
+			routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&routeServiceCalls, 1)
+
+				forwardedUrl, err := url.Parse(r.Header.Get(route_service.RouteServiceForwardedUrl))
+				Expect(err).ToNot(HaveOccurred())
+				next := "b.com"
+				if forwardedUrl.Host == "b.com" {
+					next = "a.com"
+				}
+
+				req, err := http.NewRequest("GET", "http://"+proxyServer.Addr().String()+"/", nil)
+				Expect(err).ToNot(HaveOccurred())
+				req.Host = next
+				req.Header.Set(route_service.RouteServiceHops, r.Header.Get(route_service.RouteServiceHops))
+
+				res, err := http.DefaultClient.Do(req)
+				Expect(err).ToNot(HaveOccurred())
+				defer res.Body.Close()
+
+				w.Header().Set("X-Cf-RouterError", res.Header.Get("X-Cf-RouterError"))
+				w.WriteHeader(res.StatusCode)
+				io.Copy(w, res.Body)
+			})
+		})
+
+		It("breaks the loop at the configured limit", func() {
+			for _, host := range []string{"a.com", "b.com"} {
+				ln := registerHandlerWithRouteService(r, host, "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+			}
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "a.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_loop"))
+			Expect(body).To(ContainSubstring("Route service loop detected."))
+			Expect(atomic.LoadInt32(&routeServiceCalls)).To(Equal(int32(2)))
+		})
+	})
+
+	Context("route service debug header", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+		})
+
+		sendRequest := func(routeServiceUrl string) *http.Response {
+			ln := registerHandlerWithRouteService(r, "my_host.com", routeServiceUrl, func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		It("is not sent by default", func() {
+			res := sendRequest("https://" + routeServiceListener.Addr().String())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get(router_http.CfRouteServiceUrlHeader)).To(BeEmpty())
+		})
+
+		Context("when enabled", func() {
+			BeforeEach(func() {
+				conf.RouteServiceDebugHeader = true
+			})
+
+			It("names the route service host", func() {
+				res := sendRequest("https://" + routeServiceListener.Addr().String() + "/path?token=secret")
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(res.Header.Get(router_http.CfRouteServiceUrlHeader)).To(Equal(routeServiceListener.Addr().String()))
+			})
+
+			It("names the route service host when it cannot be reached", func() {
+				closed, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).NotTo(HaveOccurred())
+				closed.Close()
+
+				res := sendRequest("https://" + closed.Addr().String())
+				Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+				Expect(res.Header[http.CanonicalHeaderKey(router_http.CfRouteServiceUrlHeader)]).To(Equal([]string{closed.Addr().String()}))
+			})
+
+			It("is not sent for routes without a route service", func() {
+				ln := registerHandler(r, "test/my_path", func(conn *test_util.HttpConn) {
+					conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				conn.WriteRequest(test_util.NewRequest("GET", "test", "/my_path", nil))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Expect(res.Header.Get(router_http.CfRouteServiceUrlHeader)).To(BeEmpty())
+			})
+		})
+	})
+
+	Context("route service requests in flight", func() {
+		var inFlight *inFlightReporter
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			inFlight = &inFlightReporter{}
+			reporter = inFlight
+		})
+
+		It("returns to zero after the route service answers", func() {
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Eventually(inFlight.Current).Should(BeZero())
+			Expect(inFlight.Max()).To(Equal(1))
+		})
+
+		It("returns to zero after the route service cannot be reached", func() {
+			closed, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			closed.Close()
+
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+closed.Addr().String(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadGateway))
+
+			Eventually(inFlight.Current).Should(BeZero())
+			Expect(inFlight.Max()).To(Equal(1))
+		})
+
+		It("is not touched for routes without a route service", func() {
+			ln := registerHandler(r, "test/my_path", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(inFlight.Max()).To(BeZero())
+		})
+	})
+
+	Context("when a request has an invalid Route service signature header", func() {
+		var done chan bool
+
+		sendInvalidSignature := func() *http.Response {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				Expect(req.Header.Get(route_service.RouteServiceSignature)).To(Equal(""))
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+				done <- true
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		BeforeEach(func() {
+			done = make(chan bool, 1)
+		})
+
+		Context("when route service signatures are enforced", func() {
+			BeforeEach(func() {
+				conf.RouteServiceEnforce = true
+			})
+
+			It("does not reach the backend", func() {
+				res := sendInvalidSignature()
+				Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+				Consistently(done).ShouldNot(Receive())
+			})
+		})
+
+		Context("when route service signatures are not enforced", func() {
+			BeforeEach(func() {
+				conf.RouteServiceEnforce = false
+			})
+
+			It("forwards the request to the backend", func() {
+				res := sendInvalidSignature()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+				Eventually(done).Should(Receive())
+			})
+		})
+	})
+
+	Context("validation result in the request context", func() {
+		var (
+			records *recordingAccessLogger
+			p       proxy.Proxy
+		)
+
+		JustBeforeEach(func() {
+			records = &recordingAccessLogger{}
+			p = proxy.NewProxy(proxy.ProxyArgs{
+				EndpointTimeout:     conf.EndpointTimeout,
+				Registry:            r,
+				Reporter:            reporter,
+				AccessLogger:        records,
+				RouteServiceEnabled: true,
+				RouteServiceTimeout: time.Hour,
+				Crypto:              crypto,
+			})
+		})
+
+		serveReturning := func(forwardedUrl string) *route_service.ValidationResult {
+			backend, err := net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).NotTo(HaveOccurred())
+			defer backend.Close()
+			go http.Serve(backend, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			registerAddr(r, "returning", "https://rs.com", backend.Addr(), "")
+
+			req := test_util.NewRequest("GET", "returning", "/", nil)
+			req.RequestURI = "/"
+			req.RemoteAddr = "127.0.0.1:12345"
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			p.ServeHTTP(httptest.NewRecorder(), req)
+
+			logged := records.Records()
+			Expect(logged).To(HaveLen(1))
+			result, ok := route_service.ValidationResultFromContext(logged[0].Request.Context())
+			Expect(ok).To(BeTrue())
+			return result
+		}
+
+		It("holds the decoded signature when it is valid", func() {
+			result := serveReturning(forwardedUrl)
+			Expect(result.Valid()).To(BeTrue())
+			Expect(result.Signature.ForwardedUrl).To(Equal(forwardedUrl))
+		})
+
+		It("holds the error when it is not valid", func() {
+			result := serveReturning("some-other-url")
+			Expect(result.Valid()).To(BeFalse())
+			Expect(result.Err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			Expect(result.Signature).To(BeNil())
+		})
+
+		It("is not set on requests that are not returning from a route service", func() {
+			req := test_util.NewRequest("GET", "test", "/", nil)
+			_, ok := route_service.ValidationResultFromContext(req.Context())
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	Context("when the route key is signed", func() {
+		BeforeEach(func() {
+			conf.RouteServiceSignRouteKey = true
+		})
+
+		Context("on the way to the route service", func() {
+			var routeService *test_util.RouteService
+
+			BeforeEach(func() {
+				conf.SSLSkipValidation = true
+				routeService = test_util.NewRouteService(nil)
+			})
+
+			AfterEach(func() {
+				routeService.Close()
+			})
+
+			It("sends the matched route key to the route service", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path/resource", nil)
+				req.Header.Set(route_service.RouteServiceRouteKey, "spoofed")
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				Expect(routeService.Requests()).To(HaveLen(1))
+				received := routeService.Requests()[0]
+				Expect(received.Header.Get(route_service.RouteServiceRouteKey)).To(Equal("test/my_path"))
+
+				crypto, err := secure.NewAesGCM([]byte(cryptoKey))
+				Expect(err).ToNot(HaveOccurred())
+				signature, err := route_service.SignatureFromHeaders(received.Signature, received.Metadata, crypto)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signature.RouteKey).To(Equal("test/my_path"))
+			})
+		})
+
+		It("strips the route key before the request reaches the backend", func() {
+			done := make(chan http.Header, 1)
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+				done <- req.Header
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			req.Header.Set(route_service.RouteServiceRouteKey, "test/my_path")
+			req.Header.Set(route_service.RouteServiceClientIP, "10.0.0.1")
+			conn.WriteRequest(req)
+
+			var headers http.Header
+			Eventually(done).Should(Receive(&headers))
+			Expect(headers.Get(route_service.RouteServiceRouteKey)).To(BeEmpty())
+			Expect(headers.Get(route_service.RouteServiceClientIP)).To(BeEmpty())
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when the route key is bound", func() {
+		var crypto secure.Crypto
+
+		BeforeEach(func() {
+			conf.RouteServiceBindRouteKey = true
+
+			var err error
+			crypto, err = secure.NewAesGCM([]byte(cryptoKey))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		sendReturning := func(boundRouteKey string) *http.Response {
+			signature := &route_service.Signature{
+				RequestedTime: time.Now(),
+				ForwardedUrl:  forwardedUrl,
+				RouteKey:      boundRouteKey,
+			}
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(crypto, signature, route_service.BuildOptions{BindRouteKey: true})
+			Expect(err).ToNot(HaveOccurred())
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			return res
+		}
+
+		Context("on the way to the route service", func() {
+			var routeService *test_util.RouteService
+
+			BeforeEach(func() {
+				conf.SSLSkipValidation = true
+				routeService = test_util.NewRouteService(nil)
+			})
+
+			AfterEach(func() {
+				routeService.Close()
+			})
+
+			It("sends a signature that only decrypts for the matched route", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				conn.WriteRequest(test_util.NewRequest("GET", "test", "/my_path/resource", nil))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				Expect(routeService.Requests()).To(HaveLen(1))
+				received := routeService.Requests()[0]
+
+				_, err := route_service.SignatureFromHeaders(received.Signature, received.Metadata, crypto)
+				Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+
+				signature, err := route_service.SignatureFromEncodedHeadersForRoute(received.Signature, received.Metadata, crypto, nil, "test/my_path")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signature.RouteKey).To(Equal("test/my_path"))
+			})
+
+			It("does not send the route key header unless it is signed too", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				conn.WriteRequest(test_util.NewRequest("GET", "test", "/my_path/resource", nil))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				Expect(routeService.Requests()).To(HaveLen(1))
+				received := routeService.Requests()[0]
+				Expect(received.Header.Get(route_service.RouteServiceRouteKey)).To(BeEmpty())
+			})
+		})
+
+		It("accepts a request returning with a signature bound to its route", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+			})
+			defer ln.Close()
+
+			Expect(sendReturning("test/my_path").StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("rejects a request returning with a signature bound to another route", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			Expect(sendReturning("test/other_path").StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("when the client ip is signed", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceSignClientIP = true
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("sends the address the request came from to the route service", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			clientIP, _, err := net.SplitHostPort(conn.LocalAddr().String())
+			Expect(err).ToNot(HaveOccurred())
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceClientIP, "10.9.8.7")
+			req.Header.Set("X-Forwarded-For", "10.9.8.7")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(routeService.Requests()).To(HaveLen(1))
+			received := routeService.Requests()[0]
+			Expect(received.Header.Get(route_service.RouteServiceClientIP)).To(Equal(clientIP))
+
+			crypto, err := secure.NewAesGCM([]byte(cryptoKey))
+			Expect(err).ToNot(HaveOccurred())
+			signature, err := route_service.SignatureFromHeaders(received.Signature, received.Metadata, crypto)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.ClientIP).To(Equal(clientIP))
+		})
+	})
+
+	Context("WebSocket upgrades", func() {
+		var upgrade = func(conn *test_util.HttpConn) *http.Response {
+			req := test_util.NewRequest("GET", "ws.com", "/chat", nil)
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			conn.WriteRequest(req)
+
+			res, err := http.ReadResponse(conn.Reader, req)
+			Expect(err).ToNot(HaveOccurred())
+			return res
+		}
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+		})
+
+		Context("when the route service sends the handshake back", func() {
+			var routeServiceUpgrades chan string
+
+			BeforeEach(func() {
+				routeServiceUpgrades = make(chan string, 1)
+				sendBack := &httputil.ReverseProxy{
+					Director: func(req *http.Request) {
+						forwardedUrl, err := url.Parse(req.Header.Get(route_service.RouteServiceForwardedUrl))
+						Expect(err).ToNot(HaveOccurred())
+
+						req.Host = forwardedUrl.Host
+						req.URL.Scheme = "http"
+						req.URL.Host = proxyServer.Addr().String()
+					},
+				}
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					routeServiceUpgrades <- r.Header.Get("Upgrade")
+					sendBack.ServeHTTP(w, r)
+				})
+			})
+
+			It("validates the signature and upgrades the connection to the backend", func() {
+				headers := make(chan http.Header, 1)
+				ln := registerHandlerWithRouteService(r, "ws.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					req, err := http.ReadRequest(conn.Reader)
+					Expect(err).ToNot(HaveOccurred())
+					headers <- req.Header
+
+					resp := test_util.NewResponse(http.StatusSwitchingProtocols)
+					resp.Header.Set("Upgrade", "websocket")
+					resp.Header.Set("Connection", "Upgrade")
+					conn.WriteResponse(resp)
+
+					conn.CheckLine("hello from client")
+					conn.WriteLine("hello from server")
+					conn.Close()
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				res := upgrade(conn)
+				Expect(res.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+				Expect(res.Header.Get("Upgrade")).To(Equal("websocket"))
+				Expect(routeServiceUpgrades).To(Receive(Equal("websocket")))
+
+				var backendHeaders http.Header
+				Eventually(headers).Should(Receive(&backendHeaders))
+				Expect(backendHeaders.Get("Upgrade")).To(Equal("websocket"))
+				Expect(backendHeaders.Get(route_service.RouteServiceSignature)).To(BeEmpty())
+				Expect(backendHeaders.Get(route_service.RouteServiceMetadata)).To(BeEmpty())
+
+				conn.WriteLine("hello from client")
+				conn.CheckLine("hello from server")
+				conn.Close()
+			})
+
+			Context("with a short endpoint timeout", func() {
+				BeforeEach(func() {
+					conf.EndpointTimeout = 100 * time.Millisecond
+				})
+
+				It("keeps the connection open past it", func() {
+					ln := registerHandlerWithRouteService(r, "ws.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+						_, err := http.ReadRequest(conn.Reader)
+						Expect(err).ToNot(HaveOccurred())
+
+						resp := test_util.NewResponse(http.StatusSwitchingProtocols)
+						resp.Header.Set("Upgrade", "websocket")
+						resp.Header.Set("Connection", "Upgrade")
+						conn.WriteResponse(resp)
+
+						conn.CheckLine("hello from client")
+						conn.WriteLine("hello from server")
+						conn.CheckLine("still there?")
+						conn.WriteLine("still here")
+						conn.Close()
+					})
+					defer ln.Close()
+
+					conn := dialProxy(proxyServer)
+					res := upgrade(conn)
+					Expect(res.StatusCode).To(Equal(http.StatusSwitchingProtocols))
+
+					conn.WriteLine("hello from client")
+					conn.CheckLine("hello from server")
+
+					time.Sleep(3 * conf.EndpointTimeout)
+
+					conn.WriteLine("still there?")
+					conn.CheckLine("still here")
+					conn.Close()
+				})
+			})
+		})
+
+		Context("when the route service answers the handshake itself", func() {
+			BeforeEach(func() {
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					Expect(r.Header.Get("Upgrade")).To(Equal("websocket"))
+					w.WriteHeader(http.StatusForbidden)
+				})
+			})
+
+			It("relays its answer without reaching the backend", func() {
+				ln := registerHandlerWithRouteService(r, "ws.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+				res := upgrade(conn)
+				Expect(res.StatusCode).To(Equal(http.StatusForbidden))
+			})
+		})
+
+		It("does not upgrade handshakes with an invalid signature", func() {
+			ln := registerHandlerWithRouteService(r, "ws.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+			req := test_util.NewRequest("GET", "ws.com", "/chat", nil)
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set(route_service.RouteServiceSignature, "invalid")
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, "http://ws.com/chat")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("with an expiry grace", func() {
+		BeforeEach(func() {
+			conf.RouteServiceExpiryGrace = time.Minute
+		})
+
+		sendReturning := func(requestedTime time.Time) (*http.Response, http.Header) {
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(crypto, &route_service.Signature{
+				RequestedTime: requestedTime,
+				ForwardedUrl:  forwardedUrl,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			done := make(chan http.Header, 1)
+			ln := registerHandlerWithRouteService(r, "my_host.com", "https://rs.com", func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+				done <- req.Header
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "my_host.com", "/resource+9-9_9?query=123&query$2=345#page1..5", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			req.Header.Set(route_service.RouteServiceSoftExpired, "spoofed")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			var headers http.Header
+			if res.StatusCode == http.StatusOK {
+				Eventually(done).Should(Receive(&headers))
+			}
+			return res, headers
+		}
+
+		It("flags signatures accepted within the grace to the backend", func() {
+			res, headers := sendReturning(time.Now().Add(-conf.RouteServiceTimeout - 30*time.Second))
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(headers.Get(route_service.RouteServiceSoftExpired)).To(Equal("true"))
+		})
+
+		It("does not flag signatures within their validity", func() {
+			res, headers := sendReturning(time.Now())
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(headers.Get(route_service.RouteServiceSoftExpired)).To(BeEmpty())
+		})
+
+		It("rejects signatures beyond the grace", func() {
+			res, _ := sendReturning(time.Now().Add(-conf.RouteServiceTimeout - 2*time.Minute))
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Context("timeout budget", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("tells the route service how long it has to send the request back", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceTimeoutMs, "999999999")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(routeService.Requests()).To(HaveLen(1))
+			budget, err := strconv.ParseInt(routeService.Requests()[0].Header.Get(route_service.RouteServiceTimeoutMs), 10, 64)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(budget).To(BeNumerically("<=", int64(conf.RouteServiceTimeout/time.Millisecond)))
+			Expect(budget).To(BeNumerically(">", int64((conf.RouteServiceTimeout-5*time.Second)/time.Millisecond)))
+		})
+
+		It("does not pass the budget on to the backend", func() {
+			done := make(chan http.Header, 1)
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+				done <- req.Header
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			req.Header.Set(route_service.RouteServiceTimeoutMs, "1000")
+			conn.WriteRequest(req)
+
+			var headers http.Header
+			Eventually(done).Should(Receive(&headers))
+			Expect(headers.Get(route_service.RouteServiceTimeoutMs)).To(BeEmpty())
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("when a route service sets reserved headers on the request", func() {
+		BeforeEach(func() {
+			conf.RouteServiceReservedHeaders = []string{"X-Trusted-User"}
+		})
+
+		It("strips them before the request reaches the backend", func() {
+			done := make(chan http.Header, 1)
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				req, _ := conn.ReadRequest()
+				conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+				conn.Close()
+				done <- req.Header
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			req.Header.Set("X-CF-ApplicationID", "spoofed-app-id")
+			req.Header.Set("X-Trusted-User", "admin")
+			req.Header.Set("X-Other", "other")
+			conn.WriteRequest(req)
+
+			var headers http.Header
+			Eventually(done).Should(Receive(&headers))
+			Expect(headers.Get("X-CF-ApplicationID")).To(Equal(""))
+			Expect(headers.Get("X-Trusted-User")).To(Equal(""))
+			Expect(headers.Get("X-Other")).To(Equal("other"))
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+		})
+	})
+
+	Context("with a route service url on a non-standard port", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			routeService = test_util.NewRouteService(nil)
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("connects to that port, naming the host without it", func() {
+			routeServiceUrl := "https://localhost:" + routeService.Port() + "/"
+			Expect(routeService.Port()).ToNot(Equal("443"))
+
+			ln := registerHandlerWithRouteService(r, "test/my_path", routeServiceUrl, func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+			Expect(routeService.Requests()).To(HaveLen(1))
+			received := routeService.Requests()[0]
+			Expect(received.Host).To(Equal("localhost:" + routeService.Port()))
+			Expect(received.ServerName).To(Equal("localhost"))
+		})
+	})
+
+	Context("when route service response headers are stripped", func() {
+		var routeService *test_util.RouteService
+
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+			conf.RouteServiceResponseHeaders = []string{"X-Route-Service-Session"}
+			routeService = test_util.NewRouteService(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Route-Service-Session", "secret")
+				w.Header().Set("X-Other", "other")
+			}))
+		})
+
+		AfterEach(func() {
+			routeService.Close()
+		})
+
+		It("removes them from the response to the client", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("X-Route-Service-Session")).To(BeEmpty())
+			Expect(res.Header.Get("X-Other")).To(Equal("other"))
+		})
+	})
+
+	Context("X-Forwarded-For", func() {
+		BeforeEach(func() {
+			conf.SSLSkipValidation = true
+		})
+
+		Context("on the route service leg", func() {
+			var done chan string
+
+			BeforeEach(func() {
+				done = make(chan string, 1)
+				routeServiceHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					done <- r.Header.Get("X-Forwarded-For")
+					w.Write([]byte("route service"))
+				})
+			})
+
+			It("appends the client address", func() {
+				ln := registerHandlerWithRouteService(r, "my_host.com", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
 
 				conn := dialProxy(proxyServer)
 
-				req := test_util.NewRequest("GET", "mybadapp.com", "/", nil)
+				req := test_util.NewRequest("GET", "my_host.com", "/", nil)
+				req.Header.Set("X-Forwarded-For", "1.2.3.4")
+				conn.WriteRequest(req)
+
+				var xff string
+				Eventually(done).Should(Receive(&xff))
+				Expect(xff).To(Equal("1.2.3.4, 127.0.0.1"))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when the route service has already appended its own address", func() {
+			It("does not append the route service address twice", func() {
+				done := make(chan string)
+				ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					req, _ := conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+					done <- req.Header.Get("X-Forwarded-For")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
 				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
 				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
 				req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+				req.Header.Set("X-Forwarded-For", "1.2.3.4, 127.0.0.1")
 				conn.WriteRequest(req)
-				resp, _ := conn.ReadResponse()
 
-				Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+				var xff string
+				Eventually(done).Should(Receive(&xff))
+				Expect(xff).To(Equal("1.2.3.4, 127.0.0.1"))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when the route service did not append its own address", func() {
+			It("appends the route service address", func() {
+				done := make(chan string)
+				ln := registerHandlerWithRouteService(r, "test/my_path", "https://"+routeServiceListener.Addr().String(), func(conn *test_util.HttpConn) {
+					req, _ := conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+					done <- req.Header.Get("X-Forwarded-For")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+				req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+				req.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+				req.Header.Set("X-Forwarded-For", "1.2.3.4")
+				conn.WriteRequest(req)
+
+				var xff string
+				Eventually(done).Should(Receive(&xff))
+				Expect(xff).To(Equal("1.2.3.4, 127.0.0.1"))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+
+		Context("when the route has no route service", func() {
+			It("appends the client address once", func() {
+				done := make(chan string)
+				ln := registerHandler(r, "test/my_path", func(conn *test_util.HttpConn) {
+					req, _ := conn.ReadRequest()
+					conn.WriteResponse(test_util.NewResponse(http.StatusOK))
+					conn.Close()
+					done <- req.Header.Get("X-Forwarded-For")
+				})
+				defer ln.Close()
+
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set("X-Forwarded-For", "1.2.3.4")
+				conn.WriteRequest(req)
+
+				var xff string
+				Eventually(done).Should(Receive(&xff))
+				Expect(xff).To(Equal("1.2.3.4, 127.0.0.1"))
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+			})
+		})
+	})
+
+	Context("when a request has a metadata header but no signature header", func() {
+		It("returns a bad request error", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://expired.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			conn.WriteRequest(req)
+
+			res, body := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_missing_signature"))
+			Expect(body).To(ContainSubstring("Route service metadata sent without a signature."))
+		})
+
+		Context("when the signature is not enforced", func() {
+			var routeService *test_util.RouteService
+
+			BeforeEach(func() {
+				conf.SSLSkipValidation = true
+				conf.RouteServiceEnforce = false
+				routeService = test_util.NewRouteService(nil)
+			})
+
+			AfterEach(func() {
+				routeService.Close()
+			})
+
+			It("sends the request to the route service with fresh metadata", func() {
+				ln := registerHandlerWithRouteService(r, "test/my_path", routeService.Url(), func(conn *test_util.HttpConn) {
+					Fail("Should not get here")
+				})
+				defer ln.Close()
+				conn := dialProxy(proxyServer)
+
+				req := test_util.NewRequest("GET", "test", "/my_path", nil)
+				req.Header.Set(route_service.RouteServiceMetadata, "stale")
+				conn.WriteRequest(req)
+
+				res, _ := conn.ReadResponse()
+				Expect(res.StatusCode).To(Equal(http.StatusOK))
+
+				Expect(routeService.Requests()).To(HaveLen(1))
+				Expect(routeService.Requests()[0].Signature).NotTo(BeEmpty())
+				Expect(routeService.Requests()[0].Metadata).NotTo(Equal("stale"))
 			})
 		})
 	})
@@ -239,6 +4013,7 @@ var _ = Describe("Route Services", func() {
 
 			res, body := conn.ReadResponse()
 			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_bad_signature"))
 			Expect(body).To(ContainSubstring("Failed to validate Route Service Signature"))
 		})
 	})
@@ -268,6 +4043,23 @@ var _ = Describe("Route Services", func() {
 	})
 
 	Context("when a route service modifies the X-CF-Forwarded-Url header", func() {
+		It("returns a bad request error, even for another host", func() {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, "http://other-host.com/my_path")
+			conn.WriteRequest(req)
+
+			res, _ := conn.ReadResponse()
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+
 		It("returns a bad request error", func() {
 			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
 				Fail("Should not get here")
@@ -287,6 +4079,46 @@ var _ = Describe("Route Services", func() {
 		})
 	})
 
+	Context("when 421 is configured for forwarded urls for another host", func() {
+		BeforeEach(func() {
+			conf.RouteServiceMisdirectedOnHostMismatch = true
+		})
+
+		sendForwardedUrl := func(url string) (*http.Response, string) {
+			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
+				Fail("Should not get here")
+			})
+			defer ln.Close()
+			conn := dialProxy(proxyServer)
+
+			req := test_util.NewRequest("GET", "test", "/my_path", nil)
+			req.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+			req.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+			req.Header.Set(route_service.RouteServiceForwardedUrl, url)
+			conn.WriteRequest(req)
+
+			return conn.ReadResponse()
+		}
+
+		It("returns a misdirected request error when the host differs", func() {
+			res, body := sendForwardedUrl("http://other-host.com/my_path")
+			Expect(res.StatusCode).To(Equal(http.StatusMisdirectedRequest))
+			Expect(res.Header.Get("X-Cf-RouterError")).To(Equal(proxy.RouteServiceMisdirected))
+			Expect(body).To(ContainSubstring("Forwarded url is for another host."))
+		})
+
+		It("still returns a bad request error when only the path differs", func() {
+			res, body := sendForwardedUrl("http://test/other_path")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+			Expect(body).To(ContainSubstring("Failed to validate Route Service Signature"))
+		})
+
+		It("still returns a bad request error when the forwarded url has no host", func() {
+			res, _ := sendForwardedUrl("some-other-url")
+			Expect(res.StatusCode).To(Equal(http.StatusBadRequest))
+		})
+	})
+
 	Context("when a route service strips off the X-CF-Forwarded-Url header", func() {
 		It("returns a bad request error", func() {
 			ln := registerHandlerWithRouteService(r, "test/my_path", "https://rs.com", func(conn *test_util.HttpConn) {
@@ -436,6 +4268,7 @@ var _ = Describe("Route Services", func() {
 		res, body := readResponse(conn)
 
 		Expect(res.StatusCode).To(Equal(http.StatusInternalServerError))
+		Expect(res.Header.Get("X-Cf-RouterError")).To(Equal("route_service_failed"))
 		Expect(body).NotTo(ContainSubstring("My Special Snowflake Route Service"))
 	})
 
@@ -472,4 +4305,193 @@ var _ = Describe("Route Services", func() {
 		okCodes := []int{http.StatusOK, http.StatusFound}
 		Expect(okCodes).Should(ContainElement(res.StatusCode))
 	})
+
+	It("fails load balancer heartbeats when the route service key fails its self check", func() {
+		brokenCrypto := new(fakes.FakeCrypto)
+		brokenCrypto.EncryptReturns([]byte("cipher-text"), []byte("nonce"), nil)
+		brokenCrypto.DecryptReturns(nil, errors.New("corrupt key"))
+
+		p := proxy.NewProxy(proxy.ProxyArgs{
+			EndpointTimeout:     conf.EndpointTimeout,
+			Registry:            r,
+			Reporter:            reporter,
+			AccessLogger:        accessLog,
+			RouteServiceEnabled: true,
+			RouteServiceTimeout: time.Hour,
+			Crypto:              brokenCrypto,
+		})
+
+		req := test_util.NewRequest("GET", "", "/", nil)
+		req.Header.Set("User-Agent", "HTTP-Monitor/1.1")
+		req.RemoteAddr = "127.0.0.1:12345"
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+
+		Expect(w.Code).To(Equal(http.StatusServiceUnavailable))
+		Expect(w.Header().Get("Cache-Control")).To(Equal("private, max-age=0"))
+		Expect(w.Body.String()).ToNot(Equal("ok\n"))
+	})
+
+	Context("when failing closed on unusable route service keys", func() {
+		var brokenCrypto *fakes.FakeCrypto
+
+		BeforeEach(func() {
+			brokenCrypto = new(fakes.FakeCrypto)
+			brokenCrypto.EncryptReturns([]byte("cipher-text"), []byte("nonce"), nil)
+			brokenCrypto.DecryptReturns(nil, errors.New("corrupt key"))
+		})
+
+		newProxy := func(current, prev secure.Crypto, failClosed bool) func() {
+			return func() {
+				proxy.NewProxy(proxy.ProxyArgs{
+					EndpointTimeout:        conf.EndpointTimeout,
+					Registry:               r,
+					Reporter:               reporter,
+					AccessLogger:           accessLog,
+					RouteServiceEnabled:    true,
+					RouteServiceTimeout:    time.Hour,
+					Crypto:                 current,
+					CryptoPrev:             prev,
+					RouteServiceFailClosed: failClosed,
+				})
+			}
+		}
+
+		It("refuses to build a proxy with a bad current key", func() {
+			Expect(newProxy(brokenCrypto, crypto, true)).To(Panic())
+			Expect(newProxy(brokenCrypto, crypto, false)).ToNot(Panic())
+		})
+
+		It("refuses to build a proxy with a bad previous key", func() {
+			Expect(newProxy(crypto, brokenCrypto, true)).To(Panic())
+			Expect(newProxy(crypto, brokenCrypto, false)).ToNot(Panic())
+		})
+
+		It("builds a proxy with usable keys", func() {
+			Expect(newProxy(crypto, crypto, true)).ToNot(Panic())
+		})
+	})
+
+	It("does no route service work for direct routes", func() {
+		backend, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer backend.Close()
+		go http.Serve(backend, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+		registerAddr(r, "direct", "", backend.Addr(), "")
+
+		allocs := map[bool]float64{}
+		for _, enabled := range []bool{false, true} {
+			p := proxy.NewProxy(proxy.ProxyArgs{
+				EndpointTimeout:     conf.EndpointTimeout,
+				Registry:            r,
+				Reporter:            reporter,
+				AccessLogger:        accessLog,
+				RouteServiceEnabled: enabled,
+				RouteServiceTimeout: time.Hour,
+				Crypto:              crypto,
+			})
+
+			allocs[enabled] = testing.AllocsPerRun(100, func() {
+				req := test_util.NewRequest("GET", "direct", "/", nil)
+				req.RequestURI = "/"
+				req.RemoteAddr = "127.0.0.1:12345"
+				w := httptest.NewRecorder()
+				p.ServeHTTP(w, req)
+				Expect(w.Code).To(Equal(http.StatusOK))
+			})
+		}
+
+		Expect(allocs[true]).To(Equal(allocs[false]))
+	})
 })
+
+type recordingAccessLogger struct {
+	mutex   sync.Mutex
+	records []access_log.AccessLogRecord
+}
+
+func (l *recordingAccessLogger) Run()  {}
+func (l *recordingAccessLogger) Stop() {}
+
+func (l *recordingAccessLogger) Log(record access_log.AccessLogRecord) {
+	l.mutex.Lock()
+	l.records = append(l.records, record)
+	l.mutex.Unlock()
+}
+
+func (l *recordingAccessLogger) Records() []access_log.AccessLogRecord {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]access_log.AccessLogRecord{}, l.records...)
+}
+
+type jsonRouteServiceErrors struct{}
+
+func (jsonRouteServiceErrors) RouteServiceError(reason string, err error, request *http.Request) (int, string, []byte) {
+	code := http.StatusBadGateway
+	if reason == proxy.RouteServiceBadSignature {
+		code = http.StatusBadRequest
+	}
+
+	if request.Header.Get("Accept") != "application/json" {
+		return code, "text/html", []byte("<h1>" + reason + "</h1>")
+	}
+
+	payload := map[string]string{"reason": reason}
+	if err != nil {
+		payload["error"] = err.Error()
+	}
+	body, _ := json.Marshal(payload)
+	return code, "application/json", body
+}
+
+type routeServiceLatencyReporter struct {
+	nullVarz
+	hosts chan string
+}
+
+func (r *routeServiceLatencyReporter) CaptureRouteServiceResponse(host string, res *http.Response, d time.Duration) {
+	r.hosts <- host
+}
+
+type signatureAgeReporter struct {
+	nullVarz
+	ages chan time.Duration
+}
+
+func (r *signatureAgeReporter) CaptureRouteServiceSignatureAge(d time.Duration) {
+	r.ages <- d
+}
+
+type inFlightReporter struct {
+	nullVarz
+	sync.Mutex
+	current, max int
+}
+
+func (r *inFlightReporter) CaptureRouteServiceRequestStarted() {
+	r.Lock()
+	defer r.Unlock()
+	r.current++
+	if r.current > r.max {
+		r.max = r.current
+	}
+}
+
+func (r *inFlightReporter) CaptureRouteServiceRequestFinished() {
+	r.Lock()
+	defer r.Unlock()
+	r.current--
+}
+
+func (r *inFlightReporter) Current() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.current
+}
+
+func (r *inFlightReporter) Max() int {
+	r.Lock()
+	defer r.Unlock()
+	return r.max
+}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	router_http "github.com/cloudfoundry/gorouter/common/http"
+)
+
+// setRouteServiceTraceHeaders starts a span for the hop to a route service.
+// Incoming B3 and W3C trace context is kept, with the caller's span becoming
+// the parent; a new trace is started when the request carries none. Trace
+// headers set by the route service on its way back are passed to the backend
+// as they are.
+func setRouteServiceTraceHeaders(header http.Header) {
+	spanId := newTraceId(8)
+	traced := false
+
+	if header.Get(router_http.B3TraceIdHeader) != "" {
+		traced = true
+		parentSpanId := header.Get(router_http.B3SpanIdHeader)
+		if parentSpanId != "" {
+			header.Set(router_http.B3ParentSpanIdHeader, parentSpanId)
+		} else {
+			header.Del(router_http.B3ParentSpanIdHeader)
+		}
+		header.Set(router_http.B3SpanIdHeader, spanId)
+	}
+
+	// b3: {TraceId}-{SpanId}[-{SamplingState}[-{ParentSpanId}]]
+	if b3 := header.Get(router_http.B3Header); b3 != "" {
+		parts := strings.Split(b3, "-")
+		if len(parts) >= 2 {
+			traced = true
+			value := parts[0] + "-" + spanId
+			if len(parts) >= 3 {
+				value += "-" + parts[2] + "-" + parts[1]
+			}
+			header.Set(router_http.B3Header, value)
+		}
+	}
+
+	// traceparent: {version}-{trace-id}-{parent-id}-{trace-flags}
+	if traceparent := header.Get(router_http.TraceparentHeader); traceparent != "" {
+		parts := strings.Split(traceparent, "-")
+		if len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+			traced = true
+			parts[2] = spanId
+			header.Set(router_http.TraceparentHeader, strings.Join(parts, "-"))
+		}
+	}
+
+	if !traced {
+		header.Set(router_http.B3TraceIdHeader, newTraceId(16))
+		header.Set(router_http.B3SpanIdHeader, spanId)
+	}
+}
+
+func newTraceId(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -2,6 +2,7 @@ package registry
 
 import (
 	"encoding/json"
+	"path"
 	"strings"
 	"sync"
 	"time"
@@ -36,6 +37,8 @@ type RouteRegistry struct {
 
 	messageBus yagnats.NATSConn
 
+	routeServiceAllowedRoutes []string
+
 	ticker           *time.Ticker
 	timeOfLastUpdate time.Time
 }
@@ -50,6 +53,8 @@ func NewRouteRegistry(c *config.Config, mbus yagnats.NATSConn) *RouteRegistry {
 	r.pruneStaleDropletsInterval = c.PruneStaleDropletsInterval
 	r.dropletStaleThreshold = c.DropletStaleThreshold
 
+	r.routeServiceAllowedRoutes = c.RouteServiceAllowedRoutes
+
 	r.messageBus = mbus
 
 	return r
@@ -61,10 +66,18 @@ func (r *RouteRegistry) Register(uri route.Uri, endpoint *route.Endpoint) {
 
 	uri = uri.RouteKey()
 
+	if endpoint.RouteServiceUrl != "" && !r.routeServiceAllowed(uri) {
+		r.logger.Warnd(map[string]interface{}{
+			"route":             uri,
+			"route_service_url": endpoint.RouteServiceUrl,
+		}, "registry.route-service.not-allowed")
+		endpoint.RouteServiceUrl = ""
+	}
+
 	pool, found := r.byUri.Find(uri)
 	if !found {
 		contextPath := parseContextPath(uri)
-		pool = route.NewPool(r.dropletStaleThreshold/4, contextPath)
+		pool = route.NewPoolForRoute(r.dropletStaleThreshold/4, uri, contextPath)
 		r.byUri.Insert(uri, pool)
 	}
 
@@ -74,6 +87,30 @@ func (r *RouteRegistry) Register(uri route.Uri, endpoint *route.Endpoint) {
 	r.Unlock()
 }
 
+// routeServiceAllowed reports whether uri, a route key, may be bound to a
+// route service. Patterns match either the whole key or its host.
+func (r *RouteRegistry) routeServiceAllowed(uri route.Uri) bool {
+	if len(r.routeServiceAllowedRoutes) == 0 {
+		return true
+	}
+
+	key := string(uri)
+	host := key
+	if i := strings.Index(key, "/"); i >= 0 {
+		host = key[:i]
+	}
+
+	for _, pattern := range r.routeServiceAllowedRoutes {
+		if matched, _ := path.Match(pattern, key); matched {
+			return true
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
 func (r *RouteRegistry) Unregister(uri route.Uri, endpoint *route.Endpoint) {
 	r.Lock()
 
@@ -131,6 +131,40 @@ var _ = Describe("RouteRegistry", func() {
 				Expect(r.NumEndpoints()).To(Equal(1))
 			})
 		})
+
+		Context("when routes allowed to use route services are configured", func() {
+			BeforeEach(func() {
+				configObj.RouteServiceAllowedRoutes = []string{"*.secure.com", "open.com/admin/*"}
+				r = NewRouteRegistry(configObj, messageBus)
+			})
+
+			It("honors the route service of an allowed host", func() {
+				r.Register("app.secure.com", barEndpoint)
+
+				Expect(r.Lookup("app.secure.com").RouteServiceUrl()).To(Equal("https://my-rs.com"))
+			})
+
+			It("honors the route service of an allowed route key", func() {
+				r.Register("open.com/admin/users", barEndpoint)
+
+				Expect(r.Lookup("open.com/admin/users").RouteServiceUrl()).To(Equal("https://my-rs.com"))
+			})
+
+			It("strips the route service of a route that is not allowed", func() {
+				r.Register("app.other.com", barEndpoint)
+
+				p := r.Lookup("app.other.com")
+				Expect(p).ToNot(BeNil())
+				Expect(p.RouteServiceUrl()).To(BeEmpty())
+				Expect(r.NumEndpoints()).To(Equal(1))
+			})
+
+			It("registers routes without a route service as usual", func() {
+				r.Register("app.other.com", fooEndpoint)
+
+				Expect(r.Lookup("app.other.com")).ToNot(BeNil())
+			})
+		})
 	})
 
 	Context("Unregister", func() {
@@ -261,6 +295,16 @@ var _ = Describe("RouteRegistry", func() {
 			Expect(iter.Next().CanonicalAddr()).To(Equal("192.168.1.1:1234"))
 		})
 
+		It("returns the pool of the matched route key", func() {
+			m := route.NewEndpoint("", "192.168.1.1", 1234, "", nil, -1, "")
+
+			r.Register("Foo.example.com/bar", m)
+			r.Register("*.wild.com", m)
+
+			Expect(r.Lookup("foo.example.com/bar/baz").RouteKey()).To(Equal(route.Uri("foo.example.com/bar")))
+			Expect(r.Lookup("a.wild.com").RouteKey()).To(Equal(route.Uri("*.wild.com")))
+		})
+
 		It("selects one of the routes", func() {
 			m1 := route.NewEndpoint("", "192.168.1.1", 1234, "", nil, -1, "")
 			m2 := route.NewEndpoint("", "192.168.1.1", 1235, "", nil, -1, "")
@@ -460,4 +504,14 @@ var _ = Describe("RouteRegistry", func() {
 		Ω(err).NotTo(HaveOccurred())
 		Expect(string(marshalled)).To(Equal(`{}`))
 	})
+
+	It("marshals whether a route skips validating its route service certificate", func() {
+		m := route.NewEndpoint("", "192.168.1.1", 1234, "", nil, -1, "https://my-routeService.com")
+		m.RouteServiceSkipSslValidation = true
+		r.Register("foo", m)
+
+		marshalled, err := json.Marshal(r)
+		Ω(err).NotTo(HaveOccurred())
+		Expect(string(marshalled)).To(Equal(`{"foo":[{"address":"192.168.1.1:1234","ttl":-1,"route_service_url":"https://my-routeService.com","route_service_skip_ssl_validation":true}]}`))
+	})
 })
@@ -25,6 +25,15 @@ type Endpoint struct {
 	PrivateInstanceId string
 	staleThreshold    time.Duration
 	RouteServiceUrl   string
+
+	// Set for endpoints that are themselves route services. Requests to
+	// them keep the route service signature headers so that the service
+	// can pass them back to the router.
+	IsRouteService bool
+
+	// Set to connect to the endpoint's route service without verifying its
+	// certificate, whatever the router's ssl_skip_validation.
+	RouteServiceSkipSslValidation bool
 }
 
 func (e *Endpoint) MarshalJSON() ([]byte, error) {
@@ -32,10 +41,15 @@ func (e *Endpoint) MarshalJSON() ([]byte, error) {
 		Address         string `json:"address"`
 		TTL             int    `json:"ttl"`
 		RouteServiceUrl string `json:"route_service_url,omitempty"`
+		IsRouteService  bool   `json:"is_route_service,omitempty"`
+
+		RouteServiceSkipSslValidation bool `json:"route_service_skip_ssl_validation,omitempty"`
 	}
 
 	jsonObj.Address = e.addr
 	jsonObj.RouteServiceUrl = e.RouteServiceUrl
+	jsonObj.IsRouteService = e.IsRouteService
+	jsonObj.RouteServiceSkipSslValidation = e.RouteServiceSkipSslValidation
 	jsonObj.TTL = int(e.staleThreshold.Seconds())
 	return json.Marshal(jsonObj)
 }
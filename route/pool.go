@@ -33,6 +33,7 @@ type Pool struct {
 	endpoints []*endpointElem
 	index     map[string]*endpointElem
 
+	routeKey        Uri
 	contextPath     string
 	routeServiceUrl string
 
@@ -41,15 +42,28 @@ type Pool struct {
 }
 
 func NewPool(retryAfterFailure time.Duration, contextPath string) *Pool {
+	return NewPoolForRoute(retryAfterFailure, "", contextPath)
+}
+
+// NewPoolForRoute is NewPool for the pool of the route registered under
+// routeKey.
+func NewPoolForRoute(retryAfterFailure time.Duration, routeKey Uri, contextPath string) *Pool {
 	return &Pool{
 		endpoints:         make([]*endpointElem, 0, 1),
 		index:             make(map[string]*endpointElem),
 		retryAfterFailure: retryAfterFailure,
 		nextIdx:           -1,
+		routeKey:          routeKey,
 		contextPath:       contextPath,
 	}
 }
 
+// RouteKey is the key the pool's route was registered under, or empty if it
+// was built with NewPool.
+func (p *Pool) RouteKey() Uri {
+	return p.routeKey
+}
+
 func (p *Pool) ContextPath() string {
 	return p.contextPath
 }
@@ -100,6 +114,39 @@ func (p *Pool) RouteServiceUrl() string {
 	}
 }
 
+// ApplicationId is the application the pool's endpoints were registered for.
+func (p *Pool) ApplicationId() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.endpoints) > 0 {
+		return p.endpoints[0].endpoint.ApplicationId
+	}
+	return ""
+}
+
+// RouteServiceSkipSslValidation reports whether the certificate of the pool's
+// route service is not to be verified.
+func (p *Pool) RouteServiceSkipSslValidation() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.endpoints) > 0 {
+		return p.endpoints[0].endpoint.RouteServiceSkipSslValidation
+	}
+	return false
+}
+
+func (p *Pool) IsRouteService() bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	if len(p.endpoints) > 0 {
+		return p.endpoints[0].endpoint.IsRouteService
+	}
+	return false
+}
+
 func (p *Pool) PruneEndpoints(defaultThreshold time.Duration) {
 	p.lock.Lock()
 
@@ -65,6 +65,43 @@ var _ = Describe("Pool", func() {
 		})
 	})
 
+	Context("ApplicationId", func() {
+		It("returns the application id of the pool's endpoints", func() {
+			Expect(pool.ApplicationId()).To(BeEmpty())
+
+			pool.Put(&Endpoint{ApplicationId: "app-guid"})
+			Expect(pool.ApplicationId()).To(Equal("app-guid"))
+		})
+	})
+
+	Context("RouteKey", func() {
+		It("returns the key the pool was built for", func() {
+			Expect(pool.RouteKey()).To(BeEmpty())
+
+			p := NewPoolForRoute(2*time.Minute, "test/my_path", "/my_path")
+			Expect(p.RouteKey()).To(Equal(Uri("test/my_path")))
+			Expect(p.ContextPath()).To(Equal("/my_path"))
+		})
+	})
+
+	Context("IsRouteService", func() {
+		It("reports whether the pool's endpoints are route services", func() {
+			Expect(pool.IsRouteService()).To(BeFalse())
+
+			pool.Put(&Endpoint{IsRouteService: true})
+			Expect(pool.IsRouteService()).To(BeTrue())
+		})
+	})
+
+	Context("RouteServiceSkipSslValidation", func() {
+		It("reports whether the pool's route service certificate is not verified", func() {
+			Expect(pool.RouteServiceSkipSslValidation()).To(BeFalse())
+
+			pool.Put(&Endpoint{RouteServiceSkipSslValidation: true})
+			Expect(pool.RouteServiceSkipSslValidation()).To(BeTrue())
+		})
+	})
+
 	Context("Remove", func() {
 		It("removes endpoints", func() {
 			endpoint := &Endpoint{}
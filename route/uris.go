@@ -26,6 +26,8 @@ func (u Uri) String() string {
 	return strings.TrimSuffix(string(u), "/")
 }
 
+// RouteKey is the key routes are registered and looked up by. Host names are
+// case-insensitive, so keys are always lowercased.
 func (u Uri) RouteKey() Uri {
 	key := u.ToLower()
 	if idx := strings.Index(string(key), "?"); idx >= 0 {
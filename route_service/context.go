@@ -0,0 +1,33 @@
+package route_service
+
+import "context"
+
+// ContextKey is the type of the keys the proxy stores route service state
+// under in request contexts.
+type ContextKey string
+
+// ValidationResultKey holds the *ValidationResult of a request returning from
+// a route service.
+const ValidationResultKey ContextKey = "route_service.validation_result"
+
+// ValidationResult is the outcome of validating the signature on a request
+// returning from a route service. Signature is only set when Err is nil.
+type ValidationResult struct {
+	Signature *Signature
+	Err       error
+}
+
+func (r *ValidationResult) Valid() bool {
+	return r.Err == nil
+}
+
+func WithValidationResult(ctx context.Context, result *ValidationResult) context.Context {
+	return context.WithValue(ctx, ValidationResultKey, result)
+}
+
+// ValidationResultFromContext returns the result stored by the proxy. There is
+// none for requests that were not returning from a route service.
+func ValidationResultFromContext(ctx context.Context) (*ValidationResult, bool) {
+	result, ok := ctx.Value(ValidationResultKey).(*ValidationResult)
+	return result, ok
+}
@@ -0,0 +1,124 @@
+package route_service
+
+import (
+	"bytes"
+	"strings"
+)
+
+// CanonicalForwardedUrl rewrites a forwarded url into the form the router
+// signs and sends in X-CF-Forwarded-Url when canonical forwarded urls are
+// enabled. Route services echoing the header back unchanged always match;
+// those rebuilding the url can reproduce the form by following RFC 3986
+// normalization:
+//
+//   - the scheme and host are lowercased;
+//   - port 80 is removed from http urls and port 443 from https urls;
+//   - an empty path becomes "/";
+//   - in the path, query and fragment, percent-encodings of unreserved
+//     characters (A-Z a-z 0-9 - . _ ~) are decoded, other percent-encodings
+//     have their hex digits uppercased, and any byte that may not appear
+//     literally is percent-encoded, a "%" not starting a valid encoding
+//     included. Reserved characters are never decoded nor encoded, so
+//     "%2F" and "/" stay distinct.
+//
+// Dot segments are left as they are. Urls without "://" are returned as is.
+func CanonicalForwardedUrl(forwardedUrl string) string {
+	i := strings.Index(forwardedUrl, "://")
+	if i < 0 {
+		return forwardedUrl
+	}
+	scheme := strings.ToLower(forwardedUrl[:i])
+	rest := forwardedUrl[i+3:]
+
+	end := strings.IndexAny(rest, "/?#")
+	if end < 0 {
+		end = len(rest)
+	}
+	host := strings.ToLower(rest[:end])
+	rest = rest[end:]
+
+	switch scheme {
+	case "http":
+		host = strings.TrimSuffix(host, ":80")
+	case "https":
+		host = strings.TrimSuffix(host, ":443")
+	}
+
+	var query, fragment string
+	hasQuery, hasFragment := false, false
+	if j := strings.Index(rest, "#"); j >= 0 {
+		rest, fragment, hasFragment = rest[:j], rest[j+1:], true
+	}
+	if j := strings.Index(rest, "?"); j >= 0 {
+		rest, query, hasQuery = rest[:j], rest[j+1:], true
+	}
+	path := rest
+	if path == "" {
+		path = "/"
+	}
+
+	canonical := scheme + "://" + host + normalizeEncoding(path, "/")
+	if hasQuery {
+		canonical += "?" + normalizeEncoding(query, "/?")
+	}
+	if hasFragment {
+		canonical += "#" + normalizeEncoding(fragment, "/?")
+	}
+	return canonical
+}
+
+const upperHex = "0123456789ABCDEF"
+
+// normalizeEncoding applies the percent-encoding rules of
+// CanonicalForwardedUrl to a path, query or fragment, in which the
+// characters in extra may appear literally as well as pchars.
+func normalizeEncoding(s, extra string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			decoded := unhex(s[i+1])<<4 | unhex(s[i+2])
+			if isUnreserved(decoded) {
+				b.WriteByte(decoded)
+			} else {
+				b.WriteByte('%')
+				b.WriteByte(upperHex[decoded>>4])
+				b.WriteByte(upperHex[decoded&15])
+			}
+			i += 2
+			continue
+		}
+		if isPchar(c) || strings.IndexByte(extra, c) >= 0 {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperHex[c>>4])
+		b.WriteByte(upperHex[c&15])
+	}
+	return b.String()
+}
+
+func isUnreserved(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' ||
+		c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+func isPchar(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte("!$&'()*+,;=:@", c) >= 0
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
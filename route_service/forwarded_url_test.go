@@ -0,0 +1,54 @@
+package route_service_test
+
+import (
+	"github.com/cloudfoundry/gorouter/route_service"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("CanonicalForwardedUrl", func() {
+	It("normalizes case, default ports and percent-encoding", func() {
+		Expect(route_service.CanonicalForwardedUrl("HTTP://My_Host.COM:80/a%7eb/%2f/caf%c3%a9/\xc3\xbc?q=%41%2b+x&y=%zz#Frag%3a")).To(
+			Equal("http://my_host.com/a~b/%2F/caf%C3%A9/%C3%BC?q=A%2B+x&y=%25zz#Frag%3A"))
+	})
+
+	It("produces the same form for equivalent spellings", func() {
+		spellings := []string{
+			"https://my_host.com/~user/a b?x=%2F",
+			"https://MY_HOST.com:443/%7Euser/a%20b?x=%2f",
+			"HTTPS://my_host.com:443/%7euser/a%20b?x=%2F",
+		}
+		for _, u := range spellings {
+			Expect(route_service.CanonicalForwardedUrl(u)).To(Equal("https://my_host.com/~user/a%20b?x=%2F"), u)
+		}
+	})
+
+	It("is stable", func() {
+		for _, u := range []string{
+			"http://my_host.com/resource+9-9_9?query=123&query$2=345#page1..5",
+			"http://My_Host.com:8080/%e2%82%ac/%2F?a=%3d%3D&b=%#%",
+		} {
+			canonical := route_service.CanonicalForwardedUrl(u)
+			Expect(route_service.CanonicalForwardedUrl(canonical)).To(Equal(canonical), u)
+		}
+	})
+
+	It("keeps reserved characters as they are", func() {
+		u := "http://my_host.com/a:b@c/d;e=f?g=h&i/j?k#l/m?n"
+		Expect(route_service.CanonicalForwardedUrl(u)).To(Equal(u))
+	})
+
+	It("keeps ports other than the scheme default", func() {
+		Expect(route_service.CanonicalForwardedUrl("http://my_host.com:443/")).To(Equal("http://my_host.com:443/"))
+		Expect(route_service.CanonicalForwardedUrl("https://[::1]:8443/")).To(Equal("https://[::1]:8443/"))
+		Expect(route_service.CanonicalForwardedUrl("https://[::1]:443/")).To(Equal("https://[::1]/"))
+	})
+
+	It("adds an empty path", func() {
+		Expect(route_service.CanonicalForwardedUrl("http://my_host.com?query=123")).To(Equal("http://my_host.com/?query=123"))
+	})
+
+	It("leaves strings that are not urls alone", func() {
+		Expect(route_service.CanonicalForwardedUrl("my_host.com/%7e")).To(Equal("my_host.com/%7e"))
+	})
+})
@@ -1,36 +1,179 @@
 package route_service
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"time"
 
 	"github.com/cloudfoundry/gorouter/common/secure"
+	"github.com/cloudfoundry/gorouter/internal/cryptobuf"
 )
 
 type Signature struct {
 	ForwardedUrl  string    `json:"forwarded_url"`
 	RequestedTime time.Time `json:"requested_time"`
+
+	// Optionally binds the signature to the application it was minted for.
+	AppGuid string `json:"app_guid,omitempty"`
+
+	// Optionally carries the key of the route the request matched.
+	RouteKey string `json:"route_key,omitempty"`
+
+	// Optionally carries the address the router received the request from,
+	// for route services that act on it without trusting a header.
+	ClientIP string `json:"client_ip,omitempty"`
+
+	// Optionally sets when the signature expires, in place of the validity
+	// window of the router validating it, be it shorter or longer.
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	// Optionally names the router that minted the signature, for tracing
+	// signatures back to it. It is carried, not validated.
+	Issuer string `json:"issuer,omitempty"`
+}
+
+// Validity is the window the signature is valid for from its RequestedTime:
+// up to ExpiresAt when it is set, validity otherwise.
+func (s *Signature) Validity(validity time.Duration) time.Duration {
+	if s.ExpiresAt != nil {
+		return s.ExpiresAt.Sub(s.RequestedTime)
+	}
+	return validity
+}
+
+// IsExpired reports whether the signature has expired at now, for a router
+// with the given validity window. It is still valid at the very end of the
+// window. Route services checking signatures themselves should use it so as
+// to agree with the router.
+func (s *Signature) IsExpired(now time.Time, validity time.Duration) bool {
+	return now.Sub(s.RequestedTime) > s.Validity(validity)
 }
 
 type Metadata struct {
-	Nonce []byte `json:"nonce"`
+	// Nonce is the one the signature was encrypted with and is needed to
+	// decrypt it; every router has always sent it. It is not a replay token,
+	// so metadata without one cannot be validated.
+	Nonce      []byte `json:"nonce"`
+	Version    int    `json:"version,omitempty"`
+	Compressed bool   `json:"compressed,omitempty"`
+
+	// Bound signatures are sealed with the route key as associated data
+	// rather than carrying it, so that they only decrypt for that route.
+	Bound bool `json:"bound,omitempty"`
+}
+
+const (
+	// Metadata without a version predates compression and is read as such.
+	metadataVersion = 1
+
+	// Bounds the gunzipped signature; anything larger was not minted by a
+	// router.
+	maxDecompressedSignatureLen = 64 * 1024
+)
+
+// RouteServiceUnsupportedVersion is returned for metadata of a version this
+// router does not understand, typically minted by a newer router in a fleet
+// that is part way through an upgrade.
+type RouteServiceUnsupportedVersion struct {
+	Version          int
+	SupportedVersion int
 }
 
+func (e RouteServiceUnsupportedVersion) Error() string {
+	return fmt.Sprintf("Unsupported route service metadata version: %d, supports up to %d", e.Version, e.SupportedVersion)
+}
+
+var signatureTooLarge = errors.New("Route service signature too large")
+
+// Signer mints the signature and metadata headers sent to route services. It
+// allows minting to be delegated, e.g. to a signing service, so that the
+// router does not need to hold the key itself.
+type Signer interface {
+	Sign(signature *Signature) (string, string, error)
+}
+
+// CryptoSigner mints signatures locally with Crypto. It is the default
+// Signer.
+type CryptoSigner struct {
+	Crypto secure.Crypto
+	BuildOptions
+}
+
+func (s CryptoSigner) Sign(signature *Signature) (string, string, error) {
+	return BuildSignatureAndMetadataWithOptions(s.Crypto, signature, s.BuildOptions)
+}
+
+// BuildOptions change how BuildSignatureAndMetadataWithOptions builds the
+// headers. The zero value builds them as BuildSignatureAndMetadata does.
+type BuildOptions struct {
+	// Gzips the signature before encrypting it when its JSON encoding is
+	// longer than this many bytes, and flags this in the metadata. Zero
+	// disables compression.
+	CompressionThreshold int
+
+	// The encoding of both headers. Nil is base64.URLEncoding.
+	Encoding *base64.Encoding
+
+	// Seals the signature with its RouteKey as associated data instead of
+	// carrying it, so that tampering with the route breaks decryption rather
+	// than a comparison. It then only decodes with
+	// SignatureFromEncodedHeadersForRoute given the same route key.
+	// Signatures without a RouteKey are built unbound.
+	BindRouteKey bool
+}
+
+// BuildSignatureAndMetadata signs signature as given. Its RequestedTime is
+// never replaced by the current time, so that a router validating the
+// signature against a shared clock sees exactly the time it was built with.
 func BuildSignatureAndMetadata(crypto secure.Crypto, signature *Signature) (string, string, error) {
+	return BuildSignatureAndMetadataWithOptions(crypto, signature, BuildOptions{})
+}
+
+// BuildSignatureAndMetadataWithOptions is BuildSignatureAndMetadata built as
+// opts say.
+func BuildSignatureAndMetadataWithOptions(crypto secure.Crypto, signature *Signature, opts BuildOptions) (string, string, error) {
+	var routeKey string
+	if opts.BindRouteKey && signature.RouteKey != "" {
+		routeKey = signature.RouteKey
+		unbound := *signature
+		unbound.RouteKey = ""
+		signature = &unbound
+	}
+
 	signatureJson, err := json.Marshal(&signature)
 	if err != nil {
 		return "", "", err
 	}
 
-	signatureJsonEncrypted, nonce, err := crypto.Encrypt(signatureJson)
+	compressed := opts.CompressionThreshold > 0 && len(signatureJson) > opts.CompressionThreshold
+	if compressed {
+		signatureJson, err = compress(signatureJson)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	buf := cryptobuf.Get()
+	defer cryptobuf.Put(buf)
+
+	signatureJsonEncrypted, nonce, err := encrypt(crypto, buf, signatureJson, routeKey)
 	if err != nil {
 		return "", "", err
 	}
 
 	metadata := Metadata{
-		Nonce: nonce,
+		Nonce:      nonce,
+		Version:    metadataVersion,
+		Compressed: compressed,
+		Bound:      routeKey != "",
 	}
 
 	metadataJson, err := json.Marshal(&metadata)
@@ -38,13 +181,26 @@ func BuildSignatureAndMetadata(crypto secure.Crypto, signature *Signature) (stri
 		return "", "", err
 	}
 
-	metadataHeader := base64.URLEncoding.EncodeToString(metadataJson)
-	signatureHeader := base64.URLEncoding.EncodeToString(signatureJsonEncrypted)
+	metadataHeader := encodeHeader(metadataJson, opts.Encoding)
+	signatureHeader := encodeHeader(signatureJsonEncrypted, opts.Encoding)
 
 	return signatureHeader, metadataHeader, nil
 }
 
 func SignatureFromHeaders(signatureHeader, metadataHeader string, crypto secure.Crypto) (Signature, error) {
+	return SignatureFromEncodedHeaders(signatureHeader, metadataHeader, crypto, nil)
+}
+
+// SignatureFromEncodedHeaders is SignatureFromHeaders for headers base64
+// encoded with encoding. Nil is base64.URLEncoding.
+func SignatureFromEncodedHeaders(signatureHeader, metadataHeader string, crypto secure.Crypto, encoding *base64.Encoding) (Signature, error) {
+	return SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, crypto, encoding, "")
+}
+
+// SignatureFromEncodedHeadersForRoute is SignatureFromEncodedHeaders that
+// also decodes signatures bound to routeKey, and sets it as their RouteKey.
+// Bound signatures fail to decrypt for any other route key, or without one.
+func SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader string, crypto secure.Crypto, encoding *base64.Encoding, routeKey string) (Signature, error) {
 	metadata := Metadata{}
 	signature := Signature{}
 
@@ -52,23 +208,178 @@ func SignatureFromHeaders(signatureHeader, metadataHeader string, crypto secure.
 		return signature, errors.New("No metadata found")
 	}
 
-	metadataDecoded, err := base64.URLEncoding.DecodeString(metadataHeader)
+	scratch := cryptobuf.Get()
+	defer cryptobuf.Put(scratch)
+
+	metadataDecoded, err := decodeHeader(metadataHeader, scratch, encoding)
 	if err != nil {
 		return signature, err
 	}
 
 	err = json.Unmarshal(metadataDecoded, &metadata)
-	signatureDecoded, err := base64.URLEncoding.DecodeString(signatureHeader)
 	if err != nil {
 		return signature, err
 	}
 
-	signatureDecrypted, err := crypto.Decrypt(signatureDecoded, metadata.Nonce)
+	if metadata.Version > metadataVersion {
+		return signature, RouteServiceUnsupportedVersion{Version: metadata.Version, SupportedVersion: metadataVersion}
+	}
+
+	signatureDecoded, err := decodeHeader(signatureHeader, scratch, encoding)
+	if err != nil {
+		return signature, err
+	}
+
+	boundTo := ""
+	if metadata.Bound {
+		boundTo = routeKey
+	}
+
+	buf := cryptobuf.Get()
+	defer cryptobuf.Put(buf)
+
+	signatureDecrypted, err := decrypt(crypto, buf, signatureDecoded, metadata.Nonce, boundTo)
 	if err != nil {
 		return signature, err
 	}
 
-	err = json.Unmarshal([]byte(signatureDecrypted), &signature)
+	if metadata.Compressed {
+		signatureDecrypted, err = decompress(signatureDecrypted)
+		if err != nil {
+			return signature, err
+		}
+	}
+
+	err = json.Unmarshal(signatureDecrypted, &signature)
+	if err == nil && metadata.Bound {
+		signature.RouteKey = routeKey
+	}
 
 	return signature, err
 }
+
+// RoundTrip builds the headers for signature and decodes them again with the
+// same crypto, returning the decoded signature. It lets tooling check that a
+// key can both mint and read signatures without making a request.
+func RoundTrip(crypto secure.Crypto, signature *Signature) (*Signature, error) {
+	signatureHeader, metadataHeader, err := BuildSignatureAndMetadata(crypto, signature)
+	if err != nil {
+		return nil, err
+	}
+
+	decoded, err := SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+	if err != nil {
+		return nil, err
+	}
+	return &decoded, nil
+}
+
+func compress(src []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	_, err := w.Write(src)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func decompress(src []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(src))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	dst, err := ioutil.ReadAll(io.LimitReader(r, maxDecompressedSignatureLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(dst) > maxDecompressedSignatureLen {
+		return nil, signatureTooLarge
+	}
+
+	return dst, nil
+}
+
+// VerifyForwardedUrl checks that the forwarded url echoed back by a route
+// service matches the one the router signed. The urls are hashed to the same
+// length first so that the comparison takes the same time wherever they
+// differ.
+func VerifyForwardedUrl(signature *Signature, forwardedUrl string) error {
+	expected := sha256.Sum256([]byte(signature.ForwardedUrl))
+	actual := sha256.Sum256([]byte(forwardedUrl))
+	if subtle.ConstantTimeCompare(expected[:], actual[:]) != 1 {
+		return RouteServiceForwardedUrlMismatch
+	}
+	return nil
+}
+
+// encrypt seals into buf where crypto supports it; the result is then only
+// valid until buf goes back to the pool. Signatures bound to a route key are
+// sealed with it as associated data.
+func encrypt(crypto secure.Crypto, buf *[]byte, plainText []byte, routeKey string) ([]byte, []byte, error) {
+	if sealer := cryptobuf.SealerFor(crypto); sealer != nil {
+		var aad []byte
+		if routeKey != "" {
+			aad = []byte(routeKey)
+		}
+		return sealer.EncryptInto(buf, plainText, aad)
+	}
+
+	if routeKey != "" {
+		return crypto.EncryptWithAAD(plainText, []byte(routeKey))
+	}
+	return crypto.Encrypt(plainText)
+}
+
+// decrypt is the counterpart of encrypt.
+func decrypt(crypto secure.Crypto, buf *[]byte, cipherText, nonce []byte, routeKey string) ([]byte, error) {
+	if sealer := cryptobuf.SealerFor(crypto); sealer != nil {
+		var aad []byte
+		if routeKey != "" {
+			aad = []byte(routeKey)
+		}
+		return sealer.DecryptInto(buf, cipherText, nonce, aad)
+	}
+
+	if routeKey != "" {
+		return crypto.DecryptWithAAD(cipherText, nonce, []byte(routeKey))
+	}
+	return crypto.Decrypt(cipherText, nonce)
+}
+
+func headerEncoding(encoding *base64.Encoding) *base64.Encoding {
+	if encoding == nil {
+		return base64.URLEncoding
+	}
+	return encoding
+}
+
+func encodeHeader(src []byte, encoding *base64.Encoding) string {
+	encoding = headerEncoding(encoding)
+
+	scratch := cryptobuf.Get()
+	defer cryptobuf.Put(scratch)
+
+	dst := cryptobuf.Grow(scratch, encoding.EncodedLen(len(src)))
+	encoding.Encode(dst, src)
+	return string(dst)
+}
+
+// decodeHeader decodes into the scratch buffer, so the result is only valid
+// until the scratch buffer is reused.
+func decodeHeader(header string, scratch *[]byte, encoding *base64.Encoding) ([]byte, error) {
+	encoding = headerEncoding(encoding)
+
+	dst := cryptobuf.Grow(scratch, encoding.DecodedLen(len(header)))
+	n, err := encoding.Decode(dst, []byte(header))
+	return dst[:n], err
+}
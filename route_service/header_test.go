@@ -1,12 +1,15 @@
 package route_service_test
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"strings"
+	"testing"
 	"time"
 
+	"github.com/cloudfoundry/gorouter/common/secure"
 	"github.com/cloudfoundry/gorouter/common/secure/fakes"
 	"github.com/cloudfoundry/gorouter/route_service"
 	. "github.com/onsi/ginkgo"
@@ -80,6 +83,452 @@ var _ = Describe("Route Service Header", func() {
 			Expect(err).ToNot(HaveOccurred())
 			Expect(signature.RequestedTime.Sub(decryptedSignature.RequestedTime)).To(Equal(time.Duration(0)))
 		})
+
+		Context("when the metadata is not valid json", func() {
+			BeforeEach(func() {
+				metadataHeader = base64.URLEncoding.EncodeToString([]byte(`{"nonce":`))
+			})
+
+			It("returns an error without decrypting", func() {
+				_, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the metadata nonce is the wrong size for the cipher", func() {
+			var aesGcm secure.Crypto
+
+			BeforeEach(func() {
+				var err error
+				aesGcm, err = secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+				Expect(err).ToNot(HaveOccurred())
+
+				signatureHeader, _, err = route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+				metadataHeader = base64.URLEncoding.EncodeToString([]byte(`{"nonce":"c2hvcnQ="}`))
+			})
+
+			It("returns an error", func() {
+				_, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, aesGcm)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the metadata has no nonce", func() {
+			It("returns an error, as the signature cannot be decrypted", func() {
+				aesGcm, err := secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+				Expect(err).ToNot(HaveOccurred())
+
+				signatureHeader, _, err = route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, metadata := range []string{`{}`, `{"nonce":null}`, `{"version":1}`} {
+					metadataHeader = base64.URLEncoding.EncodeToString([]byte(metadata))
+					_, err = route_service.SignatureFromHeaders(signatureHeader, metadataHeader, aesGcm)
+					Expect(err).To(HaveOccurred())
+				}
+			})
+		})
+
+		Context("when the signature is truncated", func() {
+			It("returns an error", func() {
+				aesGcm, err := secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+				Expect(err).ToNot(HaveOccurred())
+
+				signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, truncated := range []string{"", signatureHeader[:4], signatureHeader[:len(signatureHeader)-4]} {
+					_, err = route_service.SignatureFromHeaders(truncated, metadataHeader, aesGcm)
+					Expect(err).To(HaveOccurred())
+				}
+			})
+		})
+	})
+
+	Describe("Compressed signatures", func() {
+		var aesGcm secure.Crypto
+
+		decodeMetadata := func(metadataHeader string) route_service.Metadata {
+			metadataDecoded, err := base64.URLEncoding.DecodeString(metadataHeader)
+			Expect(err).ToNot(HaveOccurred())
+			metadata := route_service.Metadata{}
+			Expect(json.Unmarshal(metadataDecoded, &metadata)).To(Succeed())
+			return metadata
+		}
+
+		BeforeEach(func() {
+			var err error
+			aesGcm, err = secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		Context("when the signature is over the threshold", func() {
+			BeforeEach(func() {
+				signature.ForwardedUrl = "http://my_host.com/" + strings.Repeat("resource/", 200)
+			})
+
+			It("compresses it and round trips", func() {
+				signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(aesGcm, signature, route_service.BuildOptions{CompressionThreshold: 256})
+				Expect(err).ToNot(HaveOccurred())
+
+				metadata := decodeMetadata(metadataHeader)
+				Expect(metadata.Compressed).To(BeTrue())
+				Expect(metadata.Version).To(Equal(1))
+
+				uncompressedHeader, _, err := route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(len(signatureHeader)).To(BeNumerically("<", len(uncompressedHeader)))
+
+				decryptedSignature, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, aesGcm)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decryptedSignature.ForwardedUrl).To(Equal(signature.ForwardedUrl))
+				Expect(decryptedSignature.RequestedTime.Equal(signature.RequestedTime)).To(BeTrue())
+			})
+		})
+
+		Context("when the signature is under the threshold", func() {
+			BeforeEach(func() {
+				signature.ForwardedUrl = "http://my_host.com/resource"
+			})
+
+			It("does not compress it and round trips", func() {
+				signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(aesGcm, signature, route_service.BuildOptions{CompressionThreshold: 256})
+				Expect(err).ToNot(HaveOccurred())
+
+				metadata := decodeMetadata(metadataHeader)
+				Expect(metadata.Compressed).To(BeFalse())
+
+				decryptedSignature, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, aesGcm)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decryptedSignature.ForwardedUrl).To(Equal(signature.ForwardedUrl))
+			})
+		})
+
+		Context("when the metadata has an unknown version", func() {
+			It("returns an error", func() {
+				signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+
+				metadata := decodeMetadata(metadataHeader)
+				metadata.Version = 2
+				metadataJson, err := json.Marshal(&metadata)
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = route_service.SignatureFromHeaders(signatureHeader, base64.URLEncoding.EncodeToString(metadataJson), aesGcm)
+				Expect(err).To(Equal(route_service.RouteServiceUnsupportedVersion{Version: 2, SupportedVersion: 1}))
+			})
+		})
+
+		Context("when metadata without a version is received", func() {
+			It("reads it as uncompressed", func() {
+				signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+
+				metadata := decodeMetadata(metadataHeader)
+				metadataJson, err := json.Marshal(map[string][]byte{"nonce": metadata.Nonce})
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = route_service.SignatureFromHeaders(signatureHeader, base64.URLEncoding.EncodeToString(metadataJson), aesGcm)
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("with another base64 encoding", func() {
+		encodings := map[string]*base64.Encoding{
+			"std":     base64.StdEncoding,
+			"url":     base64.URLEncoding,
+			"raw url": base64.RawURLEncoding,
+		}
+
+		for name, encoding := range encodings {
+			encoding := encoding
+
+			It("round trips with "+name+" encoding", func() {
+				signature.ForwardedUrl = "http://my_host.com/resource?a=b"
+
+				signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(crypto, signature, route_service.BuildOptions{Encoding: encoding})
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = encoding.DecodeString(metadataHeader)
+				Expect(err).ToNot(HaveOccurred())
+
+				decoded, err := route_service.SignatureFromEncodedHeaders(signatureHeader, metadataHeader, crypto, encoding)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(decoded.ForwardedUrl).To(Equal(signature.ForwardedUrl))
+			})
+		}
+
+		It("rejects headers built with another encoding", func() {
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(crypto, signature, route_service.BuildOptions{Encoding: base64.RawURLEncoding})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+			Expect(err).To(HaveOccurred())
+
+			signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = route_service.SignatureFromEncodedHeaders(signatureHeader, metadataHeader, crypto, base64.RawURLEncoding)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("with a fixed random source", func() {
+		It("builds the same headers every time", func() {
+			signature := &route_service.Signature{
+				ForwardedUrl:  "http://my_host.com/resource",
+				RequestedTime: time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC),
+			}
+
+			for i := 0; i < 2; i++ {
+				aesGcm, err := secure.NewAesGCMWithRandom([]byte("ABCDEFGHIJKLMNOP"), bytes.NewReader(bytes.Repeat([]byte{0x2a}, 12)))
+				Expect(err).ToNot(HaveOccurred())
+
+				signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(aesGcm, signature)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signatureHeader).To(Equal("298jV7LgxSvr1-AwZdsjpUNh2WAlR4FRnxWKNhQo1wasqFJ-rRFqaMX9YwEQsC7g1xqPr43tOIRVESQ6zKUL56cGVzwKw7wK8Znt4jpt47uft7DN2P8mNdOC3OKoTJpdp36jYTzY8A=="))
+				Expect(metadataHeader).To(Equal("eyJub25jZSI6Iktpb3FLaW9xS2lvcUtpb3EiLCJ2ZXJzaW9uIjoxfQ=="))
+			}
+		})
+	})
+
+	Describe("RoundTrip", func() {
+		BeforeEach(func() {
+			signature.ForwardedUrl = "http://my_host.com/resource"
+			signature.AppGuid = "app-guid"
+		})
+
+		It("returns the signature decoded from the headers built for it", func() {
+			aesGcm, err := secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+			Expect(err).ToNot(HaveOccurred())
+
+			decoded, err := route_service.RoundTrip(aesGcm, signature)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.ForwardedUrl).To(Equal(signature.ForwardedUrl))
+			Expect(decoded.AppGuid).To(Equal(signature.AppGuid))
+			Expect(decoded.RequestedTime.Equal(signature.RequestedTime)).To(BeTrue())
+		})
+
+		Context("when the crypto cannot encrypt", func() {
+			BeforeEach(func() {
+				crypto.EncryptReturns(nil, nil, errors.New("No entropy"))
+			})
+
+			It("returns the error", func() {
+				_, err := route_service.RoundTrip(crypto, signature)
+				Expect(err).To(MatchError("No entropy"))
+			})
+		})
+
+		Context("when the crypto cannot decrypt what it encrypted", func() {
+			It("returns an error", func() {
+				broken := new(fakes.FakeCrypto)
+				broken.EncryptReturns([]byte("cipher"), []byte("nonce"), nil)
+				broken.DecryptReturns(nil, errors.New("authentication failed"))
+
+				_, err := route_service.RoundTrip(broken, signature)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Bound signatures", func() {
+		var (
+			aesGcm secure.Crypto
+			hmac   secure.Crypto
+		)
+
+		BeforeEach(func() {
+			var err error
+			aesGcm, err = secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+			Expect(err).ToNot(HaveOccurred())
+			hmac, err = secure.NewHMACSigner([]byte("ABCDEFGHIJKLMNOP"))
+			Expect(err).ToNot(HaveOccurred())
+
+			signature.ForwardedUrl = "http://my_host.com/resource"
+			signature.RouteKey = "my_host.com/resource"
+		})
+
+		for _, mode := range []string{"aes-gcm", "hmac"} {
+			mode := mode
+
+			Context("with "+mode, func() {
+				var c secure.Crypto
+
+				BeforeEach(func() {
+					c = aesGcm
+					if mode == "hmac" {
+						c = hmac
+					}
+				})
+
+				It("decodes them for the route they are bound to, which they do not carry", func() {
+					signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(c, signature, route_service.BuildOptions{BindRouteKey: true})
+					Expect(err).ToNot(HaveOccurred())
+
+					signatureDecoded, err := base64.URLEncoding.DecodeString(signatureHeader)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(string(signatureDecoded)).NotTo(ContainSubstring("route_key"))
+
+					decoded, err := route_service.SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, c, nil, "my_host.com/resource")
+					Expect(err).ToNot(HaveOccurred())
+					Expect(decoded.ForwardedUrl).To(Equal(signature.ForwardedUrl))
+					Expect(decoded.RouteKey).To(Equal("my_host.com/resource"))
+				})
+
+				It("fails to decrypt them for another route", func() {
+					signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(c, signature, route_service.BuildOptions{BindRouteKey: true})
+					Expect(err).ToNot(HaveOccurred())
+
+					_, err = route_service.SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, c, nil, "my_host.com/other")
+					Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+				})
+
+				It("fails to decrypt them without a route", func() {
+					signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(c, signature, route_service.BuildOptions{BindRouteKey: true})
+					Expect(err).ToNot(HaveOccurred())
+
+					_, err = route_service.SignatureFromHeaders(signatureHeader, metadataHeader, c)
+					Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+				})
+			})
+		}
+
+		It("keeps the route key of the signature it was given", func() {
+			_, _, err := route_service.BuildSignatureAndMetadataWithOptions(aesGcm, signature, route_service.BuildOptions{BindRouteKey: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.RouteKey).To(Equal("my_host.com/resource"))
+		})
+
+		It("builds signatures without a route key unbound", func() {
+			signature.RouteKey = ""
+
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(aesGcm, signature, route_service.BuildOptions{BindRouteKey: true})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = route_service.SignatureFromHeaders(signatureHeader, metadataHeader, aesGcm)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("combines with the other build options", func() {
+			signature.ForwardedUrl = "http://my_host.com/" + strings.Repeat("a", 512)
+			opts := route_service.BuildOptions{
+				CompressionThreshold: 256,
+				Encoding:             base64.RawURLEncoding,
+				BindRouteKey:         true,
+			}
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadataWithOptions(aesGcm, signature, opts)
+			Expect(err).ToNot(HaveOccurred())
+
+			metadataDecoded, err := base64.RawURLEncoding.DecodeString(metadataHeader)
+			Expect(err).ToNot(HaveOccurred())
+			var metadata route_service.Metadata
+			Expect(json.Unmarshal(metadataDecoded, &metadata)).To(Succeed())
+			Expect(metadata.Compressed).To(BeTrue())
+			Expect(metadata.Bound).To(BeTrue())
+
+			decoded, err := route_service.SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, aesGcm, base64.RawURLEncoding, "my_host.com/resource")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.ForwardedUrl).To(Equal(signature.ForwardedUrl))
+		})
+
+		It("decodes unbound signatures for any route", func() {
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(aesGcm, signature)
+			Expect(err).ToNot(HaveOccurred())
+
+			decoded, err := route_service.SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, aesGcm, nil, "my_host.com/other")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded.RouteKey).To(Equal("my_host.com/resource"))
+		})
+	})
+
+	Describe("VerifyForwardedUrl", func() {
+		BeforeEach(func() {
+			signature.ForwardedUrl = "http://my_host.com/resource?query=123"
+		})
+
+		It("accepts a forwarded url that matches the signature", func() {
+			err := route_service.VerifyForwardedUrl(signature, "http://my_host.com/resource?query=123")
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects a forwarded url that differs from the signature", func() {
+			err := route_service.VerifyForwardedUrl(signature, "http://my_host.com/other")
+			Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+		})
+
+		It("rejects a forwarded url of the same length that differs", func() {
+			err := route_service.VerifyForwardedUrl(signature, "http://my_host.com/resource?query=124")
+			Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+		})
+
+		It("rejects a forwarded url that only extends the signed one", func() {
+			err := route_service.VerifyForwardedUrl(signature, "http://my_host.com/resource?query=1234")
+			Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+		})
+
+		It("rejects a missing forwarded url", func() {
+			err := route_service.VerifyForwardedUrl(signature, "")
+			Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+		})
+	})
+
+	Describe("IsExpired", func() {
+		var requested = time.Date(2016, time.January, 1, 12, 0, 0, 0, time.UTC)
+
+		BeforeEach(func() {
+			signature.RequestedTime = requested
+		})
+
+		It("is valid up to the very end of the validity window", func() {
+			Expect(signature.IsExpired(requested, time.Hour)).To(BeFalse())
+			Expect(signature.IsExpired(requested.Add(time.Hour), time.Hour)).To(BeFalse())
+			Expect(signature.IsExpired(requested.Add(time.Hour+time.Nanosecond), time.Hour)).To(BeTrue())
+		})
+
+		Context("when the signature sets when it expires", func() {
+			BeforeEach(func() {
+				expiresAt := requested.Add(5 * time.Minute)
+				signature.ExpiresAt = &expiresAt
+			})
+
+			It("is valid up to ExpiresAt in place of the validity window", func() {
+				Expect(signature.Validity(time.Hour)).To(Equal(5 * time.Minute))
+				Expect(signature.IsExpired(requested.Add(5*time.Minute), time.Hour)).To(BeFalse())
+				Expect(signature.IsExpired(requested.Add(5*time.Minute+time.Nanosecond), time.Hour)).To(BeTrue())
+			})
+
+			It("may outlast the validity window", func() {
+				Expect(signature.IsExpired(requested.Add(5*time.Minute), time.Minute)).To(BeFalse())
+			})
+		})
 	})
 
 })
+
+func FuzzSignatureFromHeaders(f *testing.F) {
+	crypto, err := secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(crypto, &route_service.Signature{
+		ForwardedUrl:  "http://my_host.com/resource?query=123",
+		RequestedTime: time.Now(),
+	})
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(signatureHeader, metadataHeader)
+	f.Add(signatureHeader, base64.URLEncoding.EncodeToString([]byte(`{"nonce":"c2hvcnQ="}`)))
+	f.Add(signatureHeader[:8], metadataHeader)
+	f.Add("", "")
+	f.Add("not base64!", "not base64!")
+
+	f.Fuzz(func(t *testing.T, signatureHeader, metadataHeader string) {
+		route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+	})
+}
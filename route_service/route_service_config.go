@@ -1,11 +1,21 @@
 package route_service
 
 import (
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"net"
 	"net/http"
 	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/cloudfoundry/dropsonde/metrics"
+	router_http "github.com/cloudfoundry/gorouter/common/http"
 	"github.com/cloudfoundry/gorouter/common/secure"
 	steno "github.com/cloudfoundry/gosteno"
 )
@@ -14,16 +24,148 @@ const (
 	RouteServiceSignature    = "X-CF-Proxy-Signature"
 	RouteServiceForwardedUrl = "X-CF-Forwarded-Url"
 	RouteServiceMetadata     = "X-CF-Proxy-Metadata"
+
+	// The signed route key, repeated in the clear for the route service.
+	RouteServiceRouteKey = "X-CF-Route-Key"
+
+	// The signed client ip, repeated in the clear for the route service.
+	RouteServiceClientIP = "X-CF-Client-IP"
+
+	// How many milliseconds the route service has left to send the request
+	// back before its signature expires.
+	RouteServiceTimeoutMs = "X-Cf-RouteService-Timeout-Ms"
+
+	// How many times the request has been sent to a route service, counting
+	// the current one. Only sent when a maximum is set.
+	RouteServiceHops = "X-Cf-RouteService-Hops"
+
+	// Tells the backend that the signature had expired and was only accepted
+	// within the expiry grace.
+	RouteServiceSoftExpired = "X-Cf-RouteService-Soft-Expired"
 )
 
-var RouteServiceExpired = errors.New("Route service request expired")
+const (
+	DefaultMaxForwardedUrlLength = 8 * 1024
+
+	// Room in the signature for the claims other than the forwarded url and
+	// for the authentication tag.
+	maxSignatureOverhead = 1024
+)
+
+// RouteServiceExpiredError records when an expired signature was minted, the
+// validity window it was checked against and the time of the check.
+type RouteServiceExpiredError struct {
+	RequestedTime time.Time
+	Validity      time.Duration
+	Now           time.Time
+}
+
+func (e RouteServiceExpiredError) Error() string {
+	return fmt.Sprintf("Route service request expired: signed at %s, window %s, now %s",
+		e.RequestedTime.Format(time.RFC3339Nano), e.Validity, e.Now.Format(time.RFC3339Nano))
+}
+
+// RouteServiceAppGuidMismatchError is returned when a signature bound to one
+// application is presented on a request for another.
+type RouteServiceAppGuidMismatchError struct {
+	SignedAppGuid   string
+	ExpectedAppGuid string
+}
+
+func (e RouteServiceAppGuidMismatchError) Error() string {
+	return fmt.Sprintf("Route service signature is for app %s, not %s", e.SignedAppGuid, e.ExpectedAppGuid)
+}
+
+// RouteServiceMissingSignatureError is returned for a metadata header sent
+// without the signature header it belongs with.
+type RouteServiceMissingSignatureError struct {
+	SignatureHeader string
+}
+
+func (e RouteServiceMissingSignatureError) Error() string {
+	return fmt.Sprintf("Route service metadata sent without a %s header", e.SignatureHeader)
+}
+
+// RouteServiceTooManyHopsError is returned for a request that has already
+// been sent to route services as many times as allowed, typically because
+// route services forward to one another in a loop.
+type RouteServiceTooManyHopsError struct {
+	Hops    int
+	MaxHops int
+}
+
+func (e RouteServiceTooManyHopsError) Error() string {
+	return fmt.Sprintf("Route service loop: request has been sent to %d route services, max %d", e.Hops, e.MaxHops)
+}
+
+// RouteServiceInvalidForwardedUrlError is returned for a signature whose own
+// forwarded url does not parse. No router mints one, so the signature is
+// rejected rather than compared.
+type RouteServiceInvalidForwardedUrlError struct {
+	ForwardedUrl string
+	Err          error
+}
+
+func (e RouteServiceInvalidForwardedUrlError) Error() string {
+	return fmt.Sprintf("Route service signed forwarded url is invalid: %s", e.Err)
+}
+
+var RouteServiceExpired = RouteServiceExpiredError{}
 var RouteServiceForwardedUrlMismatch = errors.New("Route service forwarded url mismatch")
+var RouteServiceForwardedUrlTooLong = errors.New("Route service forwarded url too long")
+var RouteServiceHostDenied = errors.New("Route service host is denied")
+
+// Headers the router sets on requests to the backend. They are removed from
+// requests returning from a route service so that it cannot spoof them.
+var DefaultReservedHeaders = []string{
+	router_http.CfAppIdHeader,
+	router_http.CfInstanceIdHeader,
+}
+
+// Hop-by-hop headers (RFC 7230, section 6.1), which are not forwarded to
+// route services. Headers named in Connection are also hop-by-hop.
+var DefaultHopByHopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Proxy-Connection",
+	"TE",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
 
 type RouteServiceConfig struct {
 	routeServiceEnabled bool
+	routeServiceEnforce *int32
 	routeServiceTimeout time.Duration
+	expiryGrace         time.Duration
 	crypto              secure.Crypto
 	cryptoPrev          secure.Crypto
+	signer              Signer
+	hostCrypto          map[string]secure.Crypto
+	reservedHeaders     []string
+	hopByHopHeaders     []string
+	responseHeaders     []string
+	maxForwardedUrlLen  int
+	signatureHeader     string
+	metadataHeader      string
+	forwardedUrlHeader  string
+	compressThreshold   int
+	bindRouteKey        bool
+	stripFragment       bool
+	ignoreDefaultPorts  bool
+	pathExtensions      bool
+	canonicalUrls       bool
+	maxHops             int
+	issuer              string
+	optionalUrlPaths    []string
+	headerEncoding      *base64.Encoding
+	deniedHosts         map[string]bool
+	deniedNets          []*net.IPNet
+	now                 func() time.Time
+	observeSignatureAge func(time.Duration)
 	logger              *steno.Logger
 }
 
@@ -33,15 +175,100 @@ type RouteServiceArgs struct {
 	Signature       string
 	Metadata        string
 	ForwardedUrlRaw string
+	RouteKey        string
+	ClientIP        string
+
+	// When the router received the request. The route service's timeout
+	// budget runs from it; none is sent when it is zero.
+	StartedAt time.Time
+
+	// The hop count to send, see NextHop; none is sent when it is zero.
+	Hops int
 }
 
-func NewRouteServiceConfig(enabled bool, timeout time.Duration, crypto secure.Crypto, cryptoPrev secure.Crypto) *RouteServiceConfig {
+// SignatureOptions are the claims of a signature minted by Generate. Those
+// left empty are not signed.
+type SignatureOptions struct {
+	ForwardedUrlRaw string
+	AppGuid         string
+	RouteKey        string
+	ClientIP        string
+}
+
+// ValidateOptions are what Validate checks a signature against, beyond its
+// validity and forwarded url.
+type ValidateOptions struct {
+	// With BindAppGuid, signatures bound to an application other than AppGuid
+	// are rejected. Those not bound to any are accepted.
+	AppGuid     string
+	BindAppGuid bool
+
+	// The key signatures bound to a route must have been sealed with; those
+	// bound to another route fail to decrypt. See SetBindRouteKey.
+	RouteKey string
+}
+
+// NewRouteServiceConfig fails if route services are enabled without a key to
+// sign with, or with a validity that would expire every signature as soon as
+// it is minted.
+func NewRouteServiceConfig(enabled bool, timeout time.Duration, crypto secure.Crypto, cryptoPrev secure.Crypto) (*RouteServiceConfig, error) {
+	if enabled && crypto == nil {
+		return nil, errors.New("Route services are enabled without a route service key")
+	}
+	if enabled && timeout <= 0 {
+		return nil, fmt.Errorf("Invalid route service validity: %s, must be positive", timeout)
+	}
+
+	// Shared with the configs returned by ForRouteService.
+	enforce := int32(1)
+
 	return &RouteServiceConfig{
 		routeServiceEnabled: enabled,
+		routeServiceEnforce: &enforce,
 		routeServiceTimeout: timeout,
 		crypto:              crypto,
 		cryptoPrev:          cryptoPrev,
+		reservedHeaders:     append([]string{}, DefaultReservedHeaders...),
+		hopByHopHeaders:     append([]string{}, DefaultHopByHopHeaders...),
+		maxForwardedUrlLen:  DefaultMaxForwardedUrlLength,
+		signatureHeader:     RouteServiceSignature,
+		metadataHeader:      RouteServiceMetadata,
+		forwardedUrlHeader:  RouteServiceForwardedUrl,
+		deniedHosts:         map[string]bool{},
+		now:                 time.Now,
 		logger:              steno.NewLogger("router.proxy.route-service"),
+	}, nil
+}
+
+// NewRouteServiceConfigFromKeys builds the AES-GCM crypto for the current
+// and, if given, previous keys, failing if either is not 16, 24 or 32 bytes.
+func NewRouteServiceConfigFromKeys(enabled bool, validity time.Duration, currentKey, prevKey []byte) (*RouteServiceConfig, error) {
+	var crypto, cryptoPrev secure.Crypto
+	var err error
+
+	if enabled || len(currentKey) > 0 {
+		crypto, err = newAesGCM("route service key", currentKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(prevKey) > 0 {
+		cryptoPrev, err = newAesGCM("previous route service key", prevKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewRouteServiceConfig(enabled, validity, crypto, cryptoPrev)
+}
+
+func newAesGCM(name string, key []byte) (secure.Crypto, error) {
+	switch len(key) {
+	case 16, 24, 32:
+		return secure.NewAesGCM(key)
+	default:
+		return nil, fmt.Errorf("Invalid %s: %d bytes, must be 16, 24 or 32", name, len(key))
 	}
 }
 
@@ -49,70 +276,710 @@ func (rs *RouteServiceConfig) RouteServiceEnabled() bool {
 	return rs.routeServiceEnabled
 }
 
+// Enabled is RouteServiceEnabled, for reporting alongside ValidityDuration.
+func (rs *RouteServiceConfig) Enabled() bool {
+	return rs.routeServiceEnabled
+}
+
+// ValidityDuration is how long a signature is accepted after it was issued.
+func (rs *RouteServiceConfig) ValidityDuration() time.Duration {
+	return rs.routeServiceTimeout
+}
+
+// SetRouteServiceEnforce controls whether requests failing signature
+// validation are rejected. When not enforced, failures are only reported. It
+// may be called while requests are being validated.
+func (rs *RouteServiceConfig) SetRouteServiceEnforce(enforce bool) {
+	var value int32
+	if enforce {
+		value = 1
+	}
+	atomic.StoreInt32(rs.routeServiceEnforce, value)
+}
+
+func (rs *RouteServiceConfig) RouteServiceEnforce() bool {
+	return atomic.LoadInt32(rs.routeServiceEnforce) == 1
+}
+
+// AddReservedHeaders extends the set of headers stripped from requests
+// returning from a route service.
+func (rs *RouteServiceConfig) AddReservedHeaders(headers ...string) {
+	rs.reservedHeaders = append(rs.reservedHeaders, headers...)
+}
+
+func (rs *RouteServiceConfig) StripReservedHeaders(headers *http.Header) {
+	for _, header := range rs.reservedHeaders {
+		headers.Del(header)
+	}
+}
+
+// AddResponseHeaders adds headers to strip from route service responses
+// before they are passed on. None are stripped by default.
+func (rs *RouteServiceConfig) AddResponseHeaders(headers ...string) {
+	rs.responseHeaders = append(rs.responseHeaders, headers...)
+}
+
+func (rs *RouteServiceConfig) StripResponseHeaders(headers *http.Header) {
+	for _, header := range rs.responseHeaders {
+		headers.Del(header)
+	}
+}
+
+// AddHopByHopHeaders extends the set of headers stripped from requests sent
+// to a route service.
+func (rs *RouteServiceConfig) AddHopByHopHeaders(headers ...string) {
+	rs.hopByHopHeaders = append(rs.hopByHopHeaders, headers...)
+}
+
+// StripHopByHopHeaders removes the hop-by-hop headers, including any named in
+// Connection.
+func (rs *RouteServiceConfig) StripHopByHopHeaders(headers *http.Header) {
+	for _, connection := range headers.Values("Connection") {
+		for _, token := range strings.Split(connection, ",") {
+			if token = strings.TrimSpace(token); token != "" {
+				headers.Del(token)
+			}
+		}
+	}
+
+	for _, header := range rs.hopByHopHeaders {
+		headers.Del(header)
+	}
+}
+
+// SetMaxForwardedUrlLength bounds the size in bytes of the forwarded url that
+// is signed, and of the headers accepted back from a route service.
+func (rs *RouteServiceConfig) SetMaxForwardedUrlLength(length int) {
+	rs.maxForwardedUrlLen = length
+}
+
+// SetHeaderNames overrides the names of the headers used to exchange the
+// signature, metadata and forwarded url with route services. Empty names
+// leave the corresponding default in place.
+func (rs *RouteServiceConfig) SetHeaderNames(signature, metadata, forwardedUrl string) {
+	if signature != "" {
+		rs.signatureHeader = signature
+	}
+	if metadata != "" {
+		rs.metadataHeader = metadata
+	}
+	if forwardedUrl != "" {
+		rs.forwardedUrlHeader = forwardedUrl
+	}
+}
+
+func (rs *RouteServiceConfig) SignatureHeader() string {
+	return rs.signatureHeader
+}
+
+func (rs *RouteServiceConfig) MetadataHeader() string {
+	return rs.metadataHeader
+}
+
+func (rs *RouteServiceConfig) ForwardedUrlHeader() string {
+	return rs.forwardedUrlHeader
+}
+
+// SetDeniedHosts configures the hostnames, addresses and CIDR ranges that
+// requests are never forwarded to, whatever route service url is registered.
+func (rs *RouteServiceConfig) SetDeniedHosts(entries []string) error {
+	for _, entry := range entries {
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return err
+			}
+			rs.deniedNets = append(rs.deniedNets, ipNet)
+			continue
+		}
+
+		if ip := net.ParseIP(entry); ip != nil {
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			rs.deniedNets = append(rs.deniedNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		rs.deniedHosts[strings.ToLower(entry)] = true
+	}
+	return nil
+}
+
+// ValidateHost checks a route service host, with or without a port, against
+// the denied hosts. It does not resolve hostnames, which would cost a lookup
+// on every request; the addresses they resolve to are checked by ValidateIP
+// when they are dialed.
+func (rs *RouteServiceConfig) ValidateHost(host string) error {
+	if len(rs.deniedHosts) == 0 && len(rs.deniedNets) == 0 {
+		return nil
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if rs.deniedHosts[strings.ToLower(host)] {
+		return RouteServiceHostDenied
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return rs.ValidateIP(ip)
+	}
+	return nil
+}
+
+// ValidateIP checks an address against the denied CIDR ranges. It is used on
+// the connected address, so that hostnames are checked by what they resolve
+// to when they are dialed.
+func (rs *RouteServiceConfig) ValidateIP(ip net.IP) error {
+	for _, ipNet := range rs.deniedNets {
+		if ipNet.Contains(ip) {
+			rs.logger.Warnd(map[string]interface{}{"ip": ip.String()}, "proxy.route-service.host-denied")
+			return RouteServiceHostDenied
+		}
+	}
+	return nil
+}
+
+// SetCompressionThreshold gzips signatures whose JSON encoding is longer than
+// threshold bytes. Zero, the default, disables compression.
+func (rs *RouteServiceConfig) SetCompressionThreshold(threshold int) {
+	rs.compressThreshold = threshold
+}
+
+// SetBindRouteKey seals the signatures minted for a route with its key as
+// associated data, instead of carrying it as a claim. Requests returning with
+// them only validate given the same route key in ValidateOptions.
+// It does not apply to signatures minted by a signer set with SetSigner.
+func (rs *RouteServiceConfig) SetBindRouteKey(bind bool) {
+	rs.bindRouteKey = bind
+}
+
+// SetStripForwardedUrlFragment leaves the fragment of the forwarded url out of
+// the signature and out of its validation. Browsers do not send fragments, so
+// route services rebuilding the url from the request they receive lose it.
+func (rs *RouteServiceConfig) SetStripForwardedUrlFragment(strip bool) {
+	rs.stripFragment = strip
+}
+
+// SetIgnoreDefaultPorts accepts a forwarded url echoed back with port 80 or
+// 443 added to or removed from its host. Either port is ignored whatever the
+// scheme, as by default the router signs the forwarded url as http even for
+// requests it received over https.
+func (rs *RouteServiceConfig) SetIgnoreDefaultPorts(ignore bool) {
+	rs.ignoreDefaultPorts = ignore
+}
+
+// SetAllowPathExtensions accepts a forwarded url echoed back with path
+// segments appended, e.g. a callback path added by the route service, and
+// validates the signed url it starts with. The signed url must have no query
+// or fragment, and what follows it must start a new segment and may not hold
+// dot segments, so that only the path beneath the signed one can change.
+func (rs *RouteServiceConfig) SetAllowPathExtensions(allow bool) {
+	rs.pathExtensions = allow
+}
+
+// SetForwardedUrlOptionalPaths lets requests for paths matching the glob
+// patterns return from a route service without the forwarded url header, for
+// route services such as health probes that do not echo it. The caller then
+// validates the signature against the url of the request itself instead, so
+// only the header, not the check, is optional.
+func (rs *RouteServiceConfig) SetForwardedUrlOptionalPaths(patterns []string) {
+	rs.optionalUrlPaths = patterns
+}
+
+// ForwardedUrlOptional reports whether a request for requestPath may return
+// without the forwarded url header.
+func (rs *RouteServiceConfig) ForwardedUrlOptional(requestPath string) bool {
+	for _, pattern := range rs.optionalUrlPaths {
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// SetCanonicalForwardedUrls signs and sends forwarded urls in the form of
+// CanonicalForwardedUrl, and puts those echoed back in it before comparing.
+func (rs *RouteServiceConfig) SetCanonicalForwardedUrls(canonical bool) {
+	rs.canonicalUrls = canonical
+}
+
+// ForwardedUrl is the forwarded url to sign and send to a route service for
+// a request to forwardedUrlRaw. It is canonical or without its fragment as
+// configured, so that the url sent is the one signed.
+func (rs *RouteServiceConfig) ForwardedUrl(forwardedUrlRaw string) string {
+	forwardedUrl := forwardedUrlRaw
+	if rs.canonicalUrls {
+		forwardedUrl = CanonicalForwardedUrl(forwardedUrl)
+	}
+	if rs.stripFragment {
+		if i := strings.Index(forwardedUrl, "#"); i >= 0 {
+			forwardedUrl = forwardedUrl[:i]
+		}
+	}
+	return forwardedUrl
+}
+
+// ForwardedUrlFromRequest is the ForwardedUrl of request, received over
+// scheme.
+func (rs *RouteServiceConfig) ForwardedUrlFromRequest(scheme string, request *http.Request) string {
+	return rs.ForwardedUrl(scheme + "://" + request.Host + request.RequestURI)
+}
+
+// SetMaxHops limits how many times a request may be sent to route services,
+// to break loops between them. Zero is unlimited.
+func (rs *RouteServiceConfig) SetMaxHops(max int) {
+	rs.maxHops = max
+}
+
+// SetIssuer names this router in the signatures it mints. Empty, the default,
+// leaves the issuer out.
+func (rs *RouteServiceConfig) SetIssuer(issuer string) {
+	rs.issuer = issuer
+}
+
+// SetHeaderEncoding changes the base64 encoding of the signature and metadata
+// headers, for route services expecting another one. It applies to both
+// minting and validation. Nil restores the default, base64.URLEncoding.
+func (rs *RouteServiceConfig) SetHeaderEncoding(encoding *base64.Encoding) {
+	rs.headerEncoding = encoding
+}
+
+// SetClock replaces time.Now as the source of the time signatures are minted
+// and validated at, so that tests can move it across the validity boundary.
+func (rs *RouteServiceConfig) SetClock(now func() time.Time) {
+	rs.now = now
+}
+
+// SetExpiryGrace keeps accepting signatures for grace past the end of their
+// validity, so that an outage of signing routers does not fail every request
+// in flight. Such signatures are logged and counted as soft expired. Zero, the
+// default, rejects them as soon as they expire.
+func (rs *RouteServiceConfig) SetExpiryGrace(grace time.Duration) {
+	rs.expiryGrace = grace
+}
+
+// SoftExpired reports whether signature, accepted by Validate, had
+// expired and was only accepted within the expiry grace.
+func (rs *RouteServiceConfig) SoftExpired(signature *Signature) bool {
+	return signature.IsExpired(rs.now(), rs.routeServiceTimeout)
+}
+
+// SetSignatureAgeObserver has observe called with the age of every signature
+// that decodes, expired or not, to show how close route services run to the
+// validity window. Nil, the default, records nothing.
+func (rs *RouteServiceConfig) SetSignatureAgeObserver(observe func(time.Duration)) {
+	rs.observeSignatureAge = observe
+}
+
+// SetSigner mints signatures with signer instead of the local crypto. The
+// local crypto is still used to validate them, so signer must use the same
+// key. A nil signer restores the default.
+func (rs *RouteServiceConfig) SetSigner(signer Signer) {
+	rs.signer = signer
+}
+
+// SetHostCrypto gives the route services of some host names a key of their
+// own, to sign for them and validate requests for their routes with. Route
+// services of other hosts keep to the router's key. Those with a key of their
+// own are not signed for by the signer set with SetSigner, and the previous
+// key is not accepted for them.
+func (rs *RouteServiceConfig) SetHostCrypto(hostCrypto map[string]secure.Crypto) {
+	rs.hostCrypto = make(map[string]secure.Crypto, len(hostCrypto))
+	for host, crypto := range hostCrypto {
+		rs.hostCrypto[strings.ToLower(host)] = crypto
+	}
+}
+
+// ForRouteService is the config to sign for and validate requests for the
+// route service at routeServiceUrl with: this one, unless the route service's
+// host has a key of its own.
+func (rs *RouteServiceConfig) ForRouteService(routeServiceUrl string) *RouteServiceConfig {
+	if len(rs.hostCrypto) == 0 {
+		return rs
+	}
+
+	u, err := url.Parse(routeServiceUrl)
+	if err != nil {
+		return rs
+	}
+	crypto, ok := rs.hostCrypto[strings.ToLower(u.Hostname())]
+	if !ok {
+		return rs
+	}
+
+	forHost := *rs
+	forHost.crypto = crypto
+	forHost.cryptoPrev = nil
+	forHost.signer = nil
+	return &forHost
+}
+
+func (rs *RouteServiceConfig) currentSigner() Signer {
+	if rs.signer != nil {
+		return rs.signer
+	}
+	return CryptoSigner{
+		Crypto: rs.crypto,
+		BuildOptions: BuildOptions{
+			CompressionThreshold: rs.compressThreshold,
+			Encoding:             rs.headerEncoding,
+			BindRouteKey:         rs.bindRouteKey,
+		},
+	}
+}
+
 func (rs *RouteServiceConfig) GenerateSignatureAndMetadata(forwardedUrlRaw string) (string, string, error) {
+	return rs.Generate(SignatureOptions{ForwardedUrlRaw: forwardedUrlRaw})
+}
+
+// Generate mints the signature and metadata headers for a request about to
+// be sent to a route service.
+func (rs *RouteServiceConfig) Generate(opts SignatureOptions) (string, string, error) {
+	if len(opts.ForwardedUrlRaw) > rs.maxForwardedUrlLen {
+		return "", "", RouteServiceForwardedUrlTooLong
+	}
+
 	signature := &Signature{
-		RequestedTime: time.Now(),
-		ForwardedUrl:  forwardedUrlRaw,
+		RequestedTime: rs.now(),
+		ForwardedUrl:  rs.ForwardedUrl(opts.ForwardedUrlRaw),
+		AppGuid:       opts.AppGuid,
+		RouteKey:      opts.RouteKey,
+		ClientIP:      opts.ClientIP,
+		Issuer:        rs.issuer,
 	}
 
-	signatureHeader, metadataHeader, err := BuildSignatureAndMetadata(rs.crypto, signature)
+	signatureHeader, metadataHeader, err := rs.currentSigner().Sign(signature)
 	if err != nil {
 		return "", "", err
 	}
 	return signatureHeader, metadataHeader, nil
 }
 
+// ResignSignatureAndMetadata validates headers, which may have been signed
+// with the previous key, and signs what they carry again with the current one.
+// The requested time and forwarded url are kept, so the new headers expire
+// when the old ones would have.
+func (rs *RouteServiceConfig) ResignSignatureAndMetadata(headers *http.Header) (string, string, error) {
+	signature, err := rs.Validate(headers, ValidateOptions{})
+	if err != nil {
+		return "", "", err
+	}
+
+	return rs.currentSigner().Sign(signature)
+}
+
 func (rs *RouteServiceConfig) SetupRouteServiceRequest(request *http.Request, args RouteServiceArgs) {
 	rs.logger.Debug("proxy.route-service")
-	request.Header.Set(RouteServiceSignature, args.Signature)
-	request.Header.Set(RouteServiceMetadata, args.Metadata)
-	request.Header.Set(RouteServiceForwardedUrl, args.ForwardedUrlRaw)
+	upgrade := webSocketUpgrade(request.Header)
+	rs.StripHopByHopHeaders(&request.Header)
+	if upgrade != "" {
+		// The route service is asked to upgrade too, and either does so
+		// itself or sends the handshake back.
+		request.Header.Set("Connection", "Upgrade")
+		request.Header.Set("Upgrade", upgrade)
+	}
+	request.Header.Set(rs.signatureHeader, args.Signature)
+	request.Header.Set(rs.metadataHeader, args.Metadata)
+	request.Header.Set(rs.forwardedUrlHeader, args.ForwardedUrlRaw)
+	request.Header.Del(RouteServiceRouteKey)
+	if args.RouteKey != "" {
+		request.Header.Set(RouteServiceRouteKey, args.RouteKey)
+	}
+	request.Header.Del(RouteServiceClientIP)
+	if args.ClientIP != "" {
+		request.Header.Set(RouteServiceClientIP, args.ClientIP)
+	}
+	request.Header.Del(RouteServiceTimeoutMs)
+	if !args.StartedAt.IsZero() {
+		remaining := rs.routeServiceTimeout - rs.now().Sub(args.StartedAt)
+		if remaining < 0 {
+			remaining = 0
+		}
+		request.Header.Set(RouteServiceTimeoutMs, strconv.FormatInt(int64(remaining/time.Millisecond), 10))
+	}
+
+	request.Header.Del(RouteServiceHops)
+	if args.Hops > 0 {
+		request.Header.Set(RouteServiceHops, strconv.Itoa(args.Hops))
+	}
 
 	request.Host = args.ParsedUrl.Host
 	request.URL = args.ParsedUrl
 }
 
+// NextHop is the hop count to send with a request about to be sent to a
+// route service, one more than the count it came in with. It fails once the
+// count would go over the maximum, and is zero when there is none.
+func (rs *RouteServiceConfig) NextHop(headers *http.Header) (int, error) {
+	if rs.maxHops <= 0 {
+		return 0, nil
+	}
+
+	hops, err := strconv.Atoi(headers.Get(RouteServiceHops))
+	if err != nil || hops < 0 {
+		hops = 0
+	}
+	if hops >= rs.maxHops {
+		err = RouteServiceTooManyHopsError{Hops: hops, MaxHops: rs.maxHops}
+		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.loop")
+		return 0, err
+	}
+	return hops + 1, nil
+}
+
+// SelfCheck mints a signature with the current key and decodes it again, to
+// catch a truncated or corrupt key before it fails requests. It always
+// succeeds when route services are disabled.
+func (rs *RouteServiceConfig) SelfCheck() error {
+	if !rs.routeServiceEnabled {
+		return nil
+	}
+	return rs.selfCheck(rs.crypto)
+}
+
+// CheckKeys runs the self check on every key signatures are minted or
+// validated with: the current and previous keys, and those of route service
+// hosts. A broken previous key would otherwise only show as requests with
+// older signatures failing validation.
+func (rs *RouteServiceConfig) CheckKeys() error {
+	if !rs.routeServiceEnabled {
+		return nil
+	}
+
+	err := rs.selfCheck(rs.crypto)
+	if err != nil {
+		return fmt.Errorf("current key: %s", err)
+	}
+
+	if rs.cryptoPrev != nil {
+		err = rs.selfCheck(rs.cryptoPrev)
+		if err != nil {
+			return fmt.Errorf("previous key: %s", err)
+		}
+	}
+
+	hosts := make([]string, 0, len(rs.hostCrypto))
+	for host := range rs.hostCrypto {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		err = rs.selfCheck(rs.hostCrypto[host])
+		if err != nil {
+			return fmt.Errorf("key for %s: %s", host, err)
+		}
+	}
+	return nil
+}
+
+// CheckKeysOnStartup runs CheckKeys for a router about to start. With
+// failClosed its error is returned, for the router to refuse to start with.
+// Without, it is only logged and the router starts anyway.
+func (rs *RouteServiceConfig) CheckKeysOnStartup(failClosed bool) error {
+	err := rs.CheckKeys()
+	if err != nil && !failClosed {
+		rs.logger.Errord(map[string]interface{}{"error": err.Error()}, "proxy.route-service.check-keys.failed")
+		return nil
+	}
+	return err
+}
+
+func (rs *RouteServiceConfig) selfCheck(crypto secure.Crypto) error {
+	signature := &Signature{
+		ForwardedUrl:  "https://self-check.invalid/",
+		RequestedTime: rs.now(),
+	}
+	decoded, err := RoundTrip(crypto, signature)
+	if err == nil && decoded.ForwardedUrl != signature.ForwardedUrl {
+		err = RouteServiceForwardedUrlMismatch
+	}
+	if err != nil {
+		return fmt.Errorf("Route service key self check failed: %s", err)
+	}
+	return nil
+}
+
 func (rs *RouteServiceConfig) ValidateSignature(headers *http.Header) error {
-	metadataHeader := headers.Get(RouteServiceMetadata)
-	signatureHeader := headers.Get(RouteServiceSignature)
+	_, err := rs.Validate(headers, ValidateOptions{})
+	return err
+}
+
+// ValidateAndDecode validates the signature in headers like ValidateSignature
+// and, on success, returns the decrypted signature.
+func (rs *RouteServiceConfig) ValidateAndDecode(headers *http.Header) (*Signature, error) {
+	return rs.Validate(headers, ValidateOptions{})
+}
+
+// Validate validates the signature in headers, sent back by a route service,
+// and on success returns it decrypted.
+func (rs *RouteServiceConfig) Validate(headers *http.Header, opts ValidateOptions) (*Signature, error) {
+	metadataHeader := headers.Get(rs.metadataHeader)
+	signatureHeader := headers.Get(rs.signatureHeader)
 
-	signature, err := SignatureFromHeaders(signatureHeader, metadataHeader, rs.crypto)
+	if signatureHeader == "" && metadataHeader != "" {
+		err := RouteServiceMissingSignatureError{SignatureHeader: rs.signatureHeader}
+		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.missing-signature")
+		return nil, err
+	}
+
+	err := rs.validateHeaderLengths(signatureHeader, headers.Get(rs.forwardedUrlHeader))
+	if err != nil {
+		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.forwarded-url.too-long")
+		return nil, err
+	}
+
+	usedPrevKey := false
+	signature, err := SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, rs.crypto, rs.headerEncoding, opts.RouteKey)
 	if err != nil {
 		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.current_key")
-		// Decrypt the head again trying to use the old key.
-		if rs.cryptoPrev != nil {
-			rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.current_key")
-			signature, err = SignatureFromHeaders(signatureHeader, metadataHeader, rs.cryptoPrev)
+		if rs.cryptoPrev == nil {
+			return nil, err
+		}
 
-			if err != nil {
-				rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.previous_key")
-			}
+		// Decrypt the head again trying to use the old key.
+		signature, err = SignatureFromEncodedHeadersForRoute(signatureHeader, metadataHeader, rs.cryptoPrev, rs.headerEncoding, opts.RouteKey)
+		if err != nil {
+			rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.previous_key")
+			return nil, err
 		}
+		usedPrevKey = true
+	}
 
-		return err
+	if rs.observeSignatureAge != nil {
+		rs.observeSignatureAge(rs.now().Sub(signature.RequestedTime))
 	}
 
 	err = rs.validateSignatureTimeout(signature)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = rs.validateForwardedUrl(signature, headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.BindAppGuid && signature.AppGuid != "" && signature.AppGuid != opts.AppGuid {
+		err = RouteServiceAppGuidMismatchError{SignedAppGuid: signature.AppGuid, ExpectedAppGuid: opts.AppGuid}
+		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.app-guid.mismatch")
+		return nil, err
 	}
 
-	return rs.validateForwardedUrl(signature, headers)
+	if usedPrevKey {
+		// Once this stops being counted the previous key can be removed.
+		metrics.IncrementCounter("route_services.previous_key_validations")
+	}
+
+	return &signature, nil
+}
+
+func (rs *RouteServiceConfig) validateHeaderLengths(signatureHeader, forwardedUrl string) error {
+	maxSignatureLen := headerEncoding(rs.headerEncoding).EncodedLen(rs.maxForwardedUrlLen + maxSignatureOverhead)
+	if len(forwardedUrl) > rs.maxForwardedUrlLen || len(signatureHeader) > maxSignatureLen {
+		return RouteServiceForwardedUrlTooLong
+	}
+	return nil
 }
 
 func (rs *RouteServiceConfig) validateSignatureTimeout(signature Signature) error {
-	if time.Since(signature.RequestedTime) > rs.routeServiceTimeout {
+	now := rs.now()
+	if signature.IsExpired(now, rs.routeServiceTimeout) {
+		if now.Sub(signature.RequestedTime) <= signature.Validity(rs.routeServiceTimeout)+rs.expiryGrace {
+			rs.logger.Warnd(map[string]interface{}{"requested_time": signature.RequestedTime}, "proxy.route-service.soft-expired")
+			metrics.IncrementCounter("route_services.soft_expired_validations")
+			return nil
+		}
+
 		rs.logger.Debug("proxy.route-service.timeout")
-		return RouteServiceExpired
+		return RouteServiceExpiredError{
+			RequestedTime: signature.RequestedTime,
+			Validity:      signature.Validity(rs.routeServiceTimeout),
+			Now:           now,
+		}
 	}
 	return nil
 }
 
 func (rs *RouteServiceConfig) validateForwardedUrl(signature Signature, headers *http.Header) error {
-	if headers.Get(RouteServiceForwardedUrl) != signature.ForwardedUrl {
-		var err = RouteServiceForwardedUrlMismatch
+	if _, err := url.Parse(signature.ForwardedUrl); err != nil {
+		err = RouteServiceInvalidForwardedUrlError{ForwardedUrl: signature.ForwardedUrl, Err: err}
+		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.forwarded-url.invalid")
+		return err
+	}
+
+	signature.ForwardedUrl = rs.comparableForwardedUrl(signature.ForwardedUrl)
+	forwardedUrl := rs.comparableForwardedUrl(headers.Get(rs.forwardedUrlHeader))
+	if rs.pathExtensions && isPathExtension(signature.ForwardedUrl, forwardedUrl) {
+		forwardedUrl = signature.ForwardedUrl
+	}
+
+	err := VerifyForwardedUrl(&signature, forwardedUrl)
+	if err != nil {
 		rs.logger.Warnd(map[string]interface{}{"error": err.Error()}, "proxy.route-service.forwarded-url.mismatch")
 		return err
 	}
 	return nil
 }
+
+// webSocketUpgrade is the Upgrade header of a WebSocket handshake, or empty
+// for other requests.
+func webSocketUpgrade(headers http.Header) string {
+	for _, connection := range headers.Values("Connection") {
+		for _, token := range strings.Split(connection, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") && strings.EqualFold(headers.Get("Upgrade"), "websocket") {
+				return headers.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// isPathExtension reports whether forwardedUrl is signedUrl with path
+// segments appended, as allowed by SetAllowPathExtensions.
+func isPathExtension(signedUrl, forwardedUrl string) bool {
+	if len(forwardedUrl) <= len(signedUrl) || !strings.HasPrefix(forwardedUrl, signedUrl) {
+		return false
+	}
+	if strings.ContainsAny(signedUrl, "?#") || !strings.Contains(signedUrl, "://") {
+		return false
+	}
+
+	extension := forwardedUrl[len(signedUrl):]
+	if !strings.HasSuffix(signedUrl, "/") && extension[0] != '/' {
+		return false
+	}
+
+	if i := strings.IndexAny(extension, "?#"); i >= 0 {
+		extension = extension[:i]
+	}
+	// Some backends take a backslash for a slash.
+	extension = strings.ToLower(extension)
+	if strings.Contains(extension, "\\") || strings.Contains(extension, "%5c") {
+		return false
+	}
+	for _, segment := range strings.Split(extension, "/") {
+		segment = strings.Replace(segment, "%2e", ".", -1)
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+func (rs *RouteServiceConfig) comparableForwardedUrl(forwardedUrl string) string {
+	forwardedUrl = rs.ForwardedUrl(forwardedUrl)
+	if !rs.ignoreDefaultPorts {
+		return forwardedUrl
+	}
+
+	u, err := url.Parse(forwardedUrl)
+	if err != nil || (u.Port() != "80" && u.Port() != "443") {
+		return forwardedUrl
+	}
+	return strings.Replace(forwardedUrl, "//"+u.Host, "//"+strings.TrimSuffix(u.Host, ":"+u.Port()), 1)
+}
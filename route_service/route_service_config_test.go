@@ -1,10 +1,18 @@
 package route_service_test
 
 import (
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"testing"
 	"time"
 
+	"github.com/cloudfoundry/dropsonde/metric_sender/fake"
+	"github.com/cloudfoundry/dropsonde/metrics"
 	"github.com/cloudfoundry/gorouter/common/secure"
 	"github.com/cloudfoundry/gorouter/route_service"
 	"github.com/cloudfoundry/gorouter/test_util"
@@ -24,7 +32,8 @@ var _ = Describe("Route Service Config", func() {
 		var err error
 		crypto, err = secure.NewAesGCM([]byte(cryptoKey))
 		Expect(err).ToNot(HaveOccurred())
-		config = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+		config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+		Expect(err).ToNot(HaveOccurred())
 	})
 
 	AfterEach(func() {
@@ -33,6 +42,45 @@ var _ = Describe("Route Service Config", func() {
 		config = nil
 	})
 
+	Describe("NewRouteServiceConfigFromKeys", func() {
+		It("builds a config from valid keys", func() {
+			c, err := route_service.NewRouteServiceConfigFromKeys(true, 1*time.Hour, []byte(cryptoKey), []byte("QRSTUVWXYZ123456"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.RouteServiceEnabled()).To(BeTrue())
+
+			forwardedUrl := "http://test.com/path/"
+			signatureHeader, metadataHeader, err := c.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).NotTo(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			Expect(config.ValidateSignature(&headers)).To(Succeed())
+		})
+
+		It("accepts a config without a previous key", func() {
+			_, err := route_service.NewRouteServiceConfigFromKeys(true, 1*time.Hour, []byte(cryptoKey), nil)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("rejects a current key of the wrong length", func() {
+			_, err := route_service.NewRouteServiceConfigFromKeys(true, 1*time.Hour, []byte("ABCDEFGHIJKLMNO"), nil)
+			Expect(err).To(MatchError("Invalid route service key: 15 bytes, must be 16, 24 or 32"))
+		})
+
+		It("rejects a previous key of the wrong length", func() {
+			_, err := route_service.NewRouteServiceConfigFromKeys(true, 1*time.Hour, []byte(cryptoKey), []byte("ABCDEFGHIJKLMNO"))
+			Expect(err).To(MatchError("Invalid previous route service key: 15 bytes, must be 16, 24 or 32"))
+		})
+
+		It("does not require a key when route services are disabled", func() {
+			c, err := route_service.NewRouteServiceConfigFromKeys(false, 1*time.Hour, nil, nil)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(c.RouteServiceEnabled()).To(BeFalse())
+		})
+	})
+
 	Describe("SetupRouteServiceRequest", func() {
 		var (
 			request *http.Request
@@ -63,6 +111,16 @@ var _ = Describe("Route Service Config", func() {
 			Expect(request.Header.Get(route_service.RouteServiceMetadata)).To(Equal("metadata"))
 		})
 
+		It("sets the hop count header when there is one", func() {
+			request.Header.Set(route_service.RouteServiceHops, "7")
+			config.SetupRouteServiceRequest(request, rsArgs)
+			Expect(request.Header).NotTo(HaveKey(route_service.RouteServiceHops))
+
+			rsArgs.Hops = 2
+			config.SetupRouteServiceRequest(request, rsArgs)
+			Expect(request.Header.Get(route_service.RouteServiceHops)).To(Equal("2"))
+		})
+
 		It("sets the forwarded URL header", func() {
 			Expect(request.Header.Get(route_service.RouteServiceForwardedUrl)).To(Equal(""))
 
@@ -71,6 +129,108 @@ var _ = Describe("Route Service Config", func() {
 			Expect(request.Header.Get(route_service.RouteServiceForwardedUrl)).To(Equal("http://test.com/path/"))
 		})
 
+		It("sets the route key header when there is a route key", func() {
+			rsArgs.RouteKey = "test.com/path"
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceRouteKey)).To(Equal("test.com/path"))
+		})
+
+		It("removes a route key header sent by the client", func() {
+			request.Header.Set(route_service.RouteServiceRouteKey, "spoofed.com")
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceRouteKey)).To(BeEmpty())
+		})
+
+		It("keeps asking to upgrade WebSocket handshakes", func() {
+			request.Header.Set("Connection", "keep-alive, Upgrade")
+			request.Header.Set("Upgrade", "websocket")
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get("Connection")).To(Equal("Upgrade"))
+			Expect(request.Header.Get("Upgrade")).To(Equal("websocket"))
+		})
+
+		It("strips other upgrades as hop-by-hop headers", func() {
+			request.Header.Set("Connection", "Upgrade")
+			request.Header.Set("Upgrade", "h2c")
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get("Connection")).To(BeEmpty())
+			Expect(request.Header.Get("Upgrade")).To(BeEmpty())
+		})
+
+		It("sets the client ip header when there is a client ip", func() {
+			rsArgs.ClientIP = "10.0.0.1"
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceClientIP)).To(Equal("10.0.0.1"))
+		})
+
+		It("removes a client ip header sent by the client", func() {
+			request.Header.Set(route_service.RouteServiceClientIP, "10.0.0.2")
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceClientIP)).To(BeEmpty())
+		})
+
+		It("sends the time left before the signature expires", func() {
+			now := time.Now()
+			config.SetClock(func() time.Time { return now })
+			rsArgs.StartedAt = now.Add(-250 * time.Millisecond)
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceTimeoutMs)).To(Equal("3599750"))
+		})
+
+		It("sends a budget of zero once the validity has elapsed", func() {
+			rsArgs.StartedAt = time.Now().Add(-2 * time.Hour)
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceTimeoutMs)).To(Equal("0"))
+		})
+
+		It("sends no budget without a start time, removing one sent by the client", func() {
+			request.Header.Set(route_service.RouteServiceTimeoutMs, "1000000")
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Header.Get(route_service.RouteServiceTimeoutMs)).To(BeEmpty())
+		})
+
+		It("keeps a non-standard port in the url and host", func() {
+			parsed, err := url.Parse("https://rs.example.com:8443/")
+			Expect(err).NotTo(HaveOccurred())
+			rsArgs.UrlString = parsed.String()
+			rsArgs.ParsedUrl = parsed
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.URL.Host).To(Equal("rs.example.com:8443"))
+			Expect(request.URL.Path).To(Equal("/"))
+			Expect(request.Host).To(Equal("rs.example.com:8443"))
+		})
+
+		It("preserves the method and body", func() {
+			request = test_util.NewRequest("PUT", "test.com", "/path/", strings.NewReader("some body"))
+
+			config.SetupRouteServiceRequest(request, rsArgs)
+
+			Expect(request.Method).To(Equal("PUT"))
+			body, err := ioutil.ReadAll(request.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("some body"))
+		})
+
 		It("changes the request host and URL", func() {
 			config.SetupRouteServiceRequest(request, rsArgs)
 
@@ -79,66 +239,1379 @@ var _ = Describe("Route Service Config", func() {
 		})
 	})
 
-	Describe("ValidateSignature", func() {
-		var (
-			signatureHeader string
-			metadataHeader  string
-			headers         *http.Header
-			signature       *route_service.Signature
-		)
+	Describe("NewRouteServiceConfig", func() {
+		It("rejects a zero validity when route services are enabled", func() {
+			_, err := route_service.NewRouteServiceConfig(true, 0, crypto, cryptoPrev)
+			Expect(err).To(MatchError(ContainSubstring("Invalid route service validity")))
+		})
+
+		It("rejects a negative validity when route services are enabled", func() {
+			_, err := route_service.NewRouteServiceConfig(true, -time.Minute, crypto, cryptoPrev)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("rejects a missing key when route services are enabled", func() {
+			_, err := route_service.NewRouteServiceConfig(true, 1*time.Hour, nil, nil)
+			Expect(err).To(MatchError(ContainSubstring("without a route service key")))
+		})
+
+		It("permits a missing key when route services are disabled", func() {
+			_, err := route_service.NewRouteServiceConfig(false, 1*time.Hour, nil, nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("permits a zero validity when route services are disabled", func() {
+			c, err := route_service.NewRouteServiceConfig(false, 0, crypto, cryptoPrev)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(c.Enabled()).To(BeFalse())
+		})
+	})
+
+	Describe("Enabled and ValidityDuration", func() {
+		It("return what the config was created with", func() {
+			Expect(config.Enabled()).To(BeTrue())
+			Expect(config.ValidityDuration()).To(Equal(1 * time.Hour))
+
+			config, err := route_service.NewRouteServiceConfig(false, 5*time.Minute, crypto, cryptoPrev)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.Enabled()).To(BeFalse())
+			Expect(config.ValidityDuration()).To(Equal(5 * time.Minute))
+		})
+	})
+
+	Describe("RouteServiceEnforce", func() {
+		It("enforces signature validation by default", func() {
+			Expect(config.RouteServiceEnforce()).To(BeTrue())
+		})
+
+		It("can be switched to report-only", func() {
+			config.SetRouteServiceEnforce(false)
+			Expect(config.RouteServiceEnforce()).To(BeFalse())
+			Expect(config.RouteServiceEnabled()).To(BeTrue())
+		})
+
+		It("can be switched back while it is being read", func() {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; i < 1000; i++ {
+					config.RouteServiceEnforce()
+				}
+			}()
+
+			config.SetRouteServiceEnforce(false)
+			config.SetRouteServiceEnforce(true)
+			<-done
+			Expect(config.RouteServiceEnforce()).To(BeTrue())
+		})
+	})
+
+	Describe("StripReservedHeaders", func() {
+		var headers http.Header
+
+		BeforeEach(func() {
+			headers = make(http.Header)
+			headers.Set("X-CF-ApplicationID", "spoofed-app-id")
+			headers.Set("X-CF-InstanceID", "spoofed-instance-id")
+			headers.Set("X-Trusted-User", "admin")
+			headers.Set("X-Other", "other")
+		})
+
+		It("strips the routing headers set by the router", func() {
+			config.StripReservedHeaders(&headers)
+
+			Expect(headers.Get("X-CF-ApplicationID")).To(Equal(""))
+			Expect(headers.Get("X-CF-InstanceID")).To(Equal(""))
+			Expect(headers.Get("X-Trusted-User")).To(Equal("admin"))
+			Expect(headers.Get("X-Other")).To(Equal("other"))
+		})
+
+		Context("when additional reserved headers are configured", func() {
+			BeforeEach(func() {
+				config.AddReservedHeaders("X-Trusted-User")
+			})
+
+			It("strips them as well as the routing headers", func() {
+				config.StripReservedHeaders(&headers)
+
+				Expect(headers.Get("X-CF-ApplicationID")).To(Equal(""))
+				Expect(headers.Get("X-Trusted-User")).To(Equal(""))
+				Expect(headers.Get("X-Other")).To(Equal("other"))
+			})
+		})
+	})
+
+	Describe("StripResponseHeaders", func() {
+		var headers http.Header
+
+		BeforeEach(func() {
+			headers = make(http.Header)
+			headers.Set("Server", "route-service")
+			headers.Add("Set-Cookie", "rs_session=abc")
+			headers.Set("X-Other", "other")
+		})
+
+		It("strips nothing by default", func() {
+			config.StripResponseHeaders(&headers)
+
+			Expect(headers.Get("Server")).To(Equal("route-service"))
+			Expect(headers.Get("Set-Cookie")).To(Equal("rs_session=abc"))
+		})
+
+		It("strips the configured headers", func() {
+			config.AddResponseHeaders("Server", "set-cookie")
+			config.StripResponseHeaders(&headers)
+
+			Expect(headers.Get("Server")).To(Equal(""))
+			Expect(headers.Get("Set-Cookie")).To(Equal(""))
+			Expect(headers.Get("X-Other")).To(Equal("other"))
+		})
+	})
+
+	Describe("StripHopByHopHeaders", func() {
+		var headers http.Header
+
+		BeforeEach(func() {
+			headers = make(http.Header)
+			headers.Set("Connection", "X-Custom, Keep-Alive")
+			headers.Set("Keep-Alive", "timeout=5")
+			headers.Set("Upgrade", "websocket")
+			headers.Set("X-Custom", "value")
+			headers.Set("X-Per-Hop", "value")
+			headers.Set("X-Other", "other")
+		})
+
+		It("strips the hop-by-hop headers and those named in Connection", func() {
+			config.StripHopByHopHeaders(&headers)
+
+			Expect(headers.Get("Connection")).To(Equal(""))
+			Expect(headers.Get("Keep-Alive")).To(Equal(""))
+			Expect(headers.Get("Upgrade")).To(Equal(""))
+			Expect(headers.Get("X-Custom")).To(Equal(""))
+			Expect(headers.Get("X-Per-Hop")).To(Equal("value"))
+			Expect(headers.Get("X-Other")).To(Equal("other"))
+		})
+
+		Context("when additional hop-by-hop headers are configured", func() {
+			BeforeEach(func() {
+				config.AddHopByHopHeaders("X-Per-Hop")
+			})
+
+			It("strips them as well", func() {
+				config.StripHopByHopHeaders(&headers)
+
+				Expect(headers.Get("X-Per-Hop")).To(Equal(""))
+				Expect(headers.Get("X-Other")).To(Equal("other"))
+			})
+		})
+	})
+
+	Describe("SetHeaderNames", func() {
+		It("defaults to the X-CF headers", func() {
+			Expect(config.SignatureHeader()).To(Equal(route_service.RouteServiceSignature))
+			Expect(config.MetadataHeader()).To(Equal(route_service.RouteServiceMetadata))
+			Expect(config.ForwardedUrlHeader()).To(Equal(route_service.RouteServiceForwardedUrl))
+		})
+
+		It("keeps the default for names left empty", func() {
+			config.SetHeaderNames("X-Signature", "", "")
+
+			Expect(config.SignatureHeader()).To(Equal("X-Signature"))
+			Expect(config.MetadataHeader()).To(Equal(route_service.RouteServiceMetadata))
+			Expect(config.ForwardedUrlHeader()).To(Equal(route_service.RouteServiceForwardedUrl))
+		})
+
+		Context("when custom header names are configured", func() {
+			BeforeEach(func() {
+				config.SetHeaderNames("X-Signature", "X-Metadata", "X-Original-Url")
+			})
+
+			It("signs the request with the custom headers and validates it", func() {
+				request := test_util.NewRequest("GET", "test.com", "/path/", nil)
+				parsed, err := url.Parse("https://example-route-service.com")
+				Expect(err).NotTo(HaveOccurred())
+
+				signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata("http://test.com/path/")
+				Expect(err).NotTo(HaveOccurred())
+
+				config.SetupRouteServiceRequest(request, route_service.RouteServiceArgs{
+					UrlString:       parsed.String(),
+					ParsedUrl:       parsed,
+					Signature:       signatureHeader,
+					Metadata:        metadataHeader,
+					ForwardedUrlRaw: "http://test.com/path/",
+				})
+
+				Expect(request.Header.Get("X-Signature")).To(Equal(signatureHeader))
+				Expect(request.Header.Get("X-Metadata")).To(Equal(metadataHeader))
+				Expect(request.Header.Get("X-Original-Url")).To(Equal("http://test.com/path/"))
+				Expect(request.Header.Get(route_service.RouteServiceSignature)).To(Equal(""))
+				Expect(request.Header.Get(route_service.RouteServiceMetadata)).To(Equal(""))
+				Expect(request.Header.Get(route_service.RouteServiceForwardedUrl)).To(Equal(""))
+
+				Expect(config.ValidateSignature(&request.Header)).To(Succeed())
+			})
+
+			It("does not read the default headers", func() {
+				signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata("http://test.com/path/")
+				Expect(err).NotTo(HaveOccurred())
+
+				headers := make(http.Header)
+				headers.Set(route_service.RouteServiceSignature, signatureHeader)
+				headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+				headers.Set(route_service.RouteServiceForwardedUrl, "http://test.com/path/")
+
+				Expect(config.ValidateSignature(&headers)).NotTo(Succeed())
+			})
+		})
+	})
+
+	Describe("ValidateHost", func() {
+		It("allows any host when nothing is denied", func() {
+			Expect(config.ValidateHost("169.254.169.254")).To(Succeed())
+		})
+
+		Context("when hosts are denied", func() {
+			BeforeEach(func() {
+				err := config.SetDeniedHosts([]string{"169.254.0.0/16", "10.0.0.1", "fd00::/8", "Metadata.Internal"})
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("denies addresses in a denied range", func() {
+				Expect(config.ValidateHost("169.254.169.254")).To(Equal(route_service.RouteServiceHostDenied))
+				Expect(config.ValidateHost("169.254.169.254:443")).To(Equal(route_service.RouteServiceHostDenied))
+				Expect(config.ValidateHost("[fd00::1]:443")).To(Equal(route_service.RouteServiceHostDenied))
+			})
+
+			It("denies a denied address", func() {
+				Expect(config.ValidateHost("10.0.0.1")).To(Equal(route_service.RouteServiceHostDenied))
+				Expect(config.ValidateHost("10.0.0.2")).To(Succeed())
+			})
+
+			It("denies a denied hostname regardless of case", func() {
+				Expect(config.ValidateHost("metadata.internal:80")).To(Equal(route_service.RouteServiceHostDenied))
+			})
+
+			It("leaves hostnames to be checked by address when they are dialed", func() {
+				Expect(config.SetDeniedHosts([]string{"127.0.0.0/8"})).To(Succeed())
+				Expect(config.ValidateHost("localhost")).To(Succeed())
+			})
+
+			It("allows other hosts", func() {
+				Expect(config.ValidateHost("127.0.0.1:8443")).To(Succeed())
+			})
+
+			It("checks connected addresses against the denied ranges", func() {
+				Expect(config.ValidateIP(net.ParseIP("169.254.1.1"))).To(Equal(route_service.RouteServiceHostDenied))
+				Expect(config.ValidateIP(net.ParseIP("127.0.0.1"))).To(Succeed())
+			})
+		})
+
+		It("rejects an invalid CIDR range", func() {
+			Expect(config.SetDeniedHosts([]string{"169.254.0.0/33"})).ToNot(Succeed())
+		})
+	})
+
+	Describe("SetCompressionThreshold", func() {
+		It("validates signatures compressed above the threshold", func() {
+			config.SetCompressionThreshold(64)
+			forwardedUrl := "http://test.com/" + strings.Repeat("a", 512)
+
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+		})
+	})
+
+	Describe("SetIgnoreDefaultPorts", func() {
+		validate := func(signedUrl, echoedUrl string) error {
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(signedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, echoedUrl)
+			return config.ValidateSignature(&headers)
+		}
+
+		Context("when enabled", func() {
+			BeforeEach(func() {
+				config.SetIgnoreDefaultPorts(true)
+			})
+
+			It("accepts a forwarded url with :443 made explicit", func() {
+				Expect(validate("https://my_host.com/resource?query=123", "https://my_host.com:443/resource?query=123")).To(Succeed())
+				Expect(validate("http://my_host.com/resource?query=123", "http://my_host.com:443/resource?query=123")).To(Succeed())
+			})
+
+			It("accepts a forwarded url with :80 removed", func() {
+				Expect(validate("http://my_host.com:80/resource", "http://my_host.com/resource")).To(Succeed())
+			})
+
+			It("accepts IPv6 hosts with a default port", func() {
+				Expect(validate("http://[::1]/resource", "http://[::1]:443/resource")).To(Succeed())
+			})
+
+			It("still rejects other ports", func() {
+				Expect(validate("http://my_host.com/resource", "http://my_host.com:8443/resource")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+
+			It("still rejects a different path or query", func() {
+				Expect(validate("http://my_host.com/resource?query=123", "http://my_host.com:443/resource?query=124")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+
+		Context("when disabled", func() {
+			It("rejects a forwarded url with :443 made explicit", func() {
+				Expect(validate("https://my_host.com/resource", "https://my_host.com:443/resource")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+	})
+
+	Describe("SetAllowPathExtensions", func() {
+		validate := func(signedUrl, echoedUrl string) error {
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(signedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, echoedUrl)
+			return config.ValidateSignature(&headers)
+		}
+
+		Context("when enabled", func() {
+			BeforeEach(func() {
+				config.SetAllowPathExtensions(true)
+			})
+
+			It("accepts the signed url", func() {
+				Expect(validate("http://my_host.com/login", "http://my_host.com/login")).To(Succeed())
+			})
+
+			It("accepts path segments appended to the signed url", func() {
+				Expect(validate("http://my_host.com/login", "http://my_host.com/login/callback")).To(Succeed())
+				Expect(validate("http://my_host.com/login/", "http://my_host.com/login/callback")).To(Succeed())
+				Expect(validate("http://my_host.com", "http://my_host.com/callback")).To(Succeed())
+			})
+
+			It("accepts a query or fragment after the appended path", func() {
+				Expect(validate("http://my_host.com/login", "http://my_host.com/login/callback?code=123#done")).To(Succeed())
+			})
+
+			It("rejects a host changed by appending to it", func() {
+				for _, echoedUrl := range []string{
+					"http://my_host.com.evil.com/login",
+					"http://my_host.com:8080/callback",
+					"http://my_host.com@evil.com/callback",
+				} {
+					Expect(validate("http://my_host.com", echoedUrl)).To(Equal(route_service.RouteServiceForwardedUrlMismatch), echoedUrl)
+				}
+				Expect(validate("http://my_host.com/login", "http://evil.com/login/callback")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+
+			It("rejects text appended to the last segment", func() {
+				Expect(validate("http://my_host.com/login", "http://my_host.com/login-admin")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+
+			It("rejects dot segments and backslashes in the appended path", func() {
+				for _, echoedUrl := range []string{
+					"http://my_host.com/app/../admin",
+					"http://my_host.com/app/%2E%2e/admin",
+					"http://my_host.com/app/./x",
+					"http://my_host.com/app/..\\admin",
+					"http://my_host.com/app/..%5Cadmin",
+				} {
+					Expect(validate("http://my_host.com/app", echoedUrl)).To(Equal(route_service.RouteServiceForwardedUrlMismatch), echoedUrl)
+				}
+			})
+
+			It("rejects extensions of a signed url with a query", func() {
+				Expect(validate("http://my_host.com/login?next=1", "http://my_host.com/login?next=1/callback")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+				Expect(validate("http://my_host.com/login?next=1", "http://my_host.com/login?next=1&admin=1")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+
+		Context("when disabled", func() {
+			It("rejects path segments appended to the signed url", func() {
+				Expect(validate("http://my_host.com/login", "http://my_host.com/login/callback")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+	})
+
+	Describe("NextHop", func() {
+		var headers http.Header
+
+		BeforeEach(func() {
+			headers = make(http.Header)
+		})
+
+		It("does not count hops by default", func() {
+			headers.Set(route_service.RouteServiceHops, "100")
+			Expect(config.NextHop(&headers)).To(BeZero())
+		})
+
+		Context("with a maximum", func() {
+			BeforeEach(func() {
+				config.SetMaxHops(2)
+			})
+
+			It("counts the first hop", func() {
+				Expect(config.NextHop(&headers)).To(Equal(1))
+			})
+
+			It("adds one to the hops the request came in with", func() {
+				headers.Set(route_service.RouteServiceHops, "1")
+				Expect(config.NextHop(&headers)).To(Equal(2))
+			})
+
+			It("fails once the maximum has been reached", func() {
+				headers.Set(route_service.RouteServiceHops, "2")
+				_, err := config.NextHop(&headers)
+				Expect(err).To(Equal(route_service.RouteServiceTooManyHopsError{Hops: 2, MaxHops: 2}))
+			})
+
+			It("ignores invalid hop counts", func() {
+				headers.Set(route_service.RouteServiceHops, "-5")
+				Expect(config.NextHop(&headers)).To(Equal(1))
+
+				headers.Set(route_service.RouteServiceHops, "many")
+				Expect(config.NextHop(&headers)).To(Equal(1))
+			})
+		})
+	})
+
+	Describe("SetCanonicalForwardedUrls", func() {
+		var mixed = "http://My_Host.com:80/%7euser/caf%c3%a9?q=%2f"
+
+		It("leaves forwarded urls alone by default", func() {
+			Expect(config.ForwardedUrl(mixed)).To(Equal(mixed))
+		})
+
+		Context("when enabled", func() {
+			BeforeEach(func() {
+				config.SetCanonicalForwardedUrls(true)
+			})
+
+			It("signs the canonical form", func() {
+				forwardedUrl := config.ForwardedUrl(mixed)
+				Expect(forwardedUrl).To(Equal("http://my_host.com/~user/caf%C3%A9?q=%2F"))
+
+				signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := make(http.Header)
+				headers.Set(route_service.RouteServiceSignature, signatureHeader)
+				headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+				headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+				signature, err := config.ValidateAndDecode(&headers)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+			})
+
+			It("accepts the forwarded url echoed back in another spelling", func() {
+				signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(config.ForwardedUrl(mixed))
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := make(http.Header)
+				headers.Set(route_service.RouteServiceSignature, signatureHeader)
+				headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+				headers.Set(route_service.RouteServiceForwardedUrl, mixed)
+				Expect(config.ValidateSignature(&headers)).To(Succeed())
+
+				headers.Set(route_service.RouteServiceForwardedUrl, "http://my_host.com/~user/caf%C3%A9?q=%2F&r=1")
+				Expect(config.ValidateSignature(&headers)).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+	})
+
+	Describe("SetStripForwardedUrlFragment", func() {
+		var forwardedUrl = "http://my_host.com/resource?query=123#page1..5"
+
+		validate := func(signedUrl, echoedUrl string) error {
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(signedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, echoedUrl)
+			return config.ValidateSignature(&headers)
+		}
+
+		Context("when enabled", func() {
+			BeforeEach(func() {
+				config.SetStripForwardedUrlFragment(true)
+			})
+
+			It("leaves the fragment out of the signature", func() {
+				signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+				Expect(err).ToNot(HaveOccurred())
+
+				signature, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signature.ForwardedUrl).To(Equal("http://my_host.com/resource?query=123"))
+			})
+
+			It("accepts a forwarded url without the fragment", func() {
+				Expect(validate(forwardedUrl, "http://my_host.com/resource?query=123")).To(Succeed())
+			})
+
+			It("accepts a forwarded url with a different fragment", func() {
+				Expect(validate(forwardedUrl, "http://my_host.com/resource?query=123#other")).To(Succeed())
+			})
+
+			It("still rejects a forwarded url that differs elsewhere", func() {
+				Expect(validate(forwardedUrl, "http://my_host.com/resource?query=124#page1..5")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+
+		Context("when disabled", func() {
+			It("signs the fragment and requires it back", func() {
+				Expect(validate(forwardedUrl, forwardedUrl)).To(Succeed())
+				Expect(validate(forwardedUrl, "http://my_host.com/resource?query=123")).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+			})
+		})
+	})
+
+	Describe("ForwardedUrlFromRequest", func() {
+		var request *http.Request
+
+		BeforeEach(func() {
+			request = test_util.NewRequest("GET", "my_host.com", "/resource?query=123#page1..5", nil)
+			request.RequestURI = "/resource?query=123#page1..5"
+		})
+
+		It("builds the url from the scheme, host and request uri", func() {
+			Expect(config.ForwardedUrlFromRequest("https", request)).To(Equal("https://my_host.com/resource?query=123#page1..5"))
+		})
+
+		It("is the url signed for the request", func() {
+			forwardedUrl := config.ForwardedUrlFromRequest("http", request)
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			signature, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+		})
+
+		Context("when the fragment is stripped", func() {
+			BeforeEach(func() {
+				config.SetStripForwardedUrlFragment(true)
+			})
+
+			It("leaves the fragment out of the url sent as well as the one signed", func() {
+				forwardedUrl := config.ForwardedUrlFromRequest("http", request)
+				Expect(forwardedUrl).To(Equal("http://my_host.com/resource?query=123"))
+
+				signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+				Expect(err).ToNot(HaveOccurred())
+
+				signature, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+			})
+
+			It("strips the fragment after putting the url in canonical form", func() {
+				config.SetCanonicalForwardedUrls(true)
+				request.RequestURI = "/%7eresource#page%2f1"
+
+				Expect(config.ForwardedUrlFromRequest("http", request)).To(Equal("http://my_host.com/~resource"))
+			})
+		})
+	})
+
+	Describe("ForwardedUrlOptional", func() {
+		It("is false for every path by default", func() {
+			Expect(config.ForwardedUrlOptional("/health")).To(BeFalse())
+		})
+
+		It("is true for paths matching the configured patterns only", func() {
+			config.SetForwardedUrlOptionalPaths([]string{"/health", "/probes/*"})
+
+			Expect(config.ForwardedUrlOptional("/health")).To(BeTrue())
+			Expect(config.ForwardedUrlOptional("/probes/ready")).To(BeTrue())
+			Expect(config.ForwardedUrlOptional("/probes/ready/deep")).To(BeFalse())
+			Expect(config.ForwardedUrlOptional("/healthz")).To(BeFalse())
+			Expect(config.ForwardedUrlOptional("/")).To(BeFalse())
+		})
+	})
+
+	Describe("SetIssuer", func() {
+		validate := func() *route_service.Signature {
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata("http://my_host.com/resource")
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, "http://my_host.com/resource")
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			return signature
+		}
+
+		It("leaves the issuer out by default", func() {
+			Expect(validate().Issuer).To(BeEmpty())
+		})
+
+		It("signs the issuer, which round trips through validation", func() {
+			config.SetIssuer("10.0.0.1/2")
+			Expect(validate().Issuer).To(Equal("10.0.0.1/2"))
+		})
+
+		It("does not validate the issuer", func() {
+			config.SetIssuer("10.0.0.1/2")
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata("http://my_host.com/resource")
+			Expect(err).ToNot(HaveOccurred())
+
+			config.SetIssuer("10.0.0.2/0")
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, "http://my_host.com/resource")
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.Issuer).To(Equal("10.0.0.1/2"))
+		})
+	})
+
+	Describe("SetHeaderEncoding", func() {
+		var forwardedUrl = "http://test.com/path/"
+
+		headersFrom := func(rs *route_service.RouteServiceConfig) *http.Header {
+			signatureHeader, metadataHeader, err := rs.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			return &headers
+		}
+
+		BeforeEach(func() {
+			config.SetHeaderEncoding(base64.RawURLEncoding)
+		})
+
+		It("mints and validates headers with the encoding", func() {
+			headers := headersFrom(config)
+			Expect(headers.Get(route_service.RouteServiceMetadata)).ToNot(ContainSubstring("="))
+			Expect(config.ValidateSignature(headers)).To(Succeed())
+		})
+
+		It("rejects headers minted with the default encoding", func() {
+			defaultConfig, err := route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, nil)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(config.ValidateSignature(headersFrom(defaultConfig))).ToNot(Succeed())
+		})
+	})
+
+	Describe("SetClock", func() {
+		var (
+			now          time.Time
+			headers      http.Header
+			forwardedUrl = "http://test.com/path/"
+		)
+
+		BeforeEach(func() {
+			now = time.Date(2016, time.January, 1, 12, 0, 0, 0, time.UTC)
+			config.SetClock(func() time.Time { return now })
+
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers = make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+		})
+
+		It("mints signatures at the time of the clock", func() {
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.RequestedTime).To(BeTemporally("==", now))
+		})
+
+		It("accepts signatures up to the end of the validity", func() {
+			now = now.Add(1 * time.Hour)
+			Expect(config.ValidateSignature(&headers)).To(Succeed())
+		})
+
+		It("rejects signatures once the clock passes the validity", func() {
+			requestedTime := now
+			now = now.Add(1*time.Hour + time.Nanosecond)
+
+			err := config.ValidateSignature(&headers)
+			Expect(err).To(HaveOccurred())
+			expired, ok := err.(route_service.RouteServiceExpiredError)
+			Expect(ok).To(BeTrue())
+			Expect(expired.RequestedTime).To(BeTemporally("==", requestedTime))
+			Expect(expired.Now).To(BeTemporally("==", now))
+		})
+
+		It("observes the age of signatures as they are decoded", func() {
+			var ages []time.Duration
+			config.SetSignatureAgeObserver(func(age time.Duration) { ages = append(ages, age) })
+
+			now = now.Add(42 * time.Second)
+			Expect(config.ValidateSignature(&headers)).To(Succeed())
+			Expect(ages).To(HaveLen(1))
+			Expect(ages[0]).To(BeNumerically("~", 42*time.Second, time.Second))
+
+			now = now.Add(2 * time.Hour)
+			Expect(config.ValidateSignature(&headers)).ToNot(Succeed())
+			Expect(ages).To(HaveLen(2))
+			Expect(ages[1]).To(BeNumerically("~", 2*time.Hour+42*time.Second, time.Second))
+		})
+
+		It("does not observe headers that fail to decode", func() {
+			var ages []time.Duration
+			config.SetSignatureAgeObserver(func(age time.Duration) { ages = append(ages, age) })
+
+			headers.Set(route_service.RouteServiceSignature, "garbage")
+			Expect(config.ValidateSignature(&headers)).ToNot(Succeed())
+			Expect(ages).To(BeEmpty())
+		})
+	})
+
+	Describe("SetExpiryGrace", func() {
+		var (
+			now          time.Time
+			requested    time.Time
+			headers      http.Header
+			metricSender *fake.FakeMetricSender
+			forwardedUrl = "http://test.com/path/"
+		)
+
+		BeforeEach(func() {
+			metricSender = fake.NewFakeMetricSender()
+			metrics.Initialize(metricSender)
+
+			requested = time.Date(2016, time.January, 1, 12, 0, 0, 0, time.UTC)
+			now = requested
+			config.SetClock(func() time.Time { return now })
+			config.SetExpiryGrace(5 * time.Minute)
+
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers = make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+		})
+
+		AfterEach(func() {
+			metrics.Initialize(nil)
+		})
+
+		It("accepts signatures within their validity without flagging them", func() {
+			now = requested.Add(1 * time.Hour)
+
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.SoftExpired(signature)).To(BeFalse())
+			Expect(metricSender.GetCounter("route_services.soft_expired_validations")).To(BeZero())
+		})
+
+		It("accepts signatures within the grace and flags them as soft expired", func() {
+			now = requested.Add(1*time.Hour + 5*time.Minute)
+
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config.SoftExpired(signature)).To(BeTrue())
+			Expect(metricSender.GetCounter("route_services.soft_expired_validations")).To(Equal(uint64(1)))
+		})
+
+		It("rejects signatures beyond the grace", func() {
+			now = requested.Add(1*time.Hour + 5*time.Minute + time.Nanosecond)
+
+			err := config.ValidateSignature(&headers)
+			Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceExpiredError{}))
+			Expect(metricSender.GetCounter("route_services.soft_expired_validations")).To(BeZero())
+		})
+
+		It("gives no grace by default", func() {
+			config.SetExpiryGrace(0)
+			now = requested.Add(1*time.Hour + time.Nanosecond)
+
+			Expect(config.ValidateSignature(&headers)).To(BeAssignableToTypeOf(route_service.RouteServiceExpiredError{}))
+		})
+	})
+
+	Describe("SetHostCrypto", func() {
+		var (
+			forwardedUrl = "http://test.com/path/"
+		)
+
+		BeforeEach(func() {
+			cryptoA, err := secure.NewAesGCM([]byte("QRSTUVWXYZ123456"))
+			Expect(err).ToNot(HaveOccurred())
+			cryptoB, err := secure.NewAesGCM([]byte("7890ABCDEFGHIJKL"))
+			Expect(err).ToNot(HaveOccurred())
+
+			config.SetHostCrypto(map[string]secure.Crypto{
+				"RS-A.example.com": cryptoA,
+				"rs-b.example.com": cryptoB,
+			})
+		})
+
+		signedHeaders := func(rsConfig *route_service.RouteServiceConfig) *http.Header {
+			signatureHeader, metadataHeader, err := rsConfig.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			return &headers
+		}
+
+		It("validates signatures minted for a host with its key", func() {
+			headers := signedHeaders(config.ForRouteService("https://rs-a.example.com/auth"))
+			Expect(config.ForRouteService("https://RS-A.example.com:8443/other").ValidateSignature(headers)).To(Succeed())
+		})
+
+		It("rejects signatures minted with one host's key for another host", func() {
+			headers := signedHeaders(config.ForRouteService("https://rs-a.example.com/auth"))
+
+			err := config.ForRouteService("https://rs-b.example.com/auth").ValidateSignature(headers)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("authentication failed"))
+		})
+
+		It("rejects signatures minted with a host's key for route services without one", func() {
+			headers := signedHeaders(config.ForRouteService("https://rs-a.example.com/auth"))
+
+			Expect(config.ForRouteService("https://rs-c.example.com/auth").ValidateSignature(headers)).ToNot(Succeed())
+		})
+
+		It("rejects signatures minted with the router's key for hosts with a key of their own", func() {
+			headers := signedHeaders(config)
+
+			Expect(config.ForRouteService("https://rs-a.example.com/auth").ValidateSignature(headers)).ToNot(Succeed())
+		})
+
+		It("falls back to the router's key for hosts without one", func() {
+			Expect(config.ForRouteService("https://rs-c.example.com/auth") == config).To(BeTrue())
+			Expect(config.ForRouteService("%zz") == config).To(BeTrue())
+		})
+
+		It("shares the enforcement with the configs for hosts", func() {
+			rsConfig := config.ForRouteService("https://rs-a.example.com/auth")
+
+			config.SetRouteServiceEnforce(false)
+			Expect(rsConfig.RouteServiceEnforce()).To(BeFalse())
+		})
+	})
+
+	Describe("SetBindRouteKey", func() {
+		var (
+			headers      http.Header
+			forwardedUrl = "http://test.com/path/"
+		)
+
+		BeforeEach(func() {
+			config.SetBindRouteKey(true)
+
+			signatureHeader, metadataHeader, err := config.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, AppGuid: "app-guid", RouteKey: "test.com/path"})
+			Expect(err).ToNot(HaveOccurred())
+
+			headers = make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+		})
+
+		It("validates signatures for the route they were minted for", func() {
+			signature, err := config.Validate(&headers, route_service.ValidateOptions{RouteKey: "test.com/path"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.RouteKey).To(Equal("test.com/path"))
+			Expect(signature.AppGuid).To(Equal("app-guid"))
+		})
+
+		It("fails to decrypt signatures for another route", func() {
+			_, err := config.Validate(&headers, route_service.ValidateOptions{RouteKey: "test.com/other"})
+			Expect(err).To(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("fails to decrypt signatures without a route", func() {
+			Expect(config.ValidateSignature(&headers)).To(MatchError(ContainSubstring("authentication failed")))
+		})
+
+		It("checks the application along with the route", func() {
+			_, err := config.Validate(&headers, route_service.ValidateOptions{AppGuid: "app-guid", BindAppGuid: true, RouteKey: "test.com/path"})
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = config.Validate(&headers, route_service.ValidateOptions{AppGuid: "other-app-guid", BindAppGuid: true, RouteKey: "test.com/path"})
+			Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceAppGuidMismatchError{}))
+		})
+
+		It("does not bind signatures minted without a route", func() {
+			signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+
+			_, err = config.Validate(&headers, route_service.ValidateOptions{RouteKey: "test.com/other"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+	})
+
+	Describe("SelfCheck", func() {
+		It("succeeds with a usable key", func() {
+			Expect(config.SelfCheck()).To(Succeed())
+		})
+
+		Context("when the key cannot read what it encrypts", func() {
+			BeforeEach(func() {
+				otherCrypto, err := secure.NewAesGCM([]byte("0123456789ABCDEF"))
+				Expect(err).ToNot(HaveOccurred())
+
+				config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, mismatchedCrypto{encrypt: crypto, decrypt: otherCrypto}, nil)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error", func() {
+				err := config.SelfCheck()
+				Expect(err).To(HaveOccurred())
+				Expect(err.Error()).To(ContainSubstring("self check failed"))
+			})
+		})
+
+		Context("when the key of a route service host cannot read what it encrypts", func() {
+			BeforeEach(func() {
+				otherCrypto, err := secure.NewAesGCM([]byte("0123456789ABCDEF"))
+				Expect(err).ToNot(HaveOccurred())
+
+				config.SetHostCrypto(map[string]secure.Crypto{
+					"rs.example.com": mismatchedCrypto{encrypt: crypto, decrypt: otherCrypto},
+				})
+			})
+
+			It("returns an error for that host only", func() {
+				Expect(config.SelfCheck()).To(Succeed())
+				Expect(config.ForRouteService("https://rs.example.com").SelfCheck()).To(MatchError(ContainSubstring("self check failed")))
+			})
+		})
+
+		Context("when route services are disabled", func() {
+			BeforeEach(func() {
+				var err error
+				config, err = route_service.NewRouteServiceConfig(false, 0, nil, nil)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("succeeds without a key", func() {
+				Expect(config.SelfCheck()).To(Succeed())
+			})
+		})
+	})
+
+	Describe("CheckKeysOnStartup", func() {
+		var badCrypto secure.Crypto
+
+		BeforeEach(func() {
+			otherCrypto, err := secure.NewAesGCM([]byte("0123456789ABCDEF"))
+			Expect(err).ToNot(HaveOccurred())
+			badCrypto = mismatchedCrypto{encrypt: crypto, decrypt: otherCrypto}
+		})
+
+		Context("with usable keys", func() {
+			BeforeEach(func() {
+				prev, err := secure.NewAesGCM([]byte("QRSTUVWXYZ123456"))
+				Expect(err).ToNot(HaveOccurred())
+
+				config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, prev)
+				Expect(err).ToNot(HaveOccurred())
+				config.SetHostCrypto(map[string]secure.Crypto{"rs.example.com": prev})
+			})
+
+			It("succeeds", func() {
+				Expect(config.CheckKeys()).To(Succeed())
+				Expect(config.CheckKeysOnStartup(true)).To(Succeed())
+			})
+		})
+
+		Context("when the current key cannot read what it encrypts", func() {
+			BeforeEach(func() {
+				var err error
+				config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, badCrypto, crypto)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error when failing closed", func() {
+				Expect(config.CheckKeysOnStartup(true)).To(MatchError(ContainSubstring("current key")))
+			})
+
+			It("only logs the error otherwise", func() {
+				Expect(config.CheckKeysOnStartup(false)).To(Succeed())
+			})
+		})
+
+		Context("when the previous key cannot read what it encrypts", func() {
+			BeforeEach(func() {
+				var err error
+				config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, badCrypto)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an error when failing closed", func() {
+				Expect(config.SelfCheck()).To(Succeed())
+				Expect(config.CheckKeysOnStartup(true)).To(MatchError(ContainSubstring("previous key")))
+			})
+
+			It("only logs the error otherwise", func() {
+				Expect(config.CheckKeysOnStartup(false)).To(Succeed())
+			})
+		})
+
+		Context("when the key of a route service host cannot read what it encrypts", func() {
+			BeforeEach(func() {
+				config.SetHostCrypto(map[string]secure.Crypto{"rs.example.com": badCrypto})
+			})
+
+			It("returns an error naming the host when failing closed", func() {
+				Expect(config.CheckKeysOnStartup(true)).To(MatchError(ContainSubstring("rs.example.com")))
+			})
+		})
+
+		Context("when route services are disabled", func() {
+			BeforeEach(func() {
+				var err error
+				config, err = route_service.NewRouteServiceConfig(false, 0, nil, nil)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("succeeds without a key", func() {
+				Expect(config.CheckKeysOnStartup(true)).To(Succeed())
+			})
+		})
+	})
+
+	Describe("SetSigner", func() {
+		var signer *fakeSigner
+
+		BeforeEach(func() {
+			signer = &fakeSigner{
+				signer: route_service.CryptoSigner{Crypto: crypto},
+			}
+			config.SetSigner(signer)
+		})
+
+		It("mints signatures with the signer", func() {
+			forwardedUrl := "http://test.com/path/"
+
+			signatureHeader, metadataHeader, err := config.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, AppGuid: "app-guid"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(signer.signatures).To(HaveLen(1))
+			Expect(signer.signatures[0].ForwardedUrl).To(Equal(forwardedUrl))
+			Expect(signer.signatures[0].AppGuid).To(Equal("app-guid"))
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			_, err = config.Validate(&headers, route_service.ValidateOptions{AppGuid: "app-guid", BindAppGuid: true})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("returns the signer's errors", func() {
+			signer.err = errors.New("signing service unavailable")
+
+			_, _, err := config.GenerateSignatureAndMetadata("http://test.com/path/")
+			Expect(err).To(MatchError("signing service unavailable"))
+		})
+
+		It("goes back to the local crypto when unset", func() {
+			config.SetSigner(nil)
+
+			_, _, err := config.GenerateSignatureAndMetadata("http://test.com/path/")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signer.signatures).To(BeEmpty())
+		})
+	})
+
+	Describe("GenerateSignatureAndMetadata", func() {
+		BeforeEach(func() {
+			config.SetMaxForwardedUrlLength(64)
+		})
+
+		It("signs a forwarded url at the maximum length", func() {
+			forwardedUrl := "http://test.com/" + strings.Repeat("a", 64-len("http://test.com/"))
+			Expect(forwardedUrl).To(HaveLen(64))
+
+			_, _, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("refuses to sign a forwarded url over the maximum length", func() {
+			forwardedUrl := "http://test.com/" + strings.Repeat("a", 65-len("http://test.com/"))
+			Expect(forwardedUrl).To(HaveLen(65))
+
+			_, _, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).To(Equal(route_service.RouteServiceForwardedUrlTooLong))
+		})
+	})
+
+	Describe("ValidateSignature", func() {
+		var (
+			signatureHeader string
+			metadataHeader  string
+			headers         *http.Header
+			signature       *route_service.Signature
+			metricSender    *fake.FakeMetricSender
+		)
+
+		BeforeEach(func() {
+			metricSender = fake.NewFakeMetricSender()
+			metrics.Initialize(metricSender)
+
+			h := make(http.Header, 0)
+			headers = &h
+			var err error
+
+			signature = &route_service.Signature{
+				RequestedTime: time.Now(),
+				ForwardedUrl:  "some-forwarded-url",
+			}
+			signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers.Set(route_service.RouteServiceForwardedUrl, "some-forwarded-url")
+		})
+
+		JustBeforeEach(func() {
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+		})
+
+		AfterEach(func() {
+			metrics.Initialize(nil)
+		})
+
+		It("decrypts a valid signature", func() {
+			err := config.ValidateSignature(headers)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(metricSender.GetCounter("route_services.previous_key_validations")).To(BeZero())
+		})
+
+		Context("when the timestamp is expired", func() {
+			BeforeEach(func() {
+				signature = &route_service.Signature{
+					RequestedTime: time.Now().Add(-10 * time.Hour),
+					ForwardedUrl:  "some-forwarded-url",
+				}
+				var err error
+				signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("returns an route service request expired error", func() {
+				err := config.ValidateSignature(headers)
+				Expect(err).To(HaveOccurred())
+				Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceExpired))
+				Expect(err.Error()).To(ContainSubstring("request expired"))
+			})
+
+			It("reports when the signature was minted and the validity window", func() {
+				err := config.ValidateSignature(headers)
+				Expect(err).To(HaveOccurred())
+
+				expiredErr, ok := err.(route_service.RouteServiceExpiredError)
+				Expect(ok).To(BeTrue())
+				Expect(expiredErr.RequestedTime.Equal(signature.RequestedTime)).To(BeTrue())
+				Expect(expiredErr.Validity).To(Equal(1 * time.Hour))
+				Expect(expiredErr.Now.Sub(signature.RequestedTime)).To(BeNumerically(">", 10*time.Hour-time.Second))
+
+				Expect(err.Error()).To(ContainSubstring("signed at " + signature.RequestedTime.Format(time.RFC3339Nano)))
+				Expect(err.Error()).To(ContainSubstring("window 1h0m0s"))
+				Expect(err.Error()).To(ContainSubstring("now "))
+			})
+		})
+
+		Context("when the signature is invalid", func() {
+			BeforeEach(func() {
+				signatureHeader = "zKQt4bnxW30Kxky"
+				metadataHeader = "eyJpdiI6IjlBVn"
+			})
+			It("returns an error", func() {
+				err := config.ValidateSignature(headers)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("when the metadata is of a version the router does not understand", func() {
+			BeforeEach(func() {
+				metadataHeader = base64.URLEncoding.EncodeToString([]byte(`{"nonce":"c29tZS1ub25jZQ==","version":2}`))
+			})
+
+			It("returns an unsupported version error", func() {
+				err := config.ValidateSignature(headers)
+				Expect(err).To(Equal(route_service.RouteServiceUnsupportedVersion{Version: 2, SupportedVersion: 1}))
+			})
+		})
+
+		Context("when a maximum forwarded url length is configured", func() {
+			var forwardedUrl string
+
+			BeforeEach(func() {
+				config.SetMaxForwardedUrlLength(64)
+			})
+
+			JustBeforeEach(func() {
+				var err error
+				signature.ForwardedUrl = forwardedUrl
+				signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
+				Expect(err).ToNot(HaveOccurred())
+
+				headers.Set(route_service.RouteServiceSignature, signatureHeader)
+				headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+				headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			})
+
+			Context("when the forwarded url is at the maximum length", func() {
+				BeforeEach(func() {
+					forwardedUrl = "http://test.com/" + strings.Repeat("a", 64-len("http://test.com/"))
+				})
+
+				It("validates the signature", func() {
+					err := config.ValidateSignature(headers)
+					Expect(err).NotTo(HaveOccurred())
+				})
+			})
+
+			Context("when the forwarded url is over the maximum length", func() {
+				BeforeEach(func() {
+					forwardedUrl = "http://test.com/" + strings.Repeat("a", 65-len("http://test.com/"))
+				})
+
+				It("rejects the request", func() {
+					err := config.ValidateSignature(headers)
+					Expect(err).To(Equal(route_service.RouteServiceForwardedUrlTooLong))
+				})
+			})
+
+			Context("when the signature header is oversized", func() {
+				BeforeEach(func() {
+					forwardedUrl = "http://test.com/"
+				})
+
+				It("rejects the request before decrypting it", func() {
+					headers.Set(route_service.RouteServiceSignature, strings.Repeat("A", 4096))
+
+					err := config.ValidateSignature(headers)
+					Expect(err).To(Equal(route_service.RouteServiceForwardedUrlTooLong))
+				})
+			})
+		})
+
+		Context("when the signature was built for a fixed past time", func() {
+			var signedAt, now time.Time
 
-		BeforeEach(func() {
-			h := make(http.Header, 0)
-			headers = &h
-			var err error
+			BeforeEach(func() {
+				now = time.Date(2016, 1, 2, 3, 4, 5, 123456789, time.UTC)
+				signedAt = now.Add(-10 * time.Minute)
+				config.SetClock(func() time.Time { return now })
 
-			signature = &route_service.Signature{
-				RequestedTime: time.Now(),
-				ForwardedUrl:  "some-forwarded-url",
-			}
-			signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
-			Expect(err).ToNot(HaveOccurred())
+				var err error
+				signature = &route_service.Signature{
+					RequestedTime: signedAt,
+					ForwardedUrl:  "some-forwarded-url",
+				}
+				signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
+				Expect(err).ToNot(HaveOccurred())
+			})
 
-			headers.Set(route_service.RouteServiceForwardedUrl, "some-forwarded-url")
-		})
+			It("is validated for exactly that time", func() {
+				Expect(config.ValidateSignature(headers)).To(Succeed())
 
-		JustBeforeEach(func() {
-			headers.Set(route_service.RouteServiceSignature, signatureHeader)
-			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
-		})
+				decoded, err := config.ValidateAndDecode(headers)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(decoded.RequestedTime.Equal(signedAt)).To(BeTrue())
+			})
 
-		It("decrypts a valid signature", func() {
-			err := config.ValidateSignature(headers)
-			Expect(err).NotTo(HaveOccurred())
+			It("expires against the validator's clock from that time", func() {
+				now = signedAt.Add(1*time.Hour + time.Nanosecond)
+
+				err := config.ValidateSignature(headers)
+				Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceExpiredError{}))
+				Expect(err.(route_service.RouteServiceExpiredError).RequestedTime.Equal(signedAt)).To(BeTrue())
+				Expect(err.(route_service.RouteServiceExpiredError).Now).To(Equal(now))
+			})
 		})
 
-		Context("when the timestamp is expired", func() {
+		Context("when the signature sets when it expires", func() {
+			var now time.Time
+
 			BeforeEach(func() {
+				now = time.Date(2016, 1, 2, 3, 4, 5, 0, time.UTC)
+				config.SetClock(func() time.Time { return now })
+			})
+
+			sign := func(requestedTime, expiresAt time.Time) {
+				var err error
 				signature = &route_service.Signature{
-					RequestedTime: time.Now().Add(-10 * time.Hour),
+					RequestedTime: requestedTime,
+					ExpiresAt:     &expiresAt,
 					ForwardedUrl:  "some-forwarded-url",
 				}
-				var err error
 				signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(crypto, signature)
 				Expect(err).ToNot(HaveOccurred())
+			}
+
+			Context("before the end of the validity window", func() {
+				BeforeEach(func() {
+					sign(now.Add(-10*time.Minute), now.Add(-1*time.Minute))
+				})
+
+				It("expires at that time", func() {
+					err := config.ValidateSignature(headers)
+					Expect(err).To(Equal(route_service.RouteServiceExpiredError{
+						RequestedTime: now.Add(-10 * time.Minute),
+						Validity:      9 * time.Minute,
+						Now:           now,
+					}))
+				})
 			})
 
-			It("returns an route service request expired error", func() {
-				err := config.ValidateSignature(headers)
-				Expect(err).To(HaveOccurred())
-				Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceExpired))
-				Expect(err.Error()).To(ContainSubstring("request expired"))
+			Context("after the end of the validity window", func() {
+				BeforeEach(func() {
+					sign(now.Add(-2*time.Hour), now.Add(time.Minute))
+				})
+
+				It("is valid until that time", func() {
+					Expect(config.ValidateSignature(headers)).To(Succeed())
+
+					now = now.Add(time.Minute + time.Nanosecond)
+					Expect(config.ValidateSignature(headers)).To(BeAssignableToTypeOf(route_service.RouteServiceExpiredError{}))
+				})
 			})
 		})
 
-		Context("when the signature is invalid", func() {
+		Context("when the signature header is missing", func() {
 			BeforeEach(func() {
-				signatureHeader = "zKQt4bnxW30Kxky"
-				metadataHeader = "eyJpdiI6IjlBVn"
+				signatureHeader = ""
 			})
-			It("returns an error", func() {
+
+			It("returns a missing signature error", func() {
 				err := config.ValidateSignature(headers)
-				Expect(err).To(HaveOccurred())
+				Expect(err).To(Equal(route_service.RouteServiceMissingSignatureError{SignatureHeader: route_service.RouteServiceSignature}))
+				Expect(err.Error()).To(ContainSubstring("X-CF-Proxy-Signature"))
 			})
 		})
 
@@ -171,7 +1644,8 @@ var _ = Describe("Route Service Config", func() {
 				var err error
 				crypto, err = secure.NewAesGCM([]byte("QRSTUVWXYZ123456"))
 				Expect(err).NotTo(HaveOccurred())
-				config = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+				config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+				Expect(err).ToNot(HaveOccurred())
 			})
 
 			Context("when there is no previous key in the configuration", func() {
@@ -187,7 +1661,8 @@ var _ = Describe("Route Service Config", func() {
 					var err error
 					cryptoPrev, err = secure.NewAesGCM([]byte(cryptoKey))
 					Expect(err).ToNot(HaveOccurred())
-					config = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+					config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+					Expect(err).ToNot(HaveOccurred())
 				})
 
 				It("validates the signature", func() {
@@ -195,6 +1670,12 @@ var _ = Describe("Route Service Config", func() {
 					Expect(err).NotTo(HaveOccurred())
 				})
 
+				It("counts the validation against the previous key", func() {
+					Expect(config.ValidateSignature(headers)).To(Succeed())
+					Expect(config.ValidateSignature(headers)).To(Succeed())
+					Expect(metricSender.GetCounter("route_services.previous_key_validations")).To(Equal(uint64(2)))
+				})
+
 				Context("when a request has an expired Route service signature header", func() {
 					BeforeEach(func() {
 						signature = &route_service.Signature{
@@ -212,6 +1693,35 @@ var _ = Describe("Route Service Config", func() {
 						Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceExpired))
 					})
 				})
+
+				Context("when the signature from the previous key has expired", func() {
+					BeforeEach(func() {
+						signature = &route_service.Signature{
+							RequestedTime: time.Now().Add(-10 * time.Hour),
+							ForwardedUrl:  "some-forwarded-url",
+						}
+						var err error
+						signatureHeader, metadataHeader, err = route_service.BuildSignatureAndMetadata(cryptoPrev, signature)
+						Expect(err).ToNot(HaveOccurred())
+					})
+
+					It("returns an route service request expired error", func() {
+						err := config.ValidateSignature(headers)
+						Expect(err).To(BeAssignableToTypeOf(route_service.RouteServiceExpired))
+						Expect(metricSender.GetCounter("route_services.previous_key_validations")).To(BeZero())
+					})
+				})
+
+				Context("when the signature from the previous key is for a different forwarded url", func() {
+					BeforeEach(func() {
+						headers.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+					})
+
+					It("returns a route service request bad forwarded url error", func() {
+						err := config.ValidateSignature(headers)
+						Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+					})
+				})
 			})
 
 			Context("when the header key does not match the previous key in the configuration", func() {
@@ -219,7 +1729,8 @@ var _ = Describe("Route Service Config", func() {
 					var err error
 					cryptoPrev, err = secure.NewAesGCM([]byte("QRSTUVWXYZ123456"))
 					Expect(err).ToNot(HaveOccurred())
-					config = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+					config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+					Expect(err).ToNot(HaveOccurred())
 				})
 
 				It("rejects the signature", func() {
@@ -230,4 +1741,368 @@ var _ = Describe("Route Service Config", func() {
 			})
 		})
 	})
+
+	Describe("Generate with a route key", func() {
+		It("includes the route key in the signature", func() {
+			forwardedUrl := "http://my_host.com/resource"
+			signatureHeader, metadataHeader, err := config.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, AppGuid: "app-a", RouteKey: "my_host.com/resource"})
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.RouteKey).To(Equal("my_host.com/resource"))
+			Expect(signature.AppGuid).To(Equal("app-a"))
+		})
+	})
+
+	Describe("Generate with a client ip", func() {
+		It("includes the client ip in the signature", func() {
+			forwardedUrl := "http://my_host.com/resource"
+			signatureHeader, metadataHeader, err := config.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, ClientIP: "10.0.0.1"})
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+			signature, err := config.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.ClientIP).To(Equal("10.0.0.1"))
+		})
+	})
+
+	Describe("ValidateSignature with a signed forwarded url that does not parse", func() {
+		var (
+			headers      http.Header
+			forwardedUrl = "http://my_host.com/%zz"
+		)
+
+		BeforeEach(func() {
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(crypto, &route_service.Signature{
+				RequestedTime: time.Now(),
+				ForwardedUrl:  forwardedUrl,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			headers = make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+		})
+
+		It("returns an invalid forwarded url error instead of comparing it", func() {
+			err := config.ValidateSignature(&headers)
+			Expect(err).To(HaveOccurred())
+
+			invalid, ok := err.(route_service.RouteServiceInvalidForwardedUrlError)
+			Expect(ok).To(BeTrue())
+			Expect(invalid.ForwardedUrl).To(Equal(forwardedUrl))
+			Expect(invalid.Err).To(HaveOccurred())
+		})
+	})
+
+	Describe("ResignSignatureAndMetadata", func() {
+		var (
+			headers      http.Header
+			requested    time.Time
+			forwardedUrl = "http://my_host.com/resource"
+		)
+
+		BeforeEach(func() {
+			var err error
+			cryptoPrev, err = secure.NewAesGCM([]byte("QRSTUVWXYZ123456"))
+			Expect(err).ToNot(HaveOccurred())
+			config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, cryptoPrev)
+			Expect(err).ToNot(HaveOccurred())
+
+			requested = time.Now().Add(-10 * time.Minute)
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(cryptoPrev, &route_service.Signature{
+				RequestedTime: requested,
+				ForwardedUrl:  forwardedUrl,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			headers = make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+		})
+
+		It("signs headers validated under the previous key with the current key", func() {
+			signatureHeader, metadataHeader, err := config.ResignSignatureAndMetadata(&headers)
+			Expect(err).ToNot(HaveOccurred())
+
+			signature, err := route_service.SignatureFromHeaders(signatureHeader, metadataHeader, crypto)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.RequestedTime).To(BeTemporally("==", requested))
+			Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+
+			_, err = route_service.SignatureFromHeaders(signatureHeader, metadataHeader, cryptoPrev)
+			Expect(err).To(HaveOccurred())
+
+			currentOnly, err := route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, nil)
+			Expect(err).ToNot(HaveOccurred())
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			Expect(currentOnly.ValidateSignature(&headers)).To(Succeed())
+		})
+
+		It("does not sign headers that fail to validate", func() {
+			headers.Set(route_service.RouteServiceForwardedUrl, "http://other.com/resource")
+
+			_, _, err := config.ResignSignatureAndMetadata(&headers)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("Validate with an app guid", func() {
+		var forwardedUrl = "http://my_host.com/resource"
+
+		headersFor := func(appGuid string) *http.Header {
+			signatureHeader, metadataHeader, err := config.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, AppGuid: appGuid})
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+			return &headers
+		}
+
+		It("accepts a signature bound to the expected app", func() {
+			_, err := config.Validate(headersFor("app-a"), route_service.ValidateOptions{AppGuid: "app-a", BindAppGuid: true})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("rejects a signature minted for another app", func() {
+			_, err := config.Validate(headersFor("app-a"), route_service.ValidateOptions{AppGuid: "app-b", BindAppGuid: true})
+			Expect(err).To(Equal(route_service.RouteServiceAppGuidMismatchError{
+				SignedAppGuid:   "app-a",
+				ExpectedAppGuid: "app-b",
+			}))
+		})
+
+		It("does not check the app unless asked to", func() {
+			_, err := config.Validate(headersFor("app-a"), route_service.ValidateOptions{AppGuid: "app-b"})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("accepts a signature not bound to any app", func() {
+			_, err := config.Validate(headersFor(""), route_service.ValidateOptions{AppGuid: "app-b", BindAppGuid: true})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("still rejects signatures failing the other checks", func() {
+			headers := headersFor("app-a")
+			headers.Set(route_service.RouteServiceForwardedUrl, "http://other_host.com/resource")
+			_, err := config.Validate(headers, route_service.ValidateOptions{AppGuid: "app-a", BindAppGuid: true})
+			Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+		})
+
+		It("includes the app guid in the signature", func() {
+			headers := headersFor("app-a")
+			signature, err := config.ValidateAndDecode(headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.AppGuid).To(Equal("app-a"))
+		})
+
+		It("returns the decoded signature", func() {
+			signature, err := config.Validate(headersFor("app-a"), route_service.ValidateOptions{AppGuid: "app-a", BindAppGuid: true})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+
+			signature, err = config.Validate(headersFor("app-a"), route_service.ValidateOptions{AppGuid: "app-b", BindAppGuid: true})
+			Expect(err).To(HaveOccurred())
+			Expect(signature).To(BeNil())
+		})
+	})
+
+	Describe("ValidateAndDecode", func() {
+		var (
+			headers   http.Header
+			signature *route_service.Signature
+		)
+
+		BeforeEach(func() {
+			signature = &route_service.Signature{
+				RequestedTime: time.Now().Add(-time.Minute).Round(time.Second),
+				ForwardedUrl:  "some-forwarded-url",
+			}
+			signatureHeader, metadataHeader, err := route_service.BuildSignatureAndMetadata(crypto, signature)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers = make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, "some-forwarded-url")
+		})
+
+		It("returns the decoded signature", func() {
+			decoded, err := config.ValidateAndDecode(&headers)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.ForwardedUrl).To(Equal("some-forwarded-url"))
+			Expect(decoded.RequestedTime.Equal(signature.RequestedTime)).To(BeTrue())
+		})
+
+		Context("when the signature is not valid", func() {
+			BeforeEach(func() {
+				headers.Set(route_service.RouteServiceForwardedUrl, "some-other-url")
+			})
+
+			It("returns the validation error and no signature", func() {
+				decoded, err := config.ValidateAndDecode(&headers)
+				Expect(err).To(Equal(route_service.RouteServiceForwardedUrlMismatch))
+				Expect(decoded).To(BeNil())
+			})
+		})
+	})
+
+	Context("when signing with HMAC", func() {
+		var hmacConfig *route_service.RouteServiceConfig
+
+		BeforeEach(func() {
+			signer, err := secure.NewHMACSigner([]byte(cryptoKey))
+			Expect(err).ToNot(HaveOccurred())
+			hmacConfig, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, signer, nil)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("validates its own signatures and rejects encrypted ones", func() {
+			forwardedUrl := "http://test.com/path/"
+			signatureHeader, metadataHeader, err := hmacConfig.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+
+			headers := make(http.Header)
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+			signature, err := hmacConfig.ValidateAndDecode(&headers)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+			Expect(config.ValidateSignature(&headers)).NotTo(Succeed())
+
+			signatureHeader, metadataHeader, err = config.GenerateSignatureAndMetadata(forwardedUrl)
+			Expect(err).ToNot(HaveOccurred())
+			headers.Set(route_service.RouteServiceSignature, signatureHeader)
+			headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+			Expect(hmacConfig.ValidateSignature(&headers)).NotTo(Succeed())
+		})
+
+		Measure("signing and validating compared with AES-GCM", func(b Benchmarker) {
+			forwardedUrl := "http://my_host.com/resource?query=123"
+
+			for name, c := range map[string]*route_service.RouteServiceConfig{"hmac": hmacConfig, "aes-gcm": config} {
+				signatureHeader, metadataHeader, err := c.GenerateSignatureAndMetadata(forwardedUrl)
+				Expect(err).ToNot(HaveOccurred())
+
+				headers := make(http.Header)
+				headers.Set(route_service.RouteServiceSignature, signatureHeader)
+				headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+				headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+				b.Time(name+": 1000 signatures", func() {
+					for i := 0; i < 1000; i++ {
+						c.GenerateSignatureAndMetadata(forwardedUrl)
+					}
+				})
+
+				b.Time(name+": 1000 validations", func() {
+					for i := 0; i < 1000; i++ {
+						Expect(c.ValidateSignature(&headers)).To(Succeed())
+					}
+				})
+			}
+		}, 10)
+	})
+
+	Measure("signing and validating", func(b Benchmarker) {
+		forwardedUrl := "http://my_host.com/resource?query=123"
+
+		allocs := testing.AllocsPerRun(100, func() {
+			config.GenerateSignatureAndMetadata(forwardedUrl)
+		})
+		b.RecordValue("allocations per signature", allocs)
+
+		unbufferedConfig, err := route_service.NewRouteServiceConfig(true, 1*time.Hour, unbufferedCrypto{crypto}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		unbufferedAllocs := testing.AllocsPerRun(100, func() {
+			unbufferedConfig.GenerateSignatureAndMetadata(forwardedUrl)
+		})
+		b.RecordValue("allocations per signature without crypto buffers", unbufferedAllocs)
+		Expect(allocs).To(BeNumerically("<", unbufferedAllocs))
+
+		signatureHeader, metadataHeader, err := config.GenerateSignatureAndMetadata(forwardedUrl)
+		Expect(err).ToNot(HaveOccurred())
+
+		headers := make(http.Header)
+		headers.Set(route_service.RouteServiceSignature, signatureHeader)
+		headers.Set(route_service.RouteServiceMetadata, metadataHeader)
+		headers.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+		allocs = testing.AllocsPerRun(100, func() {
+			config.ValidateSignature(&headers)
+		})
+		b.RecordValue("allocations per validation", allocs)
+
+		unbufferedAllocs = testing.AllocsPerRun(100, func() {
+			unbufferedConfig.ValidateSignature(&headers)
+		})
+		b.RecordValue("allocations per validation without crypto buffers", unbufferedAllocs)
+		Expect(allocs).To(BeNumerically("<", unbufferedAllocs))
+
+		b.Time("1000 validations", func() {
+			for i := 0; i < 1000; i++ {
+				Expect(config.ValidateSignature(&headers)).To(Succeed())
+			}
+		})
+	}, 10)
 })
+
+type fakeSigner struct {
+	signer     route_service.Signer
+	err        error
+	signatures []route_service.Signature
+}
+
+func (s *fakeSigner) Sign(signature *route_service.Signature) (string, string, error) {
+	s.signatures = append(s.signatures, *signature)
+	if s.err != nil {
+		return "", "", s.err
+	}
+	return s.signer.Sign(signature)
+}
+
+// unbufferedCrypto hides the crypto it wraps from cryptobuf.SealerFor.
+type unbufferedCrypto struct {
+	secure.Crypto
+}
+
+// mismatchedCrypto stands in for a corrupt key, which cannot decrypt what it
+// encrypted.
+type mismatchedCrypto struct {
+	encrypt secure.Crypto
+	decrypt secure.Crypto
+}
+
+func (c mismatchedCrypto) Encrypt(plainText []byte) ([]byte, []byte, error) {
+	return c.encrypt.Encrypt(plainText)
+}
+
+func (c mismatchedCrypto) Decrypt(cipherText, nonce []byte) ([]byte, error) {
+	return c.decrypt.Decrypt(cipherText, nonce)
+}
+
+func (c mismatchedCrypto) EncryptWithAAD(plainText, aad []byte) ([]byte, []byte, error) {
+	return c.encrypt.EncryptWithAAD(plainText, aad)
+}
+
+func (c mismatchedCrypto) DecryptWithAAD(cipherText, nonce, aad []byte) ([]byte, error) {
+	return c.decrypt.DecryptWithAAD(cipherText, nonce, aad)
+}
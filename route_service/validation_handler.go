@@ -0,0 +1,32 @@
+package route_service
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type validationHandler struct {
+	config *RouteServiceConfig
+}
+
+// NewValidationHandler returns a handler that validates the route service
+// headers of the requests it serves as the proxy does, and answers with the
+// claims of a valid signature as JSON, or a 400 with the reason it is not.
+// It proxies nothing, for components that verify signatures on their own.
+func NewValidationHandler(config *RouteServiceConfig) http.Handler {
+	return &validationHandler{config: config}
+}
+
+func (h *validationHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	signature, err := h.config.ValidateAndDecode(&req.Header)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	json.NewEncoder(w).Encode(signature)
+}
@@ -0,0 +1,102 @@
+package route_service_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cloudfoundry/gorouter/common/secure"
+	"github.com/cloudfoundry/gorouter/route_service"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("ValidationHandler", func() {
+	var (
+		config       *route_service.RouteServiceConfig
+		handler      http.Handler
+		now          time.Time
+		requested    time.Time
+		request      *http.Request
+		forwardedUrl = "http://test.com/path/"
+	)
+
+	BeforeEach(func() {
+		crypto, err := secure.NewAesGCM([]byte("ABCDEFGHIJKLMNOP"))
+		Expect(err).ToNot(HaveOccurred())
+		config, err = route_service.NewRouteServiceConfig(true, 1*time.Hour, crypto, nil)
+		Expect(err).ToNot(HaveOccurred())
+
+		requested = time.Date(2016, time.January, 1, 12, 0, 0, 0, time.UTC)
+		now = requested
+		config.SetClock(func() time.Time { return now })
+
+		signatureHeader, metadataHeader, err := config.Generate(route_service.SignatureOptions{ForwardedUrlRaw: forwardedUrl, AppGuid: "app-guid", RouteKey: "test.com/path"})
+		Expect(err).ToNot(HaveOccurred())
+
+		request, err = http.NewRequest("GET", "http://validator/", nil)
+		Expect(err).ToNot(HaveOccurred())
+		request.Header.Set(route_service.RouteServiceSignature, signatureHeader)
+		request.Header.Set(route_service.RouteServiceMetadata, metadataHeader)
+		request.Header.Set(route_service.RouteServiceForwardedUrl, forwardedUrl)
+
+		handler = route_service.NewValidationHandler(config)
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	It("answers valid requests with the claims of their signature", func() {
+		now = requested.Add(10 * time.Minute)
+
+		recorder := serve()
+		Expect(recorder.Code).To(Equal(http.StatusOK))
+		Expect(recorder.Header().Get("Content-Type")).To(Equal("application/json"))
+
+		var signature route_service.Signature
+		Expect(json.Unmarshal(recorder.Body.Bytes(), &signature)).To(Succeed())
+		Expect(signature.ForwardedUrl).To(Equal(forwardedUrl))
+		Expect(signature.RequestedTime.Equal(requested)).To(BeTrue())
+		Expect(signature.AppGuid).To(Equal("app-guid"))
+		Expect(signature.RouteKey).To(Equal("test.com/path"))
+	})
+
+	It("rejects expired requests", func() {
+		now = requested.Add(1*time.Hour + time.Second)
+
+		recorder := serve()
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(ContainSubstring("expired"))
+	})
+
+	It("rejects requests whose signature was tampered with", func() {
+		signatureHeader := []byte(request.Header.Get(route_service.RouteServiceSignature))
+		if signatureHeader[10] == 'A' {
+			signatureHeader[10] = 'B'
+		} else {
+			signatureHeader[10] = 'A'
+		}
+		request.Header.Set(route_service.RouteServiceSignature, string(signatureHeader))
+
+		recorder := serve()
+		Expect(recorder.Code).To(Equal(http.StatusBadRequest))
+		Expect(recorder.Body.String()).To(ContainSubstring("error"))
+	})
+
+	It("rejects requests for another forwarded url", func() {
+		request.Header.Set(route_service.RouteServiceForwardedUrl, "http://test.com/other/")
+
+		Expect(serve().Code).To(Equal(http.StatusBadRequest))
+	})
+
+	It("rejects requests without a signature", func() {
+		request.Header.Del(route_service.RouteServiceSignature)
+		request.Header.Del(route_service.RouteServiceMetadata)
+
+		Expect(serve().Code).To(Equal(http.StatusBadRequest))
+	})
+})
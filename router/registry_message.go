@@ -1,7 +1,7 @@
 package router
 
 import (
-	"strings"
+	"net/url"
 
 	"github.com/cloudfoundry/gorouter/route"
 )
@@ -15,12 +15,29 @@ type RegistryMessage struct {
 	StaleThresholdInSeconds int               `json:"stale_threshold_in_seconds"`
 	RouteServiceUrl         string            `json:"route_service_url"`
 	PrivateInstanceId       string            `json:"private_instance_id"`
+	IsRouteService          bool              `json:"is_route_service"`
+
+	RouteServiceSkipSslValidation bool `json:"route_service_skip_ssl_validation"`
 }
 
 func (rm *RegistryMessage) makeEndpoint() *route.Endpoint {
-	return route.NewEndpoint(rm.App, rm.Host, rm.Port, rm.PrivateInstanceId, rm.Tags, rm.StaleThresholdInSeconds, rm.RouteServiceUrl)
+	endpoint := route.NewEndpoint(rm.App, rm.Host, rm.Port, rm.PrivateInstanceId, rm.Tags, rm.StaleThresholdInSeconds, rm.RouteServiceUrl)
+	endpoint.IsRouteService = rm.IsRouteService
+	endpoint.RouteServiceSkipSslValidation = rm.RouteServiceSkipSslValidation
+	return endpoint
 }
 
+// ValidateMessage rejects registrations whose route service url could not be
+// forwarded to, so that they fail when registered rather than on every
+// request.
 func (rm *RegistryMessage) ValidateMessage() bool {
-	return rm.RouteServiceUrl == "" || strings.HasPrefix(rm.RouteServiceUrl, "https")
+	if rm.RouteServiceUrl == "" {
+		return true
+	}
+
+	u, err := url.Parse(rm.RouteServiceUrl)
+	if err != nil {
+		return false
+	}
+	return u.Scheme == "https" && u.Host != ""
 }
@@ -59,5 +59,67 @@ var _ = Describe("RegistryMessage", func() {
 				Expect(message.ValidateMessage()).To(BeFalse())
 			})
 		})
+
+		Describe("With a payload with a malformed route service url", func() {
+			BeforeEach(func() {
+				payload = []byte(`{"dea":"dea1","app":"app1","uris":["test.com"],"host":"1.2.3.4","port":1234,"tags":{},"route_service_url":"https://bad%20hostname.com","private_instance_id":"private_instance_id"}`)
+			})
+
+			It("fails validation", func() {
+				Expect(message.ValidateMessage()).To(BeFalse())
+			})
+		})
+
+		Describe("With a payload with a route service url without a host", func() {
+			BeforeEach(func() {
+				payload = []byte(`{"dea":"dea1","app":"app1","uris":["test.com"],"host":"1.2.3.4","port":1234,"tags":{},"route_service_url":"https:///path","private_instance_id":"private_instance_id"}`)
+			})
+
+			It("fails validation", func() {
+				Expect(message.ValidateMessage()).To(BeFalse())
+			})
+		})
+
+		Describe("With a payload with a route service url with an https-like scheme", func() {
+			BeforeEach(func() {
+				payload = []byte(`{"dea":"dea1","app":"app1","uris":["test.com"],"host":"1.2.3.4","port":1234,"tags":{},"route_service_url":"httpsx://www.my-route.me","private_instance_id":"private_instance_id"}`)
+			})
+
+			It("fails validation", func() {
+				Expect(message.ValidateMessage()).To(BeFalse())
+			})
+		})
+	})
+
+	Describe("IsRouteService", func() {
+		It("is read from the registration", func() {
+			message := new(RegistryMessage)
+			err := json.Unmarshal([]byte(`{"app":"app1","uris":["rs.com"],"host":"1.2.3.4","port":1234,"is_route_service":true}`), message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message.IsRouteService).To(BeTrue())
+		})
+
+		It("defaults to false", func() {
+			message := new(RegistryMessage)
+			err := json.Unmarshal([]byte(`{"app":"app1","uris":["test.com"],"host":"1.2.3.4","port":1234}`), message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message.IsRouteService).To(BeFalse())
+		})
+	})
+
+	Describe("RouteServiceSkipSslValidation", func() {
+		It("is read from the registration", func() {
+			message := new(RegistryMessage)
+			err := json.Unmarshal([]byte(`{"app":"app1","uris":["legacy.com"],"host":"1.2.3.4","port":1234,"route_service_url":"https://rs.legacy.com","route_service_skip_ssl_validation":true}`), message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message.RouteServiceSkipSslValidation).To(BeTrue())
+		})
+
+		It("defaults to false", func() {
+			message := new(RegistryMessage)
+			err := json.Unmarshal([]byte(`{"app":"app1","uris":["test.com"],"host":"1.2.3.4","port":1234,"route_service_url":"https://rs.com"}`), message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(message.RouteServiceSkipSslValidation).To(BeFalse())
+		})
 	})
 })
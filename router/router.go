@@ -226,6 +226,8 @@ func (r *Router) Stop() {
 	r.closeIdleConns()
 	r.connLock.Unlock()
 
+	r.proxy.CloseIdleConnections()
+
 	r.component.Stop()
 }
 
@@ -416,7 +418,7 @@ func (r *Router) subscribeRegistry(subject string, successCallback func(*Registr
 		r.logger.Debugd(map[string]interface{}{"message": msg}, logMessage)
 
 		if !msg.ValidateMessage() {
-			logMessage := fmt.Sprintf("%s: Unable to validate message. route_service_url must be https", subject)
+			logMessage := fmt.Sprintf("%s: Unable to validate message. route_service_url must be a valid https url", subject)
 			r.logger.Warnd(map[string]interface{}{"message": msg}, logMessage)
 			return
 		}
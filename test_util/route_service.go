@@ -0,0 +1,108 @@
+package test_util
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"path/filepath"
+	"runtime"
+	"sync"
+
+	"github.com/cloudfoundry/gorouter/route_service"
+
+	. "github.com/onsi/gomega"
+)
+
+// RouteServiceRequest is what a RouteService saw of a request sent to it.
+type RouteServiceRequest struct {
+	Signature    string
+	Metadata     string
+	ForwardedUrl string
+	Header       http.Header
+	Host         string
+
+	// The server name the router asked for in the TLS handshake.
+	ServerName string
+}
+
+// RouteService is a route service listening for TLS on localhost. It records
+// the requests it receives and answers them with its handler. Its certificate
+// is not trusted, so the router under test must skip validation.
+type RouteService struct {
+	listener net.Listener
+
+	mutex    sync.Mutex
+	handler  http.Handler
+	requests []RouteServiceRequest
+}
+
+// NewRouteService starts a route service answering with handler, or with an
+// empty 200 when handler is nil.
+func NewRouteService(handler http.Handler) *RouteService {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+
+	_, filename, _, _ := runtime.Caller(0)
+	testPath, err := filepath.Abs(filepath.Join(filename, "..", "..", "test", "assets"))
+	Expect(err).NotTo(HaveOccurred())
+
+	cert, err := tls.LoadX509KeyPair(filepath.Join(testPath, "public.pem"), filepath.Join(testPath, "private.pem"))
+	Expect(err).NotTo(HaveOccurred())
+
+	rs := &RouteService{
+		listener: tls.NewListener(ln, &tls.Config{Certificates: []tls.Certificate{cert}}),
+		handler:  handler,
+	}
+
+	go http.Serve(rs.listener, rs)
+
+	return rs
+}
+
+func (rs *RouteService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rs.mutex.Lock()
+	rs.requests = append(rs.requests, RouteServiceRequest{
+		Signature:    r.Header.Get(route_service.RouteServiceSignature),
+		Metadata:     r.Header.Get(route_service.RouteServiceMetadata),
+		ForwardedUrl: r.Header.Get(route_service.RouteServiceForwardedUrl),
+		Header:       r.Header,
+		Host:         r.Host,
+		ServerName:   r.TLS.ServerName,
+	})
+	handler := rs.handler
+	rs.mutex.Unlock()
+
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// SetHandler changes the response given to subsequent requests.
+func (rs *RouteService) SetHandler(handler http.Handler) {
+	rs.mutex.Lock()
+	rs.handler = handler
+	rs.mutex.Unlock()
+}
+
+// Url is the route service url to register routes with.
+func (rs *RouteService) Url() string {
+	return "https://" + rs.listener.Addr().String()
+}
+
+// Port is the port the route service listens on.
+func (rs *RouteService) Port() string {
+	_, port, _ := net.SplitHostPort(rs.listener.Addr().String())
+	return port
+}
+
+// Requests returns the requests received so far, oldest first.
+func (rs *RouteService) Requests() []RouteServiceRequest {
+	rs.mutex.Lock()
+	defer rs.mutex.Unlock()
+
+	return append([]RouteServiceRequest{}, rs.requests...)
+}
+
+func (rs *RouteService) Close() {
+	rs.listener.Close()
+}
@@ -13,6 +13,14 @@ import (
 	metrics "github.com/rcrowley/go-metrics"
 )
 
+// Route service hosts come from service bindings, so there is no telling how
+// many there are. Past the first MaxRouteServiceTags, responses from new hosts
+// are all counted under OtherRouteServiceTag.
+const (
+	MaxRouteServiceTags  = 100
+	OtherRouteServiceTag = "other"
+)
+
 type topAppsEntry struct {
 	ApplicationId     string `json:"application_id"`
 	RequestsPerSecond int64  `json:"rps"`
@@ -22,7 +30,8 @@ type topAppsEntry struct {
 type varz struct {
 	All  *HttpMetric `json:"all"`
 	Tags struct {
-		Component TaggedHttpMetric `json:"component"`
+		Component    TaggedHttpMetric `json:"component"`
+		RouteService TaggedHttpMetric `json:"route_service"`
 	} `json:"tags"`
 
 	Urls     int `json:"urls"`
@@ -32,6 +41,9 @@ type varz struct {
 	BadGateways    int     `json:"bad_gateways"`
 	RequestsPerSec float64 `json:"requests_per_sec"`
 
+	RouteServiceRequestsInFlight int64              `json:"route_service_requests_in_flight"`
+	RouteServiceSignatureAge     *DurationHistogram `json:"route_service_signature_age"`
+
 	TopApps []topAppsEntry `json:"top10_app_requests"`
 
 	MillisSinceLastRegistryUpdate int64 `json:"ms_since_last_registry_update"`
@@ -132,6 +144,32 @@ func (x *HttpMetric) CaptureResponse(response *http.Response, duration time.Dura
 	x.Latency.Update(duration.Nanoseconds())
 }
 
+// DurationHistogram reports the percentiles of the durations it is updated
+// with, in seconds.
+type DurationHistogram struct {
+	metrics.Histogram
+}
+
+func NewDurationHistogram() *DurationHistogram {
+	return &DurationHistogram{metrics.NewHistogram(metrics.NewExpDecaySample(1028, 0.015))}
+}
+
+func (x *DurationHistogram) MarshalJSON() ([]byte, error) {
+	p := []float64{0.50, 0.75, 0.90, 0.95, 0.99}
+	z := x.Percentiles(p)
+
+	y := make(map[string]float64)
+	for i, e := range p {
+		y[fmt.Sprintf("%d", int(e*100))] = z[i] / float64(time.Second)
+	}
+
+	return json.Marshal(y)
+}
+
+func (x *DurationHistogram) Capture(duration time.Duration) {
+	x.Update(duration.Nanoseconds())
+}
+
 type TaggedHttpMetric map[string]*HttpMetric
 
 func NewTaggedHttpMetric() TaggedHttpMetric {
@@ -166,6 +204,10 @@ type Varz interface {
 	CaptureBadGateway(req *http.Request)
 	CaptureRoutingRequest(b *route.Endpoint, req *http.Request)
 	CaptureRoutingResponse(b *route.Endpoint, res *http.Response, startedAt time.Time, d time.Duration)
+	CaptureRouteServiceResponse(host string, res *http.Response, d time.Duration)
+	CaptureRouteServiceRequestStarted()
+	CaptureRouteServiceRequestFinished()
+	CaptureRouteServiceSignatureAge(d time.Duration)
 }
 
 type RealVarz struct {
@@ -184,6 +226,8 @@ func NewVarz(r *registry.RouteRegistry) Varz {
 
 	x.All = NewHttpMetric()
 	x.Tags.Component = make(map[string]*HttpMetric)
+	x.Tags.RouteService = make(map[string]*HttpMetric)
+	x.RouteServiceSignatureAge = NewDurationHistogram()
 
 	return x
 }
@@ -279,6 +323,41 @@ func (x *RealVarz) CaptureRoutingResponse(endpoint *route.Endpoint, response *ht
 	x.Unlock()
 }
 
+func (x *RealVarz) CaptureRouteServiceResponse(host string, response *http.Response, duration time.Duration) {
+	x.Lock()
+
+	tag := host
+	_, ok := x.varz.Tags.RouteService[tag]
+	if !ok && len(x.varz.Tags.RouteService) >= MaxRouteServiceTags {
+		tag = OtherRouteServiceTag
+	}
+	x.varz.Tags.RouteService.CaptureResponse(tag, response, duration)
+
+	x.Unlock()
+}
+
+// CaptureRouteServiceRequestStarted and CaptureRouteServiceRequestFinished
+// track the requests that are out with a route service.
+func (x *RealVarz) CaptureRouteServiceRequestStarted() {
+	x.Lock()
+	x.RouteServiceRequestsInFlight++
+	x.Unlock()
+}
+
+func (x *RealVarz) CaptureRouteServiceRequestFinished() {
+	x.Lock()
+	x.RouteServiceRequestsInFlight--
+	x.Unlock()
+}
+
+// CaptureRouteServiceSignatureAge records how old a route service signature
+// was when it came back to the router.
+func (x *RealVarz) CaptureRouteServiceSignatureAge(age time.Duration) {
+	x.Lock()
+	x.RouteServiceSignatureAge.Capture(age)
+	x.Unlock()
+}
+
 func transform(x interface{}, y map[string]interface{}) error {
 	var b []byte
 	var err error
@@ -41,6 +41,7 @@ var _ = Describe("Varz", func() {
 			"requests",
 			"bad_requests",
 			"bad_gateways",
+			"route_service_requests_in_flight",
 			"requests_per_sec",
 			"top10_app_requests",
 			"ms_since_last_registry_update",
@@ -204,6 +205,55 @@ var _ = Describe("Varz", func() {
 		Expect(findValue(Varz, "latency", "95").(float64)).To(Equal(float64(duration) / float64(time.Second)))
 		Expect(findValue(Varz, "latency", "99").(float64)).To(Equal(float64(duration) / float64(time.Second)))
 	})
+
+	It("updates route service latency by host", func() {
+		var duration = 1 * time.Millisecond
+
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+		}
+
+		Varz.CaptureRouteServiceResponse("rs.example.com", response, duration)
+
+		Expect(findValue(Varz, "tags", "route_service", "rs.example.com", "responses_2xx")).To(Equal(float64(1)))
+		Expect(findValue(Varz, "tags", "route_service", "rs.example.com", "latency", "50").(float64)).To(Equal(float64(duration) / float64(time.Second)))
+		Expect(findValue(Varz, "latency", "50")).To(Equal(float64(0)))
+	})
+
+	It("counts route service hosts past the first ones under other", func() {
+		response := &http.Response{
+			StatusCode: http.StatusOK,
+		}
+
+		for i := 0; i < MaxRouteServiceTags+3; i++ {
+			Varz.CaptureRouteServiceResponse(fmt.Sprintf("rs%d.example.com", i), response, time.Millisecond)
+		}
+		Varz.CaptureRouteServiceResponse("rs0.example.com", response, time.Millisecond)
+
+		Expect(findValue(Varz, "tags", "route_service", "rs0.example.com", "responses_2xx")).To(Equal(float64(2)))
+		Expect(findValue(Varz, "tags", "route_service", OtherRouteServiceTag, "responses_2xx")).To(Equal(float64(3)))
+
+		routeServices := findValue(Varz, "tags", "route_service").(map[string]interface{})
+		Expect(routeServices).To(HaveLen(MaxRouteServiceTags + 1))
+		Expect(routeServices).ToNot(HaveKey(fmt.Sprintf("rs%d.example.com", MaxRouteServiceTags)))
+	})
+
+	It("tracks route service requests in flight", func() {
+		Varz.CaptureRouteServiceRequestStarted()
+		Varz.CaptureRouteServiceRequestStarted()
+		Expect(findValue(Varz, "route_service_requests_in_flight")).To(Equal(float64(2)))
+
+		Varz.CaptureRouteServiceRequestFinished()
+		Varz.CaptureRouteServiceRequestFinished()
+		Expect(findValue(Varz, "route_service_requests_in_flight")).To(Equal(float64(0)))
+	})
+
+	It("updates the age of route service signatures", func() {
+		Varz.CaptureRouteServiceSignatureAge(42 * time.Second)
+
+		Expect(findValue(Varz, "route_service_signature_age", "50")).To(Equal(float64(42)))
+		Expect(findValue(Varz, "route_service_signature_age", "99")).To(Equal(float64(42)))
+	})
 })
 
 // Extract value using key(s) from JSON data